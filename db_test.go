@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"minisql/engine"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestHandleCreateTable(t *testing.T) {
@@ -187,3 +196,1890 @@ func TestWALRecovery(t *testing.T) {
 		t.Errorf("wal file not cleared")
 	}
 }
+
+func TestIndexPersistence(t *testing.T) {
+	_ = os.Remove("data.mdb")
+	_ = os.Remove("data.wal")
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE people (id INT, name TEXT)")
+	_, _ = engine.HandleCommand("INSERT INTO people VALUES (1, 'Alice')")
+	_, _ = engine.HandleCommand("INSERT INTO people VALUES (2, 'Bob')")
+	if _, err := engine.HandleCommand("CREATE INDEX ON people(id)"); err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	table := engine.Tables["people"]
+	if table == nil || table.Indexes["id"] == nil {
+		t.Fatalf("index not restored: %+v", table)
+	}
+	if rows := table.Indexes["id"].Lookup(2); len(rows) != 1 || rows[0] != 1 {
+		t.Errorf("index not rebuilt correctly: %v", rows)
+	}
+
+	if err := engine.SaveSQLDump("test_index_dump.sql"); err != nil {
+		t.Fatalf("dump failed: %v", err)
+	}
+	data, err := os.ReadFile("test_index_dump.sql")
+	if err != nil {
+		t.Fatalf("read dump failed: %v", err)
+	}
+	_ = os.Remove("test_index_dump.sql")
+	if !strings.Contains(string(data), "CREATE INDEX ON people(id);") {
+		t.Errorf("dump does not contain index: %s", data)
+	}
+}
+
+func TestOrderedIndexQueries(t *testing.T) {
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE items (id INT, name TEXT)")
+	_, _ = engine.HandleCommand("CREATE INDEX ON items(id)")
+	_, _ = engine.HandleCommand("CREATE INDEX ON items(name)")
+	for i := 200; i > 0; i-- {
+		q := fmt.Sprintf("INSERT INTO items VALUES (%d, 'item%03d')", i, i)
+		if _, err := engine.HandleCommand(q); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT id FROM items WHERE id BETWEEN 10 AND 12", []string{"10", "11", "12"}},
+		{"SELECT id FROM items WHERE id > 197", []string{"198", "199", "200"}},
+		{"SELECT id FROM items WHERE id < 50 AND id >= 48 ORDER BY id DESC", []string{"49", "48"}},
+		{"SELECT id FROM items ORDER BY id LIMIT 3", []string{"1", "2", "3"}},
+		{"SELECT id FROM items ORDER BY id DESC LIMIT 2", []string{"200", "199"}},
+		{"SELECT name FROM items WHERE name LIKE 'item10%'", []string{"item100", "item101", "item102", "item103", "item104", "item105", "item106", "item107", "item108", "item109"}},
+		{"SELECT MIN(id), MAX(name) FROM items", []string{"1\titem200"}},
+		{"SELECT MAX(id) FROM items WHERE id < 42", []string{"41"}},
+	}
+	for _, c := range cases {
+		res, err := engine.HandleCommand(c.query)
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		lines := strings.Split(strings.TrimSpace(res), "\n")[1:]
+		if strings.Join(lines, ",") != strings.Join(c.want, ",") {
+			t.Errorf("%s: got %v, want %v", c.query, lines, c.want)
+		}
+	}
+}
+
+func TestFloatNaNOrdering(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE samples (v FLOAT)")
+	for _, v := range []string{"1.5", "NaN", "-2", "3", "NaN"} {
+		if _, err := engine.HandleCommand("INSERT INTO samples VALUES (" + v + ")"); err != nil {
+			t.Fatalf("insert %s: %v", v, err)
+		}
+	}
+	// NaN sorts after every number and equals only itself, with or without
+	// an index.
+	for _, index := range []bool{false, true} {
+		if index {
+			_, _ = engine.HandleCommand("CREATE INDEX ON samples(v)")
+		}
+		for _, c := range []struct{ query, want string }{
+			{"SELECT v FROM samples WHERE v = 1.5", "v\n1.5\n"},
+			{"SELECT v FROM samples WHERE v > 2 ORDER BY v", "v\n3\nNaN\nNaN\n"},
+			{"SELECT v FROM samples WHERE v = NaN", "v\nNaN\nNaN\n"},
+			{"SELECT v FROM samples ORDER BY v", "v\n-2\n1.5\n3\nNaN\nNaN\n"},
+		} {
+			if res, _ := engine.HandleCommand(c.query); res != c.want {
+				t.Errorf("%s (index %v): got %q", c.query, index, res)
+			}
+		}
+	}
+}
+
+func TestUniqueConstraints(t *testing.T) {
+	engine.Tables = make(map[string]*engine.Table)
+
+	if _, err := engine.HandleCommand("CREATE TABLE accounts (id INT PRIMARY KEY, email TEXT UNIQUE, name TEXT)"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	table := engine.Tables["accounts"]
+	if !table.Columns[0].PrimaryKey || !table.Columns[1].Unique {
+		t.Fatalf("constraints not parsed: %+v", table.Columns)
+	}
+	if idx := table.Indexes["id"]; idx == nil || !idx.Unique {
+		t.Fatalf("primary key is not backed by a unique index")
+	}
+
+	_, _ = engine.HandleCommand("INSERT INTO accounts VALUES (1, 'a@example.com', 'Alice')")
+	_, _ = engine.HandleCommand("INSERT INTO accounts VALUES (2, 'b@example.com', 'Bob')")
+
+	_, err := engine.HandleCommand("INSERT INTO accounts VALUES (1, 'c@example.com', 'Carl')")
+	if !errors.Is(err, engine.ErrConstraint) || !strings.Contains(err.Error(), "PRIMARY KEY") {
+		t.Errorf("expected primary key violation, got %v", err)
+	}
+	if _, err := engine.HandleCommand("UPDATE accounts SET email='a@example.com' WHERE id=2"); !errors.Is(err, engine.ErrConstraint) {
+		t.Errorf("expected unique violation on update, got %v", err)
+	}
+	if _, err := engine.HandleCommand("UPDATE accounts SET id=3 WHERE id=2"); err != nil {
+		t.Fatalf("update of key failed: %v", err)
+	}
+	if _, err := engine.HandleCommand("INSERT INTO accounts VALUES (3, 'd@example.com', 'Dan')"); !errors.Is(err, engine.ErrConstraint) {
+		t.Errorf("updated key not enforced, got %v", err)
+	}
+	if _, err := engine.HandleCommand("INSERT INTO accounts VALUES (2, 'b2@example.com', 'Bob')"); err != nil {
+		t.Errorf("freed key rejected: %v", err)
+	}
+	if len(table.Rows) != 3 {
+		t.Errorf("expected 3 rows, got %d", len(table.Rows))
+	}
+
+	if _, err := engine.HandleCommand("CREATE UNIQUE INDEX ON accounts(name)"); !errors.Is(err, engine.ErrConstraint) {
+		t.Errorf("unique index over duplicates should fail, got %v", err)
+	}
+}
+
+func TestCompositeIndex(t *testing.T) {
+	_ = os.Remove("data.mdb")
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE memberships (tenant_id INT, user_id INT, role TEXT)")
+	for tenant := 1; tenant <= 3; tenant++ {
+		for user := 1; user <= 4; user++ {
+			q := fmt.Sprintf("INSERT INTO memberships VALUES (%d, %d, 'r%d%d')", tenant, user, tenant, user)
+			if _, err := engine.HandleCommand(q); err != nil {
+				t.Fatalf("insert: %v", err)
+			}
+		}
+	}
+	if _, err := engine.HandleCommand("CREATE UNIQUE INDEX ON memberships(tenant_id, user_id)"); err != nil {
+		t.Fatalf("create index: %v", err)
+	}
+	idx := engine.Tables["memberships"].Indexes["tenant_id,user_id"]
+	if idx == nil || len(idx.Columns) != 2 {
+		t.Fatalf("composite index not registered: %+v", engine.Tables["memberships"].Indexes)
+	}
+	if rows := idx.Lookup(2, 3); len(rows) != 1 || rows[0] != 6 {
+		t.Errorf("unexpected lookup result: %v", rows)
+	}
+
+	res, err := engine.HandleCommand("SELECT role FROM memberships WHERE user_id=3 AND tenant_id=2")
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if strings.TrimSpace(res) != "role\nr23" {
+		t.Errorf("unexpected full key result: %q", res)
+	}
+	res, err = engine.HandleCommand("SELECT role FROM memberships WHERE tenant_id=3 AND role != 'r32'")
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if strings.TrimSpace(res) != "role\nr31\nr33\nr34" {
+		t.Errorf("unexpected prefix result: %q", res)
+	}
+
+	if _, err := engine.HandleCommand("INSERT INTO memberships VALUES (1, 2, 'dup')"); !errors.Is(err, engine.ErrConstraint) {
+		t.Errorf("expected composite unique violation, got %v", err)
+	}
+	if _, err := engine.HandleCommand("INSERT INTO memberships VALUES (1, 5, 'new')"); err != nil {
+		t.Errorf("insert with new key failed: %v", err)
+	}
+
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	idx = engine.Tables["memberships"].Indexes["tenant_id,user_id"]
+	if idx == nil || !idx.Unique || len(idx.Lookup(1, 5)) != 1 {
+		t.Errorf("composite index not restored: %+v", idx)
+	}
+}
+
+func TestUpdateMaintainsIndexes(t *testing.T) {
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE stock (sku INT, qty INT)")
+	_, _ = engine.HandleCommand("CREATE INDEX ON stock(sku)")
+	_, _ = engine.HandleCommand("CREATE INDEX ON stock(qty)")
+	for i := 1; i <= 5; i++ {
+		_, _ = engine.HandleCommand(fmt.Sprintf("INSERT INTO stock VALUES (%d, %d)", i, i*10))
+	}
+
+	resp, err := engine.HandleCommand("UPDATE stock SET sku=100 WHERE sku=2")
+	if err != nil || !strings.Contains(resp, "1 rows updated") {
+		t.Fatalf("update by index failed: %v %s", err, resp)
+	}
+	resp, err = engine.HandleCommand("UPDATE stock SET qty=0 WHERE qty >= 40")
+	if err != nil || !strings.Contains(resp, "2 rows updated") {
+		t.Fatalf("range update failed: %v %s", err, resp)
+	}
+
+	idx := engine.Tables["stock"].Indexes["sku"]
+	if len(idx.Lookup(2)) != 0 || len(idx.Lookup(100)) != 1 {
+		t.Errorf("sku index not updated: old=%v new=%v", idx.Lookup(2), idx.Lookup(100))
+	}
+	if rows := engine.Tables["stock"].Indexes["qty"].Lookup(0); len(rows) != 2 {
+		t.Errorf("qty index not updated: %v", rows)
+	}
+
+	res, err := engine.HandleCommand("SELECT sku FROM stock WHERE sku=100")
+	if err != nil || strings.TrimSpace(res) != "sku\n100" {
+		t.Errorf("select by updated key: %v %q", err, res)
+	}
+	res, err = engine.HandleCommand("SELECT sku FROM stock WHERE qty=0 ORDER BY sku")
+	if err != nil || strings.TrimSpace(res) != "sku\n4\n5" {
+		t.Errorf("select by updated value: %v %q", err, res)
+	}
+}
+
+func TestResultCacheInvalidation(t *testing.T) {
+	engine.Tables = make(map[string]*engine.Table)
+	engine.InitCache(1 << 16)
+	defer engine.InitCache(0)
+
+	_, _ = engine.HandleCommand("CREATE TABLE cached (id INT, name TEXT)")
+	_, _ = engine.HandleCommand("INSERT INTO cached VALUES (1, 'a')")
+	_, _ = engine.HandleCommand("SELECT * FROM cached")
+	_, _ = engine.HandleCommand("SELECT * FROM cached")
+	if s := engine.ResultCacheStats(); s.Hits != 1 || s.Misses != 1 || s.Entries != 1 {
+		t.Fatalf("unexpected stats after repeated select: %+v", s)
+	}
+
+	_, _ = engine.HandleCommand("INSERT INTO cached VALUES (2, 'b')")
+	res, _ := engine.HandleCommand("SELECT * FROM cached")
+	if !strings.Contains(res, "2\tb") {
+		t.Errorf("stale result after insert: %q", res)
+	}
+	_, _ = engine.HandleCommand("UPDATE cached SET name='c' WHERE id=2")
+	res, _ = engine.HandleCommand("SELECT * FROM cached")
+	if !strings.Contains(res, "2\tc") {
+		t.Errorf("stale result after update: %q", res)
+	}
+
+	tx := engine.BeginTx()
+	if _, err := tx.Exec("INSERT INTO cached VALUES (3, 'd')"); err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+	if res, _ := tx.Exec("SELECT * FROM cached"); !strings.Contains(res, "3\td") {
+		t.Errorf("transaction does not see its own write: %q", res)
+	}
+	tx.Rollback()
+	res, _ = engine.HandleCommand("SELECT * FROM cached")
+	if strings.Contains(res, "3\td") {
+		t.Errorf("uncommitted row visible after rollback: %q", res)
+	}
+
+	if s := engine.ResultCacheStats(); s.Invalidations < 2 {
+		t.Errorf("invalidations not counted: %+v", s)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE staff (id INT PRIMARY KEY, name TEXT, age INT)")
+	_, _ = engine.HandleCommand("CREATE INDEX ON staff(age)")
+	for i := 1; i <= 20; i++ {
+		_, _ = engine.HandleCommand(fmt.Sprintf("INSERT INTO staff VALUES (%d, 'n%d', %d)", i, i, 20+i))
+	}
+
+	res, err := engine.HandleCommand("EXPLAIN SELECT name FROM staff WHERE id = 7")
+	if err != nil {
+		t.Fatalf("explain: %v", err)
+	}
+	if !strings.Contains(res, "IndexLookup staff using index (id): id = 7") {
+		t.Errorf("primary key lookup not used:\n%s", res)
+	}
+
+	res, _ = engine.HandleCommand("EXPLAIN SELECT name FROM staff WHERE age >= 35 AND name LIKE 'n1%' ORDER BY age DESC LIMIT 3")
+	want := "plan\n" +
+		"Project: name\n" +
+		"  Limit: 3\n" +
+		"    Filter: name LIKE 'n1%'\n" +
+		"      IndexScan staff using index (age) DESC: age >= 35 (est. rows 7)\n"
+	if res != want {
+		t.Errorf("unexpected range plan:\n%s", res)
+	}
+
+	res, _ = engine.HandleCommand("EXPLAIN SELECT * FROM staff ORDER BY name")
+	if !strings.Contains(res, "Sort: name") || !strings.Contains(res, "TableScan staff (rows 20)") {
+		t.Errorf("unindexed ORDER BY should sort a table scan:\n%s", res)
+	}
+
+	if _, err := engine.HandleCommand("EXPLAIN UPDATE staff SET age=1 WHERE id=1"); err == nil {
+		t.Errorf("expected error for EXPLAIN of UPDATE")
+	}
+}
+
+func TestAnalyzeStatistics(t *testing.T) {
+	_ = os.Remove("data.mdb")
+	_ = os.Remove("data.wal")
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE readings (id INT PRIMARY KEY, sensor TEXT, value INT)")
+	_, _ = engine.HandleCommand("CREATE INDEX ON readings(value)")
+	for i := 0; i < 100; i++ {
+		_, _ = engine.HandleCommand(fmt.Sprintf("INSERT INTO readings VALUES (%d, 's%d', %d)", i, i%4, i))
+	}
+
+	query := "EXPLAIN SELECT id FROM readings WHERE value >= 90"
+	res, _ := engine.HandleCommand(query)
+	if !strings.Contains(res, "(est. rows 34)") {
+		t.Errorf("expected default range estimate before ANALYZE:\n%s", res)
+	}
+
+	if _, err := engine.HandleCommand("ANALYZE readings"); err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	res, _ = engine.HandleCommand(query)
+	if !strings.Contains(res, "(est. rows 10)") {
+		t.Errorf("expected estimate from statistics after ANALYZE:\n%s", res)
+	}
+
+	res, err := engine.HandleCommand("SELECT column_name, distinct_count, min_value, max_value FROM minidb_stats WHERE table_name = 'readings'")
+	if err != nil {
+		t.Fatalf("select stats: %v", err)
+	}
+	want := "column_name\tdistinct_count\tmin_value\tmax_value\n" +
+		"id\t100\t0\t99\n" +
+		"sensor\t4\ts0\ts3\n" +
+		"value\t100\t0\t99\n"
+	if res != want {
+		t.Errorf("unexpected statistics:\n%s", res)
+	}
+
+	if _, err := engine.HandleCommand("ANALYZE missing"); err == nil {
+		t.Errorf("expected error for unknown table")
+	}
+	if _, err := engine.HandleCommand("CREATE TABLE minidb_stats (a INT)"); err == nil {
+		t.Errorf("expected error for reserved table name")
+	}
+
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	stats := engine.Tables["readings"].Stats
+	if stats == nil || stats.Rows != 100 || len(stats.Columns) != 3 {
+		t.Fatalf("statistics not restored: %+v", stats)
+	}
+	if cs := stats.Columns[2]; cs.Min != 0 || cs.Max != 99 || cs.Distinct != 100 {
+		t.Errorf("column statistics not restored: %+v", cs)
+	}
+}
+
+func TestSystemCatalog(t *testing.T) {
+	engine.Tables = make(map[string]*engine.Table)
+	engine.InitCache(1 << 16)
+	defer engine.InitCache(0)
+
+	_, _ = engine.HandleCommand("CREATE TABLE orders (id INT PRIMARY KEY, customer TEXT, total FLOAT)")
+	_, _ = engine.HandleCommand("CREATE TABLE customers (name TEXT UNIQUE)")
+	_, _ = engine.HandleCommand("CREATE INDEX ON orders(customer, total)")
+
+	res, err := engine.HandleCommand("SHOW TABLES")
+	if err != nil || res != "table_name\ncustomers\norders\n" {
+		t.Errorf("show tables: %v %q", err, res)
+	}
+
+	res, err = engine.HandleCommand("DESCRIBE orders")
+	header := "column_name\ttype\tprimary_key\tunique\tautoincrement\tdefault_value\tcheck_condition\treferences\ton_delete\n"
+	want := header +
+		"id\tINT\ttrue\tfalse\tfalse\tNULL\tNULL\tNULL\tNULL\n" +
+		"customer\tTEXT\tfalse\tfalse\tfalse\tNULL\tNULL\tNULL\tNULL\n" +
+		"total\tFLOAT\tfalse\tfalse\tfalse\tNULL\tNULL\tNULL\tNULL\n"
+	if err != nil || res != want {
+		t.Errorf("describe: %v %q", err, res)
+	}
+	if _, err := engine.HandleCommand("DESCRIBE missing"); err == nil {
+		t.Errorf("expected error for unknown table")
+	}
+
+	// Every column constraint is listed, not only PRIMARY KEY and UNIQUE.
+	_, _ = engine.HandleCommand("CREATE TABLE shipments (id SERIAL PRIMARY KEY, " +
+		"order_id INT REFERENCES orders(id) ON DELETE CASCADE, weight FLOAT DEFAULT 1.5 CHECK (weight > 0))")
+	res, err = engine.HandleCommand("DESCRIBE shipments")
+	want = header +
+		"id\tINT\ttrue\tfalse\ttrue\tNULL\tNULL\tNULL\tNULL\n" +
+		"order_id\tINT\tfalse\tfalse\tfalse\tNULL\tNULL\torders(id)\tCASCADE\n" +
+		"weight\tFLOAT\tfalse\tfalse\tfalse\t1.5\tweight > 0\tNULL\tNULL\n"
+	if err != nil || res != want {
+		t.Errorf("describe constraints: %v %q", err, res)
+	}
+	res, _ = engine.HandleCommand("SELECT column_name FROM minidb_columns WHERE on_delete = 'CASCADE'")
+	if res != "column_name\norder_id\n" {
+		t.Errorf("unexpected columns: %q", res)
+	}
+
+	res, _ = engine.HandleCommand("SELECT index_name, columns, unique FROM minidb_indexes WHERE table_name = 'orders'")
+	if res != "index_name\tcolumns\tunique\ncustomer,total\tcustomer, total\tfalse\nid\tid\ttrue\n" {
+		t.Errorf("unexpected indexes: %q", res)
+	}
+
+	// Catalog tables reflect writes immediately instead of being cached.
+	_, _ = engine.HandleCommand("SELECT row_count FROM minidb_tables WHERE table_name = 'orders'")
+	_, _ = engine.HandleCommand("INSERT INTO orders VALUES (1, 'ann', 9.5)")
+	res, _ = engine.HandleCommand("SELECT row_count FROM minidb_tables WHERE table_name = 'orders'")
+	if res != "row_count\n1\n" {
+		t.Errorf("stale catalog: %q", res)
+	}
+}
+
+func TestExtendedTypes(t *testing.T) {
+	_ = os.Remove("data.mdb")
+	_ = os.Remove("data.wal")
+	engine.Tables = make(map[string]*engine.Table)
+
+	if _, err := engine.HandleCommand("CREATE TABLE payments (id BIGINT PRIMARY KEY, paid_at TIMESTAMP, due DATE, receipt BLOB, amount DECIMAL(10, 2))"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	inserts := []string{
+		"INSERT INTO payments VALUES (9000000001, '2024-03-01T10:15:30.5+02:00', '2024-03-31', X'CAFE', 19.999)",
+		"INSERT INTO payments VALUES (2, '2023-12-31 23:00:00', '2024-01-15', X'', -3.5)",
+	}
+	for _, q := range inserts {
+		if _, err := engine.HandleCommand(q); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	for _, q := range []string{
+		"INSERT INTO payments VALUES (3, 'yesterday', '2024-01-15', X'', 1)",
+		"INSERT INTO payments VALUES (3, '2024-01-01', '2024-02-30', X'', 1)",
+		"INSERT INTO payments VALUES (3, '2024-01-01', '2024-01-15', X'F', 1)",
+		"INSERT INTO payments VALUES (3, '2024-01-01', '2024-01-15', X'', 123456789)",
+	} {
+		if _, err := engine.HandleCommand(q); err == nil {
+			t.Errorf("expected error for %s", q)
+		}
+	}
+	if _, err := engine.HandleCommand("CREATE TABLE bad (a DECIMAL(30,2))"); err == nil {
+		t.Errorf("expected error for DECIMAL precision above 18")
+	}
+
+	want := "id\tpaid_at\tdue\treceipt\tamount\n" +
+		"9000000001\t2024-03-01T08:15:30.5Z\t2024-03-31\tcafe\t20.00\n" +
+		"2\t2023-12-31T23:00:00Z\t2024-01-15\t\t-3.50\n"
+	res, _ := engine.HandleCommand("SELECT * FROM payments")
+	if res != want {
+		t.Errorf("unexpected rows:\n%s", res)
+	}
+	res, _ = engine.HandleCommand("SELECT id FROM payments WHERE paid_at >= '2024-01-01' AND amount > 19.99 AND receipt = X'cafe'")
+	if res != "id\n9000000001\n" {
+		t.Errorf("typed comparison failed: %q", res)
+	}
+	res, _ = engine.HandleCommand("SELECT MIN(due), MAX(amount) FROM payments")
+	if res != "MIN(due)\tMAX(amount)\n2024-01-15\t20.00\n" {
+		t.Errorf("typed aggregates failed: %q", res)
+	}
+
+	if err := engine.SaveSQLDump("types_dump.sql"); err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	defer func() { _ = os.Remove("types_dump.sql") }()
+	dump, _ := os.ReadFile("types_dump.sql")
+	if !strings.Contains(string(dump), "amount DECIMAL(10,2)") ||
+		!strings.Contains(string(dump), "(9000000001, '2024-03-01T08:15:30.5Z', '2024-03-31', X'cafe', 20.00)") {
+		t.Errorf("unexpected dump:\n%s", dump)
+	}
+
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	res, _ = engine.HandleCommand("SELECT * FROM payments")
+	if res != want {
+		t.Errorf("rows changed after reload:\n%s", res)
+	}
+	if v := engine.Tables["payments"].Rows[0][3]; string(v.(engine.Blob)) != "\xca\xfe" {
+		t.Errorf("blob not restored as raw bytes: %#v", v)
+	}
+}
+
+func TestTypedEncodingMigration(t *testing.T) {
+	_ = os.Remove("data.wal")
+
+	// A v7 file stores every value as length-prefixed text.
+	var v7 bytes.Buffer
+	writeStr16 := func(s string) {
+		_ = binary.Write(&v7, binary.LittleEndian, uint16(len(s)))
+		v7.WriteString(s)
+	}
+	v7.WriteString("MYDB")
+	v7.WriteByte(7)
+	writeStr16("legacy")
+	_ = binary.Write(&v7, binary.LittleEndian, uint16(3))
+	for _, c := range [][2]string{{"id", "INT"}, {"ratio", "FLOAT"}, {"name", "TEXT"}} {
+		writeStr16(c[0])
+		v7.WriteByte(byte(len(c[1])))
+		v7.WriteString(c[1])
+		v7.WriteByte(0) // no column options
+	}
+	values := []string{"1", "0.25", "Ann", "oops", "1.5", "Bob"}
+	for i := 3; i <= 10; i++ {
+		// Enough rows for the savings to outweigh the framing of newer versions.
+		values = append(values, fmt.Sprint(i), "0.5", "Cy")
+	}
+	_ = binary.Write(&v7, binary.LittleEndian, uint64(len(values)/3))
+	for _, val := range values {
+		_ = binary.Write(&v7, binary.LittleEndian, uint32(len(val)))
+		v7.WriteString(val)
+	}
+	_ = binary.Write(&v7, binary.LittleEndian, uint16(0)) // no indexes
+	v7.WriteByte(0)                                       // no statistics
+	if err := os.WriteFile("data.mdb", v7.Bytes(), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("load v7: %v", err)
+	}
+	migrated, err := os.ReadFile("data.mdb")
+	if err != nil || len(migrated) < 5 || migrated[4] < 8 {
+		t.Fatalf("file not migrated to v8: %v", err)
+	}
+	if len(migrated) >= v7.Len() {
+		t.Errorf("typed encoding is not smaller: %d >= %d bytes", len(migrated), v7.Len())
+	}
+
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("load v8: %v", err)
+	}
+	rows := engine.Tables["legacy"].Rows
+	if len(rows) != 10 || rows[0][0] != 1 || rows[0][1] != 0.25 || rows[0][2] != "Ann" {
+		t.Errorf("typed values not preserved: %#v", rows)
+	}
+	// Values that never parsed into the column type are kept as text.
+	if rows[1][0] != "oops" || rows[1][1] != 1.5 {
+		t.Errorf("legacy value not preserved: %#v", rows[1])
+	}
+
+	if err := os.WriteFile("data.mdb", migrated[:len(migrated)-3], 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := engine.LoadBinaryDB(); err == nil {
+		t.Errorf("expected error for truncated file")
+	}
+	_ = os.Remove("data.mdb")
+}
+
+func TestColumnarStorage(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	engine.Tables = make(map[string]*engine.Table)
+
+	if _, err := engine.HandleCommand("CREATE TABLE m (id INT PRIMARY KEY, name TEXT, score FLOAT) WITH (storage=columnar)"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for _, q := range []string{
+		"INSERT INTO m VALUES (1, 'a', 2.5)",
+		"INSERT INTO m VALUES (2, 'b', 1.5)",
+		"INSERT INTO m VALUES (3, 'c', 9)",
+		"UPDATE m SET score = 0.5 WHERE id = 3",
+	} {
+		if _, err := engine.HandleCommand(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	if tbl := engine.Tables["m"]; tbl.Storage != engine.StorageColumnar || tbl.Rows != nil {
+		t.Fatalf("table not columnar: %q %v", tbl.Storage, tbl.Rows)
+	}
+
+	res, _ := engine.HandleCommand("SELECT name FROM m WHERE score > 1 ORDER BY score")
+	if res != "name\nb\na\n" {
+		t.Errorf("unexpected select: %q", res)
+	}
+	res, _ = engine.HandleCommand("EXPLAIN SELECT name FROM m WHERE score > 1")
+	if !strings.Contains(res, "ColumnScan m [name, score] (rows 3)") {
+		t.Errorf("scan reads unneeded columns:\n%s", res)
+	}
+	res, _ = engine.HandleCommand("SELECT MIN(score), MAX(name) FROM m")
+	if res != "MIN(score)\tMAX(name)\n0.5\tc\n" {
+		t.Errorf("unexpected aggregate: %q", res)
+	}
+	res, _ = engine.HandleCommand("EXPLAIN SELECT MIN(score) FROM m")
+	if !strings.Contains(res, "MIN(score) using column vector") {
+		t.Errorf("aggregate does not use the column vector:\n%s", res)
+	}
+	// NaN sorts after every number, as it does in row tables.
+	if _, err := engine.HandleCommand("INSERT INTO m VALUES (4, 'd', NaN)"); err != nil {
+		t.Fatalf("insert NaN: %v", err)
+	}
+	res, _ = engine.HandleCommand("SELECT MIN(score), MAX(score) FROM m")
+	if res != "MIN(score)\tMAX(score)\n0.5\tNaN\n" {
+		t.Errorf("unexpected aggregate with NaN: %q", res)
+	}
+
+	tx := engine.BeginTx()
+	_, _ = tx.Exec("UPDATE m SET name = 'z' WHERE id = 1")
+	tx.Rollback()
+	res, _ = engine.HandleCommand("SELECT name FROM m WHERE id = 1")
+	if res != "name\na\n" {
+		t.Errorf("rollback did not restore the column: %q", res)
+	}
+
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if engine.Tables["m"].Storage != engine.StorageColumnar {
+		t.Errorf("storage not persisted")
+	}
+	res, _ = engine.HandleCommand("SELECT * FROM m WHERE id = 3")
+	if res != "id\tname\tscore\n3\tc\t0.5\n" {
+		t.Errorf("unexpected row after reload: %q", res)
+	}
+
+	for _, q := range []string{
+		"CREATE TABLE bad (a INT) WITH (storage=heap)",
+		"CREATE TABLE bad (a INT) WITH (fill=1)",
+		"CREATE TABLE bad (a INT) junk",
+	} {
+		if _, err := engine.HandleCommand(q); err == nil {
+			t.Errorf("expected error for %s", q)
+		}
+	}
+}
+
+func TestCompressedDataFile(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer func() { engine.Compression = engine.CompressionNone }()
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE logs (id INT, level TEXT, message TEXT)")
+	for i := 0; i < 200; i++ {
+		_, _ = engine.HandleCommand(fmt.Sprintf("INSERT INTO logs VALUES (%d, 'info', 'request served without errors')", i))
+	}
+	plain, _ := os.ReadFile("data.mdb")
+
+	engine.Compression = engine.CompressionFlate
+	if err := engine.SaveBinaryDB(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	compressed, _ := os.ReadFile("data.mdb")
+	if len(compressed) < 6 || compressed[5]&1 == 0 {
+		t.Fatalf("compression flag not set in header")
+	}
+	if len(compressed)*4 > len(plain) {
+		t.Errorf("compressed file too large: %d vs %d bytes", len(compressed), len(plain))
+	}
+
+	engine.Compression = engine.CompressionNone
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if engine.Compression != engine.CompressionFlate {
+		t.Errorf("compression not taken from the header: %q", engine.Compression)
+	}
+	res, _ := engine.HandleCommand("SELECT message FROM logs WHERE id = 199")
+	if res != "message\nrequest served without errors\n" {
+		t.Errorf("unexpected row: %q", res)
+	}
+
+	// A truncated block fails the load instead of dropping the table.
+	_ = os.WriteFile("data.mdb", compressed[:len(compressed)-10], 0600)
+	if err := engine.LoadBinaryDB(); err == nil {
+		t.Errorf("expected error for truncated block")
+	}
+}
+
+func TestChecksumsAndVerify(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE accounts (id INT PRIMARY KEY, owner TEXT)")
+	_, _ = engine.HandleCommand("INSERT INTO accounts VALUES (1, 'alice')")
+	_, _ = engine.HandleCommand("INSERT INTO accounts VALUES (2, 'bob')")
+
+	res, err := engine.HandleCommand("VERIFY")
+	want := "file\tstatus\tdetail\n" +
+		"data.mdb\tok\tversion 12, 1 tables, 2 rows\n" +
+		"data.wal\tok\t0 entries\n"
+	if err != nil || res != want {
+		t.Fatalf("verify: %v %q", err, res)
+	}
+
+	// Saves running alongside VERIFY never show it a partly written file.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 3; i < 40; i++ {
+			_, _ = engine.HandleCommand(fmt.Sprintf("INSERT INTO accounts VALUES (%d, 'user%d')", i, i))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if res, _ := engine.HandleCommand("VERIFY"); !strings.Contains(res, "data.mdb\tok\t") {
+			t.Fatalf("verify during saves: %q", res)
+		}
+	}
+	wg.Wait()
+	_, _ = engine.HandleCommand("DELETE FROM accounts WHERE id > 2")
+
+	// Flip a bit inside the stored row data.
+	data, _ := os.ReadFile("data.mdb")
+	i := bytes.Index(data, []byte("alice"))
+	if i == -1 {
+		t.Fatalf("row data not found")
+	}
+	data[i] ^= 0x01
+	_ = os.WriteFile("data.mdb", data, 0600)
+	_ = os.WriteFile("data.wal", []byte("INSERT INTO accounts VALUES (3, 'carol')\nINSERT INTO acc"), 0600)
+
+	res, _ = engine.HandleCommand("VERIFY")
+	want = "file\tstatus\tdetail\n" +
+		"data.mdb\tcorrupt\ttable accounts: checksum mismatch\n" +
+		"data.wal\tcorrupt\tlast entry is incomplete\n"
+	if res != want {
+		t.Errorf("unexpected verify report: %q", res)
+	}
+	// VERIFY does not touch the live database.
+	res, _ = engine.HandleCommand("SELECT owner FROM accounts WHERE id = 1")
+	if res != "owner\nalice\n" {
+		t.Errorf("live data changed: %q", res)
+	}
+
+	err = engine.LoadBinaryDB()
+	if !errors.Is(err, engine.ErrChecksum) || !strings.Contains(err.Error(), "accounts") {
+		t.Errorf("expected checksum error naming the table, got %v", err)
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	defer func() { _ = engine.SetEncryptionKey(nil) }()
+	engine.Tables = make(map[string]*engine.Table)
+
+	const hexKey1 = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	const hexKey2 = "f0e0d0c0b0a090807060504030201000"
+	key1, _ := engine.ParseKey(hexKey1)
+	key2, _ := engine.ParseKey(hexKey2)
+	if _, err := engine.ParseKey("abc"); err == nil {
+		t.Errorf("expected error for malformed key")
+	}
+	if err := engine.SetEncryptionKey(key1); err != nil {
+		t.Fatalf("set key: %v", err)
+	}
+
+	_, _ = engine.HandleCommand("CREATE TABLE people (id INT PRIMARY KEY, ssn TEXT)")
+	_, _ = engine.HandleCommand("INSERT INTO people VALUES (1, 'ssn-111-22')")
+	snapshot, _ := os.ReadFile("data.mdb")
+	if len(snapshot) < 6 || snapshot[5]&2 == 0 || bytes.Contains(snapshot, []byte("ssn-111")) {
+		t.Fatalf("data file not encrypted")
+	}
+
+	// Make the save fail so that the WAL entry stays behind.
+	_ = os.Remove("data.mdb")
+	_ = os.Mkdir("data.mdb", 0700)
+	if _, err := engine.HandleCommand("INSERT INTO people VALUES (2, 'ssn-333-44')"); err == nil {
+		t.Fatalf("expected save to fail")
+	}
+	wal, _ := os.ReadFile("data.wal")
+	if !bytes.HasPrefix(wal, []byte("!aes-gcm:")) || bytes.Contains(wal, []byte("ssn-333")) {
+		t.Errorf("WAL entry not encrypted: %q", wal)
+	}
+	_ = os.Remove("data.mdb")
+	_ = os.WriteFile("data.mdb", snapshot, 0600)
+
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	res, _ := engine.HandleCommand("SELECT ssn FROM people WHERE id = 2")
+	if res != "ssn\nssn-333-44\n" {
+		t.Errorf("WAL not replayed: %q", res)
+	}
+
+	if _, err := engine.HandleCommand("ROTATE KEY '" + hexKey2 + "'"); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	_ = engine.SetEncryptionKey(key1)
+	if err := engine.LoadBinaryDB(); !errors.Is(err, engine.ErrDecrypt) {
+		t.Errorf("expected decryption error with the old key, got %v", err)
+	}
+	_ = engine.SetEncryptionKey(nil)
+	if err := engine.LoadBinaryDB(); !errors.Is(err, engine.ErrNoKey) {
+		t.Errorf("expected missing key error, got %v", err)
+	}
+	_ = engine.SetEncryptionKey(key2)
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("load with rotated key: %v", err)
+	}
+	res, _ = engine.HandleCommand("SELECT id FROM people")
+	if res != "id\n1\n2\n" {
+		t.Errorf("unexpected rows after rotation: %q", res)
+	}
+
+	// Blocks of an older file under the header of a newer one do not
+	// decrypt: they are bound to the id of the file they were written to.
+	old, _ := os.ReadFile("data.mdb")
+	_, _ = engine.HandleCommand("INSERT INTO people VALUES (3, 'ssn-555-66')")
+	cur, _ := os.ReadFile("data.mdb")
+	const header = 4 + 1 + 1 + 16
+	_ = os.WriteFile("data.mdb", append(cur[:header:header], old[header:]...), 0600)
+	if err := engine.LoadBinaryDB(); !errors.Is(err, engine.ErrDecrypt) {
+		t.Errorf("expected decryption error for a replayed block, got %v", err)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	const budget = 64 << 10
+	engine.BufferPoolSize = budget
+	defer func() { engine.BufferPoolSize = 0 }()
+	engine.Tables = make(map[string]*engine.Table)
+	defer func() { engine.Tables = make(map[string]*engine.Table) }()
+
+	_, _ = engine.HandleCommand("CREATE TABLE events (id INT PRIMARY KEY, name TEXT, score FLOAT)")
+	tx := engine.BeginTx()
+	for i := 0; i < 3000; i++ {
+		if _, err := tx.Exec(fmt.Sprintf("INSERT INTO events VALUES (%d, 'event number %d', %d.5)", i, i, i%100)); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if engine.Tables["events"].Rows != nil {
+		t.Fatalf("rows kept in memory")
+	}
+	stats := engine.BufferPoolStats()
+	if stats.Evictions == 0 || stats.Spilled == 0 || stats.Resident > budget {
+		t.Errorf("budget not enforced: %+v", stats)
+	}
+
+	res, _ := engine.HandleCommand("SELECT name FROM events WHERE id = 1234")
+	if res != "name\nevent number 1234\n" {
+		t.Errorf("unexpected lookup: %q", res)
+	}
+	_, _ = engine.HandleCommand("UPDATE events SET name = 'renamed' WHERE id = 7")
+	res, _ = engine.HandleCommand("SELECT MAX(score), MIN(name) FROM events WHERE score > 98")
+	if res != "MAX(score)\tMIN(name)\n99.5\tevent number 1098\n" {
+		t.Errorf("unexpected scan: %q", res)
+	}
+
+	tx = engine.BeginTx()
+	_, _ = tx.Exec("UPDATE events SET name = 'lost' WHERE id = 7")
+	tx.Rollback()
+	res, _ = engine.HandleCommand("SELECT name FROM events WHERE id = 7")
+	if res != "name\nrenamed\n" {
+		t.Errorf("rollback not applied: %q", res)
+	}
+
+	// Loaded pages are read back from data.mdb, not copied to the spill
+	// file.
+	spilled := engine.BufferPoolStats().Spilled
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	res, _ = engine.HandleCommand("SELECT name, score FROM events WHERE id = 2999")
+	if res != "name\tscore\nevent number 2999\t99.5\n" {
+		t.Errorf("unexpected row after reload: %q", res)
+	}
+	if stats := engine.BufferPoolStats(); stats.Resident > budget {
+		t.Errorf("budget exceeded after reload: %+v", stats)
+	}
+	evictions := engine.BufferPoolStats().Evictions
+	res, _ = engine.HandleCommand("SELECT MIN(name) FROM events")
+	if res != "MIN(name)\nevent number 0\n" {
+		t.Errorf("unexpected scan after reload: %q", res)
+	}
+	if stats := engine.BufferPoolStats(); stats.Spilled != spilled || stats.Evictions == evictions {
+		t.Errorf("loaded pages spilled: %+v", stats)
+	}
+
+	if _, err := engine.HandleCommand("DELETE FROM events WHERE id >= 1000"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	res, _ = engine.HandleCommand("SELECT MAX(id), MAX(score) FROM events")
+	if res != "MAX(id)\tMAX(score)\n999\t99.5\n" {
+		t.Errorf("unexpected rows after delete: %q", res)
+	}
+	res, _ = engine.HandleCommand("SELECT name FROM events WHERE id = 998")
+	if res != "name\nevent number 998\n" {
+		t.Errorf("unexpected lookup after delete: %q", res)
+	}
+
+	// A save moves the loaded pages to the new data.mdb instead of keeping
+	// the replaced file open, and a page that can no longer be read fails
+	// the statement.
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	spilled = engine.BufferPoolStats().Spilled
+	if _, err := engine.HandleCommand("CREATE TABLE marks (id INT)"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	res, _ = engine.HandleCommand("SELECT MAX(id), MIN(name) FROM events WHERE score = 0.5")
+	if res != "MAX(id)\tMIN(name)\n900\tevent number 0\n" {
+		t.Errorf("unexpected scan after save: %q", res)
+	}
+	if stats := engine.BufferPoolStats(); stats.Spilled != spilled {
+		t.Errorf("pages spilled on save: %d, was %d", stats.Spilled, spilled)
+	}
+	if err := os.Truncate("data.mdb", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.HandleCommand("SELECT name FROM events WHERE score = 0.5"); err == nil {
+		t.Errorf("expected error reading a truncated data file")
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	dir := t.TempDir()
+	engine.WALArchiveDir = filepath.Join(dir, "archive")
+	defer func() { engine.WALArchiveDir = "" }()
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE orders (id INT, status TEXT)")
+	_, _ = engine.HandleCommand("INSERT INTO orders VALUES (1, 'new')")
+	_, _ = engine.HandleCommand("INSERT INTO orders VALUES (2, 'new')")
+
+	backup := filepath.Join(dir, "base")
+	res, err := engine.HandleCommand(fmt.Sprintf("BACKUP TO '%s'", backup))
+	if err != nil || res != fmt.Sprintf("Backup written to %s at LSN 3.", backup) {
+		t.Fatalf("backup: %v %q", err, res)
+	}
+	if _, err := engine.HandleCommand(fmt.Sprintf("BACKUP TO '%s'", backup)); err == nil {
+		t.Errorf("expected an existing backup to be kept")
+	}
+
+	_, _ = engine.HandleCommand("INSERT INTO orders VALUES (3, 'new')")
+	mid := time.Now()
+	_, _ = engine.HandleCommand("UPDATE orders SET status='paid' WHERE id=1")
+	_, _ = engine.HandleCommand("INSERT INTO orders VALUES (4, 'new')")
+
+	cases := []struct {
+		target engine.RestoreTarget
+		lsn    uint64
+		want   string
+	}{
+		{engine.RestoreTarget{LSN: 5}, 5, "id\tstatus\n1\tpaid\n2\tnew\n3\tnew\n"},
+		{engine.RestoreTarget{Time: mid}, 4, "id\tstatus\n1\tnew\n2\tnew\n3\tnew\n"},
+		{engine.RestoreTarget{}, 6, "id\tstatus\n1\tpaid\n2\tnew\n3\tnew\n4\tnew\n"},
+	}
+	for _, c := range cases {
+		lsn, err := engine.Restore(backup, c.target)
+		if err != nil || lsn != c.lsn {
+			t.Fatalf("restore %+v: %v %d", c.target, err, lsn)
+		}
+		res, _ := engine.HandleCommand("SELECT * FROM orders")
+		if res != c.want {
+			t.Errorf("restore %+v: unexpected rows %q", c.target, res)
+		}
+	}
+
+	// The restored database is the one on disk.
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	res, _ = engine.HandleCommand("SELECT id FROM orders WHERE status = 'paid'")
+	if res != "id\n1\n" {
+		t.Errorf("unexpected rows after reload: %q", res)
+	}
+
+	if _, err := engine.Restore(backup, engine.RestoreTarget{LSN: 2}); err == nil {
+		t.Errorf("expected an error for a target before the backup")
+	}
+	if _, err := engine.Restore(backup, engine.RestoreTarget{LSN: 99}); err == nil || err.Error() != "WAL archive ends at LSN 6" {
+		t.Errorf("unexpected error for a target past the archive: %v", err)
+	}
+}
+
+func TestHTTPRejectsFileStatements(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	engine.Tables = make(map[string]*engine.Table)
+	_, _ = engine.HandleCommand("CREATE TABLE users (id INT, name TEXT)")
+
+	dir := t.TempDir()
+	target := filepath.Join(dir, "out")
+	for _, query := range []string{
+		fmt.Sprintf("BACKUP TO '%s'", target),
+		fmt.Sprintf("  dump %s", target),
+		"ROTATE KEY '000102030405060708090a0b0c0d0e0f'",
+		"SOURCE '/etc/passwd'",
+		fmt.Sprintf("COPY users TO '%s'", target),
+		"COPY users FROM '/etc/passwd'",
+	} {
+		rec := httptest.NewRecorder()
+		handleQuery(rec, httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(query)))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, body %q", query, rec.Code, rec.Body)
+		}
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("file statement ran over HTTP: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	handleQuery(rec, httptest.NewRequest(http.MethodPost, "/query", strings.NewReader("SELECT * FROM users")))
+	if rec.Code != http.StatusOK || rec.Body.String() != "id\tname\n" {
+		t.Errorf("select over HTTP: status %d, body %q", rec.Code, rec.Body)
+	}
+}
+
+func TestSourceDump(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	dir := t.TempDir()
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE notes (id INT PRIMARY KEY, body TEXT)")
+	_, _ = engine.HandleCommand("INSERT INTO notes VALUES (1, 'semi;colon')")
+	_, _ = engine.HandleCommand("INSERT INTO notes VALUES (2, 'it''s -- not a comment')")
+	_, _ = engine.HandleCommand("CREATE INDEX ON notes(body)")
+	dump := filepath.Join(dir, "dump.sql")
+	if err := engine.SaveSQLDump(dump); err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+
+	engine.Tables = make(map[string]*engine.Table)
+	res, err := engine.HandleCommand(fmt.Sprintf("SOURCE '%s'", dump))
+	if err != nil || res != fmt.Sprintf("3 statements executed from %s.", dump) {
+		t.Fatalf("source: %v %q", err, res)
+	}
+	res, _ = engine.HandleCommand("SELECT * FROM notes")
+	if res != "id\tbody\n1\tsemi;colon\n2\tit's -- not a comment\n" {
+		t.Errorf("unexpected rows: %q", res)
+	}
+	res, _ = engine.HandleCommand("SELECT columns FROM minidb_indexes WHERE table_name = 'notes'")
+	if res != "columns\nbody\nid\n" {
+		t.Errorf("index not restored: %q", res)
+	}
+
+	script := filepath.Join(dir, "script.sql")
+	_ = os.WriteFile(script, []byte("-- seed data\n"+
+		"INSERT INTO notes\n  VALUES (3, 'multi\nline');\n"+
+		"INSERT INTO notes VALUES (4, 'x'); INSERT INTO notes\n"+
+		"  VALUES (1, 'duplicate');\n"), 0600)
+	_, err = engine.LoadSQLFile(script, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), script+":5: ") {
+		t.Fatalf("expected an error at line 5, got %v", err)
+	}
+	res, _ = engine.HandleCommand("SELECT id FROM notes")
+	if res != "id\n1\n2\n" {
+		t.Errorf("failed load was not rolled back: %q", res)
+	}
+
+	_ = os.WriteFile(script, []byte("INSERT INTO notes VALUES (3, 'multi\nline');\nINSERT INTO notes VALUES (4, 'x')\n"), 0600)
+	n, err := engine.LoadSQLFile(script, nil)
+	if err != nil || n != 2 {
+		t.Fatalf("load: %v %d", err, n)
+	}
+	res, _ = engine.HandleCommand("SELECT body FROM notes WHERE id = 3")
+	if res != "body\nmulti\nline\n" {
+		t.Errorf("unexpected multi-line value: %q", res)
+	}
+}
+
+func TestSourceRecovery(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE seed (id INT)")
+	saved, _ := os.ReadFile("data.mdb")
+	script := filepath.Join(t.TempDir(), "script.sql")
+	_ = os.WriteFile(script, []byte("CREATE TABLE notes\n  (id INT PRIMARY KEY, body TEXT);\n"+
+		"INSERT INTO notes\n  VALUES (1, 'multi\nline');\n"), 0600)
+
+	// The data file cannot be written, so the statements stay in the WAL.
+	os.Remove("data.mdb")
+	_ = os.Mkdir("data.mdb", 0700)
+	if _, err := engine.LoadSQLFile(script, nil); err == nil {
+		t.Fatalf("expected the save to fail")
+	}
+	os.Remove("data.mdb")
+	_ = os.WriteFile("data.mdb", saved, 0600)
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	res, _ := engine.HandleCommand("SELECT * FROM notes")
+	if res != "id\tbody\n1\tmulti\nline\n" {
+		t.Errorf("unexpected rows after replay: %q", res)
+	}
+}
+
+func TestCopyCSVAndJSON(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	dir := t.TempDir()
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE items (id INT PRIMARY KEY, name TEXT, price DECIMAL(8,2), added DATE, active BOOL)")
+	_, _ = engine.HandleCommand("INSERT INTO items VALUES (1, 'pen, blue', 1.50, '2024-03-01', true)")
+	_, _ = engine.HandleCommand("INSERT INTO items VALUES (2, 'say \"hi\"', 20, '2024-03-02', false)")
+
+	csvFile := filepath.Join(dir, "items.csv")
+	res, err := engine.HandleCommand(fmt.Sprintf("COPY items TO '%s' WITH (FORMAT csv, HEADER)", csvFile))
+	if err != nil || res != fmt.Sprintf("2 rows exported to %s.", csvFile) {
+		t.Fatalf("copy to csv: %v %q", err, res)
+	}
+	data, _ := os.ReadFile(csvFile)
+	want := "id,name,price,added,active\n1,\"pen, blue\",1.50,2024-03-01,true\n2,\"say \"\"hi\"\"\",20.00,2024-03-02,false\n"
+	if string(data) != want {
+		t.Errorf("unexpected csv:\n%s", data)
+	}
+	jsonFile := filepath.Join(dir, "items.json")
+	if _, err := engine.HandleCommand(fmt.Sprintf("COPY items TO '%s' WITH (FORMAT json)", jsonFile)); err != nil {
+		t.Fatalf("copy to json: %v", err)
+	}
+	data, _ = os.ReadFile(jsonFile)
+	want = "[\n{\"id\":1,\"name\":\"pen, blue\",\"price\":\"1.50\",\"added\":\"2024-03-01\",\"active\":true},\n" +
+		"{\"id\":2,\"name\":\"say \\\"hi\\\"\",\"price\":\"20.00\",\"added\":\"2024-03-02\",\"active\":false}\n]\n"
+	if string(data) != want {
+		t.Errorf("unexpected json:\n%s", data)
+	}
+
+	// Both files load back into an empty copy of the table.
+	for _, c := range []struct{ file, opts string }{
+		{csvFile, "WITH (HEADER)"},
+		{jsonFile, "WITH (FORMAT json)"},
+	} {
+		_, _ = engine.HandleCommand("CREATE TABLE items (id INT PRIMARY KEY, name TEXT, price DECIMAL(8,2), added DATE, active BOOL)")
+		res, err := engine.HandleCommand(fmt.Sprintf("COPY items FROM '%s' %s", c.file, c.opts))
+		if err != nil || res != "2 rows imported." {
+			t.Fatalf("copy from %s: %v %q", c.file, err, res)
+		}
+		res, _ = engine.HandleCommand("SELECT * FROM items")
+		if res != "id\tname\tprice\tadded\tactive\n1\tpen, blue\t1.50\t2024-03-01\ttrue\n2\tsay \"hi\"\t20.00\t2024-03-02\tfalse\n" {
+			t.Errorf("unexpected rows from %s: %q", c.file, res)
+		}
+	}
+
+	jsonlFile := filepath.Join(dir, "more.jsonl")
+	_ = os.WriteFile(jsonlFile, []byte(`{"id": 3, "name": "cup", "price": 4, "added": "2024-03-03", "active": true}
+{"active": false, "added": "2024-03-04", "price": "5.25", "name": "mug", "id": 4}
+`), 0600)
+	if res, err := engine.HandleCommand(fmt.Sprintf("COPY items FROM '%s' WITH (FORMAT jsonl)", jsonlFile)); err != nil || res != "2 rows imported." {
+		t.Fatalf("copy from jsonl: %v %q", err, res)
+	}
+
+	// With a NULL marker NULL and an empty string round-trip through CSV;
+	// without one both are written as an empty field. A JSON object without
+	// a column gives it its default, while null is NULL.
+	_, _ = engine.HandleCommand("CREATE TABLE notes (id INT, body TEXT, tag TEXT DEFAULT 'misc', n INT DEFAULT 7)")
+	_, _ = engine.HandleCommand("INSERT INTO notes VALUES (1, '', NULL, NULL), (2, NULL, ' x', 3)")
+	notesCSV := filepath.Join(dir, "notes.csv")
+	for _, c := range []struct{ opts, want string }{
+		{"", "1,,,\n2,,\" x\",3\n"},
+		{"WITH (NULL '\\N')", "1,,\\N,\\N\n2,\\N,\" x\",3\n"},
+	} {
+		_, _ = engine.HandleCommand(fmt.Sprintf("COPY notes TO '%s' %s", notesCSV, c.opts))
+		if data, _ := os.ReadFile(notesCSV); string(data) != c.want {
+			t.Errorf("unexpected csv with %q:\n%s", c.opts, data)
+		}
+	}
+	notesJSONL := filepath.Join(dir, "notes.jsonl")
+	_ = os.WriteFile(notesJSONL, []byte(`{"id": 3, "body": "b"}
+{"id": 4, "body": null, "tag": null, "n": null}
+`), 0600)
+	_, _ = engine.HandleCommand("CREATE TABLE notes (id INT, body TEXT, tag TEXT DEFAULT 'misc', n INT DEFAULT 7)")
+	for _, c := range []struct{ file, opts string }{{notesCSV, "WITH (NULL '\\N')"}, {notesJSONL, "WITH (FORMAT jsonl)"}} {
+		if _, err := engine.HandleCommand(fmt.Sprintf("COPY notes FROM '%s' %s", c.file, c.opts)); err != nil {
+			t.Fatalf("copy from %s: %v", c.file, err)
+		}
+	}
+	res, _ = engine.HandleCommand("SELECT * FROM notes")
+	if res != "id\tbody\ttag\tn\n1\t\tNULL\tNULL\n2\tNULL\t x\t3\n3\tb\tmisc\t7\n4\tNULL\tNULL\tNULL\n" {
+		t.Errorf("unexpected rows: %q", res)
+	}
+	for _, c := range []struct{ query, err string }{
+		{"COPY notes TO '%s' WITH (NULL 'b')", "row 3: value of column body equals the NULL marker"},
+		{"COPY notes TO '%s' WITH (FORMAT json, NULL '')", "NULL is only supported for CSV"},
+		{"COPY notes TO '%s' WITH (NULL b)", "NULL requires a quoted marker"},
+	} {
+		if _, err := engine.HandleCommand(fmt.Sprintf(c.query, notesCSV)); err == nil || err.Error() != c.err {
+			t.Errorf("%s: expected %q, got %v", c.query, c.err, err)
+		}
+	}
+	_ = os.WriteFile(notesJSONL, []byte(`{"id": 5, "title": "t"}`), 0600)
+	if _, err := engine.HandleCommand(fmt.Sprintf("COPY notes FROM '%s' WITH (FORMAT jsonl)", notesJSONL)); err == nil ||
+		err.Error() != "row 1: unknown column title" {
+		t.Errorf("unexpected error for an unknown key: %v", err)
+	}
+
+	// A bad row rejects the whole file.
+	bad := filepath.Join(dir, "bad.csv")
+	for _, c := range []struct{ content, err string }{
+		{"5,a,1,2024-03-05,true\n6,b,x,2024-03-05,true\n", "row 2: invalid DECIMAL(8,2) value for column price"},
+		{"5,a,1,2024-03-05,true\n6,b,1\n", "row 2: expected 5 fields, got 3"},
+		{"5,a,1,2024-03-05,true\n6,b,1,2024-03-05,true\n5,c,1,2024-03-05,true\n", "row 3: constraint violation: duplicate value 5 for PRIMARY KEY column id"},
+		{"7,a,1,2024-03-05,true\n1,b,1,2024-03-05,true\n", "row 2: constraint violation: duplicate value 1 for PRIMARY KEY column id"},
+	} {
+		_ = os.WriteFile(bad, []byte(c.content), 0600)
+		_, err := engine.HandleCommand(fmt.Sprintf("COPY items FROM '%s'", bad))
+		if err == nil || err.Error() != c.err {
+			t.Errorf("expected %q, got %v", c.err, err)
+		}
+	}
+	res, _ = engine.HandleCommand("SELECT id FROM items")
+	if res != "id\n1\n2\n3\n4\n" {
+		t.Errorf("rejected rows were inserted: %q", res)
+	}
+
+	// Imported rows are saved once the whole file is accepted.
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	res, _ = engine.HandleCommand("SELECT name FROM items WHERE id = 4")
+	if res != "name\nmug\n" {
+		t.Errorf("unexpected row after reload: %q", res)
+	}
+}
+
+func TestDeterministicDump(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	dir := t.TempDir()
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE zoo (id INT PRIMARY KEY, weight FLOAT, tame BOOL)")
+	_, _ = engine.HandleCommand("CREATE TABLE aviary (name TEXT UNIQUE)")
+	_, _ = engine.HandleCommand("CREATE INDEX ON zoo(weight)")
+	res, err := engine.HandleCommand("INSERT INTO zoo VALUES (1, 2, true), (2, 0.5, false), (3, 1e21, true)")
+	if err != nil || res != "3 rows inserted." {
+		t.Fatalf("multi-row insert: %v %q", err, res)
+	}
+	_, _ = engine.HandleCommand("INSERT INTO aviary VALUES ('o''wl')")
+	if _, err := engine.HandleCommand("INSERT INTO zoo VALUES (4, 1, true), (1, 1, true)"); err == nil ||
+		err.Error() != "row 2: constraint violation: duplicate value 1 for PRIMARY KEY column id" {
+		t.Errorf("unexpected error for a duplicate row: %v", err)
+	}
+	if _, err := engine.HandleCommand("INSERT INTO zoo VALUES (4, 1, true), (5, heavy, true)"); err == nil ||
+		err.Error() != "row 2: invalid FLOAT value for column weight" {
+		t.Errorf("unexpected error for a bad row: %v", err)
+	}
+
+	file := filepath.Join(dir, "dump.sql")
+	if err := engine.SaveSQLDumpWith(file, engine.DumpOptions{BatchRows: 2}); err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	first, _ := os.ReadFile(file)
+	want := "CREATE TABLE aviary (name TEXT UNIQUE);\n" +
+		"INSERT INTO aviary VALUES ('o''wl');\n" +
+		"CREATE TABLE zoo (id INT PRIMARY KEY, weight FLOAT, tame BOOL);\n" +
+		"INSERT INTO zoo VALUES (1, 2.0, true),\n  (2, 0.5, false);\n" +
+		"INSERT INTO zoo VALUES (3, 1e+21, true);\n" +
+		"CREATE INDEX ON zoo(weight);\n"
+	if string(first) != want {
+		t.Errorf("unexpected dump:\n%s", first)
+	}
+	for i := 0; i < 5; i++ {
+		_ = engine.SaveSQLDumpWith(file, engine.DumpOptions{BatchRows: 2})
+		if again, _ := os.ReadFile(file); !bytes.Equal(again, first) {
+			t.Fatalf("dump changed between runs:\n%s", again)
+		}
+	}
+
+	for _, c := range []struct{ opts, want string }{
+		{"SCHEMA ONLY", "CREATE TABLE aviary (name TEXT UNIQUE);\nCREATE TABLE zoo (id INT PRIMARY KEY, weight FLOAT, tame BOOL);\nCREATE INDEX ON zoo(weight);\n"},
+		{"DATA ONLY TABLES aviary", "INSERT INTO aviary VALUES ('o''wl');\n"},
+		{"TABLES zoo, aviary", "CREATE TABLE aviary (name TEXT UNIQUE);\nINSERT INTO aviary VALUES ('o''wl');\n" +
+			"CREATE TABLE zoo (id INT PRIMARY KEY, weight FLOAT, tame BOOL);\n" +
+			"INSERT INTO zoo VALUES (1, 2.0, true),\n  (2, 0.5, false),\n  (3, 1e+21, true);\nCREATE INDEX ON zoo(weight);\n"},
+	} {
+		res, err := engine.HandleCommand(fmt.Sprintf("DUMP '%s' %s", file, c.opts))
+		if err != nil || res != fmt.Sprintf("Dump saved to %s.", file) {
+			t.Fatalf("DUMP %s: %v %q", c.opts, err, res)
+		}
+		if data, _ := os.ReadFile(file); string(data) != c.want {
+			t.Errorf("DUMP %s:\n%s", c.opts, data)
+		}
+	}
+	if _, err := engine.HandleCommand(fmt.Sprintf("DUMP '%s' TABLES cages", file)); err == nil {
+		t.Errorf("expected an error for an unknown table")
+	}
+
+	// A multi-line statement survives in the WAL until it is replayed.
+	saved, _ := os.ReadFile("data.mdb")
+	os.Remove("data.mdb")
+	_ = os.Mkdir("data.mdb", 0700)
+	if _, err := engine.HandleCommand("INSERT INTO aviary VALUES\n('crow'),\n('jay')"); err == nil {
+		t.Fatalf("expected the save to fail")
+	}
+	os.Remove("data.mdb")
+	_ = os.WriteFile("data.mdb", saved, 0600)
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	res, _ = engine.HandleCommand("SELECT name FROM aviary")
+	if res != "name\no'wl\ncrow\njay\n" {
+		t.Errorf("unexpected rows after replay: %q", res)
+	}
+}
+
+func TestInsertColumnListAndSelect(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	dir := t.TempDir()
+	engine.Tables = make(map[string]*engine.Table)
+
+	_, _ = engine.HandleCommand("CREATE TABLE src (id INT PRIMARY KEY, name TEXT, score FLOAT)")
+	_, _ = engine.HandleCommand("INSERT INTO src VALUES (10, 'ann', 0.5), (11, 'bo', 2.25), (12, 'cy', 3)")
+	_, _ = engine.HandleCommand("CREATE TABLE dst (id BIGINT PRIMARY KEY, label TEXT, score DECIMAL(6,2), note TEXT)")
+
+	res, err := engine.HandleCommand("INSERT INTO dst (label, id) VALUES ('a', 1), (NULL, 2)")
+	if err != nil || res != "2 rows inserted." {
+		t.Fatalf("insert with columns: %v %q", err, res)
+	}
+	for _, c := range []struct{ query, err string }{
+		{"INSERT INTO dst (label) VALUES ('x')", "constraint violation: NULL value for PRIMARY KEY column id"},
+		{"INSERT INTO dst (id, nope) VALUES (3, 'x')", "column nope does not exist"},
+		{"INSERT INTO dst (id, id) VALUES (3, 3)", "column id is listed twice"},
+		{"INSERT INTO dst (id, label) VALUES (3)", "columns count does not match"},
+		{"INSERT INTO dst SELECT id FROM src", "columns count does not match"},
+		{"INSERT INTO dst (id, score) SELECT id, name FROM src", "row 1: invalid DECIMAL(6,2) value for column score"},
+	} {
+		if _, err := engine.HandleCommand(c.query); err == nil || err.Error() != c.err {
+			t.Errorf("%s: expected %q, got %v", c.query, c.err, err)
+		}
+	}
+
+	res, err = engine.HandleCommand("INSERT INTO dst (id, label, score) SELECT id, name, score FROM src WHERE score > 1")
+	if err != nil || res != "2 rows inserted." {
+		t.Fatalf("insert select: %v %q", err, res)
+	}
+	res, err = engine.HandleCommand("INSERT INTO dst (id) SELECT id FROM src WHERE score > 100")
+	if err != nil || res != "0 rows inserted." {
+		t.Errorf("empty insert select: %v %q", err, res)
+	}
+	// A conflicting row rejects the whole statement.
+	if _, err := engine.HandleCommand("INSERT INTO dst (id, label) SELECT id, name FROM src"); err == nil ||
+		err.Error() != "row 2: constraint violation: duplicate value 11 for PRIMARY KEY column id" {
+		t.Errorf("unexpected error for a conflicting select: %v", err)
+	}
+	want := "id\tlabel\tscore\tnote\n1\ta\tNULL\tNULL\n2\tNULL\tNULL\tNULL\n11\tbo\t2.25\tNULL\n12\tcy\t3.00\tNULL\n"
+	if res, _ := engine.HandleCommand("SELECT * FROM dst"); res != want {
+		t.Errorf("unexpected rows: %q", res)
+	}
+
+	// NULL survives dumps and COPY.
+	file := filepath.Join(dir, "dst.sql")
+	_ = engine.SaveSQLDumpWith(file, engine.DumpOptions{DataOnly: true, Tables: []string{"dst"}})
+	if data, _ := os.ReadFile(file); !strings.Contains(string(data), "(2, NULL, NULL, NULL)") {
+		t.Errorf("NULL missing from dump:\n%s", data)
+	}
+	jsonl := filepath.Join(dir, "dst.jsonl")
+	_, _ = engine.HandleCommand(fmt.Sprintf("COPY dst TO '%s' WITH (FORMAT jsonl)", jsonl))
+	csvFile := filepath.Join(dir, "dst.csv")
+	_, _ = engine.HandleCommand(fmt.Sprintf("COPY dst TO '%s'", csvFile))
+	if data, _ := os.ReadFile(csvFile); !strings.HasPrefix(string(data), "1,a,,\n2,,,\n") {
+		t.Errorf("unexpected csv:\n%s", data)
+	}
+	for _, c := range []struct{ file, opts, want string }{
+		{jsonl, "WITH (FORMAT jsonl)", want},
+		// An empty CSV field is an empty string in a TEXT column.
+		{csvFile, "", "id\tlabel\tscore\tnote\n1\ta\tNULL\t\n2\t\tNULL\t\n11\tbo\t2.25\t\n12\tcy\t3.00\t\n"},
+	} {
+		_, _ = engine.HandleCommand("CREATE TABLE dst (id BIGINT PRIMARY KEY, label TEXT, score DECIMAL(6,2), note TEXT)")
+		if _, err := engine.HandleCommand(fmt.Sprintf("COPY dst FROM '%s' %s", c.file, c.opts)); err != nil {
+			t.Fatalf("copy from %s: %v", c.file, err)
+		}
+		if res, _ := engine.HandleCommand("SELECT * FROM dst"); res != c.want {
+			t.Errorf("unexpected rows from %s: %q", c.file, res)
+		}
+	}
+}
+
+func TestNullSemantics(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	engine.Tables = make(map[string]*engine.Table)
+
+	exec := func(query, want string) {
+		t.Helper()
+		res, err := engine.HandleCommand(query)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if res != want {
+			t.Errorf("%s: expected %q, got %q", query, want, res)
+		}
+	}
+	check := func(query, want string) {
+		t.Helper()
+		if res, _ := engine.HandleCommand(query); res != want {
+			t.Errorf("%s: unexpected rows: %q", query, res)
+		}
+	}
+
+	// NULL equals nothing, so unique indexes accept any number of NULLs.
+	exec("CREATE TABLE accounts (id INT PRIMARY KEY, email TEXT UNIQUE, a INT, b INT)", "Table 'accounts' created.")
+	exec("CREATE UNIQUE INDEX ON accounts(a, b)", "Index on a, b created.")
+	exec("INSERT INTO accounts VALUES (1, NULL, 1, NULL), (2, NULL, 1, NULL)", "2 rows inserted.")
+	exec("INSERT INTO accounts VALUES (3, NULL, NULL, NULL)", "1 row inserted.")
+	exec("UPDATE accounts SET a = 1 WHERE id = 3", "1 rows updated.")
+	exec("INSERT INTO accounts VALUES (4, NULL, 2, 2) ON CONFLICT (email) DO UPDATE SET a = 9", "1 row inserted.")
+	check("SELECT id FROM accounts WHERE a = 9", "id\n")
+	exec("CREATE UNIQUE INDEX ON accounts(b)", "Index on b created.")
+	if _, err := engine.HandleCommand("INSERT INTO accounts VALUES (5, 'x', 3, 3), (6, 'x', 4, 4)"); err == nil ||
+		err.Error() != "row 2: constraint violation: duplicate value x for UNIQUE column email" {
+		t.Errorf("unexpected error for a duplicate value: %v", err)
+	}
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("reload with NULL keys: %v", err)
+	}
+	check("SELECT id FROM accounts WHERE a = 1", "id\n1\n2\n3\n")
+
+	// A comparison with NULL matches no row, with or without an index.
+	check("SELECT id FROM accounts WHERE email != 'x'", "id\n")
+	check("SELECT id FROM accounts WHERE email LIKE '%'", "id\n")
+	check("SELECT id FROM accounts WHERE b > 0", "id\n4\n")
+	check("SELECT id FROM accounts WHERE b >= 0 ORDER BY b DESC", "id\n4\n")
+	check("SELECT id FROM accounts WHERE a >= 1 AND b <= 5", "id\n4\n")
+	exec("DELETE FROM accounts WHERE b != 2", "0 rows deleted.")
+
+	// MIN and MAX skip NULL, whether they scan rows, walk an index or read
+	// a column vector, and are NULL only without any other value.
+	check("SELECT MIN(b), MAX(b), MAX(email) FROM accounts", "MIN(b)\tMAX(b)\tMAX(email)\n2\t2\tNULL\n")
+	check("SELECT MIN(b), MAX(b) FROM accounts WHERE id < 4", "MIN(b)\tMAX(b)\nNULL\tNULL\n")
+	exec("CREATE TABLE readings (v FLOAT, w INT, k INT) WITH (storage=columnar)", "Table 'readings' created.")
+	exec("INSERT INTO readings VALUES (NULL, 1, 1), (2.5, NULL, 1), (NULL, 3, 1), (-1, NULL, 1)", "4 rows inserted.")
+	check("SELECT MIN(v), MAX(v), MIN(w), MAX(w) FROM readings", "MIN(v)\tMAX(v)\tMIN(w)\tMAX(w)\n-1\t2.5\t1\t3\n")
+	check("SELECT MIN(v), MAX(v), MIN(w), MAX(w) FROM readings WHERE k = 1", "MIN(v)\tMAX(v)\tMIN(w)\tMAX(w)\n-1\t2.5\t1\t3\n")
+
+	// UPDATE can set NULL, except in a PRIMARY KEY column.
+	exec("UPDATE accounts SET b = NULL, email = 'd@x' WHERE id = 4", "1 rows updated.")
+	check("SELECT id FROM accounts WHERE b = 2", "id\n")
+	check("SELECT MAX(b) FROM accounts", "MAX(b)\nNULL\n")
+	exec("CREATE TABLE tickets (id SERIAL PRIMARY KEY, note TEXT)", "Table 'tickets' created.")
+	exec("INSERT INTO tickets (note) VALUES ('open')", "1 row inserted.")
+	exec("UPDATE tickets SET note = NULL WHERE id = 1", "1 rows updated.")
+	for _, query := range []string{
+		"UPDATE accounts SET id = NULL WHERE id = 4",
+		"UPDATE tickets SET id = null WHERE id = 1",
+		"INSERT INTO tickets VALUES (1, 'x') ON CONFLICT (id) DO UPDATE SET id = NULL",
+	} {
+		if _, err := engine.HandleCommand(query); !errors.Is(err, engine.ErrConstraint) {
+			t.Errorf("%s: expected a constraint violation, got %v", query, err)
+		}
+	}
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	check("SELECT * FROM tickets", "id\tnote\n1\tNULL\n")
+	check("SELECT email, b FROM accounts WHERE id = 4", "email\tb\nd@x\tNULL\n")
+
+	// ON DELETE SET NULL may leave several NULLs in a UNIQUE column.
+	exec("CREATE TABLE owners (id INT PRIMARY KEY)", "Table 'owners' created.")
+	exec("CREATE TABLE pets (id INT PRIMARY KEY, owner INT UNIQUE REFERENCES owners(id) ON DELETE SET NULL)", "Table 'pets' created.")
+	exec("INSERT INTO owners VALUES (1), (2)", "2 rows inserted.")
+	exec("INSERT INTO pets VALUES (1, 1), (2, 2)", "2 rows inserted.")
+	exec("DELETE FROM owners", "2 rows deleted.")
+	exec("INSERT INTO pets VALUES (3, NULL)", "1 row inserted.")
+	check("SELECT * FROM pets", "id\towner\n1\tNULL\n2\tNULL\n3\tNULL\n")
+}
+
+func TestDefaultsAndChecks(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	engine.Tables = make(map[string]*engine.Table)
+
+	for _, c := range []struct{ query, err string }{
+		{"CREATE TABLE bad (n INT DEFAULT 'x')", "invalid DEFAULT 'x' for INT column n"},
+		{"CREATE TABLE bad (d DATE DEFAULT CURRENT_TIMESTAMP)", "CURRENT_TIMESTAMP is not a valid DEFAULT for DATE column d"},
+		{"CREATE TABLE bad (id INT PRIMARY KEY DEFAULT NULL)", "PRIMARY KEY column id cannot default to NULL"},
+		{"CREATE TABLE bad (n INT CHECK (m > 0))", "invalid CHECK for column n: unknown column m"},
+		{"CREATE TABLE bad (s TEXT DEFAULT)", "invalid DEFAULT for column s"},
+	} {
+		if _, err := engine.HandleCommand(c.query); err == nil || err.Error() != c.err {
+			t.Errorf("%s: expected %q, got %v", c.query, c.err, err)
+		}
+	}
+
+	_, err := engine.HandleCommand("CREATE TABLE items (id INT PRIMARY KEY, qty INT DEFAULT 1 CHECK (qty >= 0 AND qty <= 100), " +
+		"status TEXT DEFAULT 'new item', price FLOAT CHECK(price > 0), added TIMESTAMP DEFAULT CURRENT_TIMESTAMP)")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := engine.HandleCommand("INSERT INTO items (id) VALUES (1)"); err != nil {
+		t.Fatalf("insert defaults: %v", err)
+	}
+	if _, err := engine.HandleCommand("INSERT INTO items VALUES (2, DEFAULT, 'sold', 9.5, '2024-01-02 03:04:05')"); err != nil {
+		t.Fatalf("insert DEFAULT keyword: %v", err)
+	}
+	for _, c := range []struct{ query, err string }{
+		{"INSERT INTO items (id, qty) VALUES (3, 5), (4, 101)", "row 2: constraint violation: CHECK (qty >= 0 AND qty <= 100) failed for column qty"},
+		{"INSERT INTO items (id, price) VALUES (3, 0)", "constraint violation: CHECK (price > 0) failed for column price"},
+		{"UPDATE items SET qty = -1 WHERE id = 2", "constraint violation: CHECK (qty >= 0 AND qty <= 100) failed for column qty"},
+	} {
+		if _, err := engine.HandleCommand(c.query); err == nil || err.Error() != c.err {
+			t.Errorf("%s: expected %q, got %v", c.query, c.err, err)
+		}
+	}
+	// A NULL value passes a CHECK.
+	if _, err := engine.HandleCommand("INSERT INTO items (id, qty) VALUES (3, NULL)"); err != nil {
+		t.Errorf("NULL should pass CHECK: %v", err)
+	}
+
+	check := func(when string) {
+		t.Helper()
+		want := "id\tqty\tstatus\tprice\n1\t1\tnew item\tNULL\n2\t1\tsold\t9.5\n3\tNULL\tnew item\tNULL\n"
+		if res, _ := engine.HandleCommand("SELECT id, qty, status, price FROM items"); res != want {
+			t.Errorf("%s: unexpected rows: %q", when, res)
+		}
+		res, _ := engine.HandleCommand("SELECT id FROM items WHERE added > '2025-01-01 00:00:00'")
+		if res != "id\n1\n3\n" {
+			t.Errorf("%s: CURRENT_TIMESTAMP default not applied: %q", when, res)
+		}
+	}
+	check("after insert")
+
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	check("after reload")
+	if _, err := engine.HandleCommand("INSERT INTO items (id, qty) VALUES (4, 200)"); err == nil {
+		t.Error("CHECK lost after reload")
+	}
+	tx := engine.BeginTx()
+	if _, err := tx.Exec("UPDATE items SET qty = 500 WHERE id = 1"); err == nil {
+		t.Error("CHECK lost in a transaction")
+	}
+	tx.Rollback()
+	if _, err := engine.HandleCommand("UPDATE items SET qty = 500 WHERE id = 1"); err == nil {
+		t.Error("CHECK lost after a rollback")
+	}
+
+	file := filepath.Join(t.TempDir(), "items.sql")
+	if err := engine.SaveSQLDumpWith(file, engine.DumpOptions{SchemaOnly: true}); err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	want := "CREATE TABLE items (id INT PRIMARY KEY, qty INT DEFAULT 1 CHECK (qty >= 0 AND qty <= 100), " +
+		"status TEXT DEFAULT 'new item', price FLOAT CHECK (price > 0), added TIMESTAMP DEFAULT CURRENT_TIMESTAMP);\n"
+	if data, _ := os.ReadFile(file); !strings.Contains(string(data), want) {
+		t.Errorf("unexpected dump:\n%s", data)
+	}
+}
+
+func TestForeignKeys(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	engine.Tables = make(map[string]*engine.Table)
+
+	exec := func(query string) {
+		t.Helper()
+		if _, err := engine.HandleCommand(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	exec("CREATE TABLE users (id INT PRIMARY KEY, email TEXT UNIQUE, name TEXT)")
+	for _, c := range []struct{ query, err string }{
+		{"CREATE TABLE bad (u INT REFERENCES nope(id))", "table nope referenced by column u does not exist"},
+		{"CREATE TABLE bad (u INT REFERENCES users(name))", "column users.name referenced by column u is not PRIMARY KEY or UNIQUE"},
+		{"CREATE TABLE bad (u TEXT REFERENCES users(id))", "column u of type TEXT cannot reference users.id of type INT"},
+		{"CREATE TABLE bad (u INT PRIMARY KEY REFERENCES users(id) ON DELETE SET NULL)", "PRIMARY KEY column u cannot be SET NULL on delete"},
+		{"CREATE TABLE bad (u INT REFERENCES users(id) ON DELETE NOTHING)", "invalid ON DELETE action for column u"},
+	} {
+		if _, err := engine.HandleCommand(c.query); err == nil || err.Error() != c.err {
+			t.Errorf("%s: expected %q, got %v", c.query, c.err, err)
+		}
+	}
+	exec("CREATE TABLE orders (id INT PRIMARY KEY, user_id INT REFERENCES users(id) ON DELETE CASCADE, total FLOAT) WITH (storage=columnar)")
+	exec("CREATE TABLE notes (id INT PRIMARY KEY, user_id INT REFERENCES users(id) ON DELETE SET NULL, body TEXT)")
+	exec("CREATE TABLE payments (id INT PRIMARY KEY, order_id INT REFERENCES orders(id))")
+	exec("INSERT INTO users VALUES (1, 'a@x', 'ann'), (2, 'b@x', 'bob'), (3, 'c@x', 'cy')")
+	exec("INSERT INTO orders VALUES (10, 1, 5), (11, 1, 7), (20, 2, 3), (30, NULL, 1)")
+	exec("INSERT INTO notes VALUES (1, 1, 'vip'), (2, 3, 'new')")
+	exec("INSERT INTO payments VALUES (1, 20)")
+
+	for _, c := range []struct{ query, err string }{
+		{"INSERT INTO orders VALUES (12, 1, 1), (13, 99, 1)", "row 2: constraint violation: value 99 of column user_id not found in users.id"},
+		{"UPDATE orders SET user_id = 4 WHERE id = 10", "constraint violation: value 4 of column user_id not found in users.id"},
+		{"UPDATE users SET id = 5 WHERE id = 1", "constraint violation: value 1 of users.id is referenced by notes.user_id"},
+		{"DELETE FROM users WHERE id = 2", "constraint violation: value 20 of orders.id is referenced by payments.order_id"},
+		{"CREATE TABLE users (id INT PRIMARY KEY)", "table users is referenced by notes.user_id"},
+		{"DELETE users WHERE id = 1", "invalid DELETE syntax"},
+	} {
+		if _, err := engine.HandleCommand(c.query); err == nil || err.Error() != c.err {
+			t.Errorf("%s: expected %q, got %v", c.query, c.err, err)
+		}
+	}
+	// Changing a key nothing references is allowed.
+	exec("UPDATE users SET id = 4 WHERE id = 2 AND name = 'nobody'")
+
+	check := func(query, want string) {
+		t.Helper()
+		if res, err := engine.HandleCommand(query); err != nil || res != want {
+			t.Errorf("%s: expected %q, got %q (%v)", query, want, res, err)
+		}
+	}
+	check("DELETE FROM users WHERE id = 1", "1 rows deleted.")
+	check("SELECT * FROM users", "id\temail\tname\n2\tb@x\tbob\n3\tc@x\tcy\n")
+	check("SELECT * FROM orders", "id\tuser_id\ttotal\n20\t2\t3\n30\tNULL\t1\n")
+	check("SELECT * FROM notes", "id\tuser_id\tbody\n1\tNULL\tvip\n2\t3\tnew\n")
+	// The indexes follow the rows that moved up.
+	check("SELECT name FROM users WHERE id = 3", "name\ncy\n")
+	check("SELECT total FROM orders WHERE id = 30", "total\n1\n")
+	exec("CREATE TABLE points (id INT PRIMARY KEY, x FLOAT, label TEXT) WITH (storage=columnar)")
+	exec("INSERT INTO points VALUES (1, 1.5, 'a'), (2, NULL, 'b'), (3, 3.5, 'c'), (4, 4.5, 'd')")
+	check("DELETE FROM points WHERE x > 1 AND x < 4", "2 rows deleted.")
+	check("SELECT * FROM points", "id\tx\tlabel\n2\tNULL\tb\n4\t4.5\td\n")
+	check("SELECT label FROM points WHERE id = 4", "label\nd\n")
+	check("SELECT MIN(x) FROM points", "MIN(x)\n4.5\n")
+
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if _, err := engine.HandleCommand("INSERT INTO orders VALUES (40, 1, 1)"); err == nil {
+		t.Error("REFERENCES lost after reload")
+	}
+	// Referencing rows are found through an index on the column.
+	if idx := engine.Tables["orders"].Indexes["user_id"]; idx == nil || idx.Unique {
+		t.Errorf("no index on the referencing column: %+v", idx)
+	}
+	check("DELETE FROM payments", "1 rows deleted.")
+	check("DELETE FROM users WHERE id = 2", "1 rows deleted.")
+	check("SELECT id FROM orders", "id\n30\n")
+
+	// A table may reference itself; rows inserted together may reference
+	// each other.
+	exec("CREATE TABLE staff (id INT PRIMARY KEY, manager INT REFERENCES staff(id) ON DELETE CASCADE)")
+	exec("INSERT INTO staff VALUES (1, NULL), (2, 1), (3, 2), (4, NULL)")
+	check("DELETE FROM staff WHERE id = 1", "1 rows deleted.")
+	check("SELECT id FROM staff", "id\n4\n")
+
+	file := filepath.Join(t.TempDir(), "fk.sql")
+	if err := engine.SaveSQLDumpWith(file, engine.DumpOptions{SchemaOnly: true}); err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	data, _ := os.ReadFile(file)
+	dump := string(data)
+	if !strings.Contains(dump, "user_id INT REFERENCES users(id) ON DELETE CASCADE, total FLOAT") ||
+		!strings.Contains(dump, "order_id INT REFERENCES orders(id))") {
+		t.Errorf("constraints missing from dump:\n%s", dump)
+	}
+	if strings.Contains(dump, "CREATE INDEX") {
+		t.Errorf("index of a REFERENCES column dumped:\n%s", dump)
+	}
+	if strings.Index(dump, "CREATE TABLE users") > strings.Index(dump, "CREATE TABLE notes") {
+		t.Errorf("referenced table dumped after its references:\n%s", dump)
+	}
+
+	// A dump of a table that references itself loads back across INSERT
+	// batches, even with rows stored before the rows they reference and a
+	// cycle of references.
+	exec("CREATE TABLE emp (id INT PRIMARY KEY, boss INT REFERENCES emp(id))")
+	exec("INSERT INTO emp VALUES (1, NULL), (2, 1), (3, 2), (4, 3), (5, 4), (6, NULL), (7, NULL), (8, 8)")
+	exec("UPDATE emp SET boss = 5 WHERE id = 1")
+	exec("UPDATE emp SET boss = 7 WHERE id = 6")
+	want := "id\tboss\n1\t5\n2\t1\n3\t2\n4\t3\n5\t4\n6\t7\n7\tNULL\n8\t8\n"
+	check("SELECT * FROM emp ORDER BY id", want)
+	file = filepath.Join(t.TempDir(), "emp.sql")
+	if err := engine.SaveSQLDumpWith(file, engine.DumpOptions{Tables: []string{"emp"}, BatchRows: 2}); err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	engine.Tables = make(map[string]*engine.Table)
+	if _, err := engine.HandleCommand(fmt.Sprintf("SOURCE '%s'", file)); err != nil {
+		data, _ := os.ReadFile(file)
+		t.Fatalf("source: %v\n%s", err, data)
+	}
+	check("SELECT * FROM emp ORDER BY id", want)
+}
+
+func TestAutoIncrement(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	engine.Tables = make(map[string]*engine.Table)
+
+	for _, c := range []struct{ query, err string }{
+		{"CREATE TABLE bad (a SERIAL, b INT AUTOINCREMENT)", "multiple AUTOINCREMENT columns are not supported"},
+		{"CREATE TABLE bad (a TEXT AUTOINCREMENT)", "AUTOINCREMENT column a must be INT or BIGINT"},
+		{"CREATE TABLE bad (a INT AUTOINCREMENT DEFAULT 1)", "AUTOINCREMENT column a cannot have a DEFAULT"},
+	} {
+		if _, err := engine.HandleCommand(c.query); err == nil || err.Error() != c.err {
+			t.Errorf("%s: expected %q, got %v", c.query, c.err, err)
+		}
+	}
+
+	exec := func(query string) {
+		t.Helper()
+		if _, err := engine.HandleCommand(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	check := func(want string) {
+		t.Helper()
+		if res, _ := engine.HandleCommand("SELECT * FROM tickets"); res != want {
+			t.Errorf("unexpected rows: %q", res)
+		}
+	}
+	exec("CREATE TABLE tickets (id BIGINT PRIMARY KEY AUTOINCREMENT, title TEXT UNIQUE)")
+	exec("INSERT INTO tickets (title) VALUES ('a'), ('b')")
+	// A rejected INSERT uses up no values.
+	if _, err := engine.HandleCommand("INSERT INTO tickets (title) VALUES ('c'), ('a')"); err == nil {
+		t.Fatal("expected a duplicate title to be rejected")
+	}
+	exec("INSERT INTO tickets (title) VALUES ('c')")
+	check("id\ttitle\n1\ta\n2\tb\n3\tc\n")
+
+	// Deleted values are not reused, also after a reload.
+	exec("DELETE FROM tickets WHERE id = 3")
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	exec("INSERT INTO tickets VALUES (DEFAULT, 'd')")
+	check("id\ttitle\n1\ta\n2\tb\n4\td\n")
+
+	tx := engine.BeginTx()
+	if _, err := tx.Exec("INSERT INTO tickets (title) VALUES ('e')"); err != nil {
+		t.Fatalf("insert in tx: %v", err)
+	}
+	tx.Rollback()
+	exec("INSERT INTO tickets (title) VALUES ('f')")
+	check("id\ttitle\n1\ta\n2\tb\n4\td\n5\tf\n")
+
+	// Replaying the WAL assigns the same values.
+	saved, _ := os.ReadFile("data.mdb")
+	os.Remove("data.mdb")
+	_ = os.Mkdir("data.mdb", 0700)
+	if _, err := engine.HandleCommand("INSERT INTO tickets (title) VALUES ('g'), ('h')"); err == nil {
+		t.Fatalf("expected the save to fail")
+	}
+	os.Remove("data.mdb")
+	_ = os.WriteFile("data.mdb", saved, 0600)
+	engine.Tables = make(map[string]*engine.Table)
+	if err := engine.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	check("id\ttitle\n1\ta\n2\tb\n4\td\n5\tf\n6\tg\n7\th\n")
+
+	file := filepath.Join(t.TempDir(), "tickets.sql")
+	if err := engine.SaveSQLDumpWith(file, engine.DumpOptions{SchemaOnly: true}); err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	want := "CREATE TABLE tickets (id BIGINT PRIMARY KEY AUTOINCREMENT, title TEXT UNIQUE) WITH (sequence=7);\n"
+	if data, _ := os.ReadFile(file); !strings.HasPrefix(string(data), want) {
+		t.Errorf("unexpected dump:\n%s", data)
+	}
+
+	// Updating the column past the counter moves the counter forward.
+	exec("UPDATE tickets SET id = 20 WHERE id = 7")
+	exec("UPDATE tickets SET id = 3 WHERE id = 6")
+	exec("INSERT INTO tickets (title) VALUES ('i')")
+	check("id\ttitle\n1\ta\n2\tb\n4\td\n5\tf\n3\tg\n20\th\n21\ti\n")
+}
+
+func TestUpsert(t *testing.T) {
+	os.Remove("data.mdb")
+	os.Remove("data.wal")
+	defer os.Remove("data.mdb")
+	defer os.Remove("data.wal")
+	engine.Tables = make(map[string]*engine.Table)
+
+	exec := func(query, want string) {
+		t.Helper()
+		res, err := engine.Exec(query)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if res.Message != want {
+			t.Errorf("%s: expected %q, got %q", query, want, res.Message)
+		}
+	}
+	check := func(query, want string) {
+		t.Helper()
+		if res, _ := engine.HandleCommand(query); res != want {
+			t.Errorf("%s: unexpected rows: %q", query, res)
+		}
+	}
+	exec("CREATE TABLE stock (sku TEXT PRIMARY KEY, qty INT CHECK (qty >= 0), note TEXT)", "Table 'stock' created.")
+	exec("CREATE INDEX ON stock (qty)", "Index on qty created.")
+	exec("INSERT INTO stock VALUES ('a', 1, 'x'), ('b', 2, 'y')", "2 rows inserted.")
+
+	exec("INSERT INTO stock VALUES ('a', 5, 'z'), ('c', 3, 'z') ON CONFLICT DO NOTHING", "1 row inserted.")
+	exec("INSERT INTO stock VALUES ('a', 5, 'z') ON CONFLICT (sku) DO NOTHING", "0 rows inserted.")
+	res, err := engine.Exec("INSERT INTO stock VALUES ('b', 7, 'z'), ('d', 4, 'z') ON CONFLICT (sku) DO UPDATE SET qty = EXCLUDED.qty, note = 'updated'")
+	if err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if res.Message != "1 row inserted, 1 updated." || res.RowsAffected != 2 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	check("SELECT * FROM stock", "sku\tqty\tnote\na\t1\tx\nb\t7\tupdated\nc\t3\tz\nd\t4\tz\n")
+	// The index on qty follows the update.
+	check("SELECT sku FROM stock WHERE qty = 7", "sku\nb\n")
+	check("SELECT sku FROM stock WHERE qty = 2", "sku\n")
+
+	for _, c := range []struct{ query, err string }{
+		{"INSERT INTO stock VALUES ('a', 1, 'x') ON CONFLICT (qty) DO NOTHING", "no unique index on (qty) for ON CONFLICT"},
+		{"INSERT INTO stock VALUES ('a', 1, 'x') ON CONFLICT DO UPDATE SET qty = 1", "ON CONFLICT DO UPDATE requires a conflict target"},
+		{"INSERT INTO stock VALUES ('a', 1, 'x') ON CONFLICT (sku) DO UPDATE SET qty = EXCLUDED.note", "EXCLUDED.note cannot be assigned to INT column qty"},
+		{"INSERT INTO stock VALUES ('a', 1, 'x') ON CONFLICT (sku) DO UPDATE SET qty = 'many'", "invalid INT value for column qty"},
+		{"INSERT INTO stock VALUES ('a', 1, 'x'), ('a', 2, 'x') ON CONFLICT (sku) DO UPDATE SET qty = EXCLUDED.qty", "row 2: ON CONFLICT DO UPDATE cannot affect a row twice"},
+		{"INSERT INTO stock VALUES ('e', 1, 'x'), ('e', 2, 'x') ON CONFLICT (sku) DO UPDATE SET qty = EXCLUDED.qty", "row 2: ON CONFLICT DO UPDATE cannot affect a row twice"},
+		{"INSERT INTO stock VALUES ('a', -1, 'x') ON CONFLICT (sku) DO UPDATE SET qty = EXCLUDED.qty", "constraint violation: CHECK (qty >= 0) failed for column qty"},
+		{"INSERT INTO stock VALUES ('e', 1, 'x'), ('a', 1, 'x') ON CONFLICT (sku) DO UPDATE SET sku = 'e'", "constraint violation: duplicate value e for PRIMARY KEY column sku"},
+	} {
+		if _, err := engine.HandleCommand(c.query); err == nil || err.Error() != c.err {
+			t.Errorf("%s: expected %q, got %v", c.query, c.err, err)
+		}
+	}
+	// Rejected statements change nothing.
+	check("SELECT * FROM stock", "sku\tqty\tnote\na\t1\tx\nb\t7\tupdated\nc\t3\tz\nd\t4\tz\n")
+
+	if err := engine.LoadBinaryDB(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	check("SELECT * FROM stock WHERE sku = 'b'", "sku\tqty\tnote\nb\t7\tupdated\n")
+
+	// DO UPDATE moves the AUTOINCREMENT counter like UPDATE does.
+	exec("CREATE TABLE tags (id SERIAL PRIMARY KEY, name TEXT UNIQUE)", "Table 'tags' created.")
+	exec("INSERT INTO tags (name) VALUES ('a')", "1 row inserted.")
+	exec("INSERT INTO tags (name) VALUES ('a') ON CONFLICT (name) DO UPDATE SET id = 10", "0 rows inserted, 1 updated.")
+	exec("INSERT INTO tags (name) VALUES ('b')", "1 row inserted.")
+	check("SELECT * FROM tags", "id\tname\n10\ta\n11\tb\n")
+}
@@ -7,6 +7,7 @@ package driver
 import (
 	"database/sql"
 	"database/sql/driver"
+	"fmt"
 	"io"
 	"strings"
 
@@ -19,8 +20,23 @@ type Driver struct{}
 
 func init() { sql.Register("minidb", &Driver{}) }
 
-// Open initializes the database and returns a new connection.
+// Open initializes the database and returns a new connection. The data
+// source name may set the encryption key as "key=<hex>" among other
+// "&"-separated parameters; otherwise the key is taken from the MINIDB_KEY
+// environment variable, if set. The rest of the name is ignored, as it was
+// before the key parameter existed.
 func (d *Driver) Open(name string) (driver.Conn, error) {
+	for _, param := range strings.Split(name, "&") {
+		if value, ok := strings.CutPrefix(param, "key="); ok {
+			key, err := engine.ParseKey(value)
+			if err == nil {
+				err = engine.SetEncryptionKey(key)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
 	if err := engine.Init(); err != nil {
 		return nil, err
 	}
@@ -49,13 +65,29 @@ func (s *stmt) Close() error { return nil }
 func (s *stmt) NumInput() int { return -1 }
 
 func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
-	if _, err := engine.Execute(s.query); err != nil {
+	res, err := engine.Exec(s.query)
+	if err != nil {
 		return nil, err
 	}
-	return driver.RowsAffected(0), nil
+	return result{res}, nil
 }
 
+// result reports the rows changed by a statement and, for an INSERT into a
+// table with an AUTOINCREMENT column, the value assigned to the last row.
+type result struct{ res engine.Result }
+
+func (r result) LastInsertId() (int64, error) { return r.res.LastInsertID, nil }
+func (r result) RowsAffected() (int64, error) { return r.res.RowsAffected, nil }
+
 func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(s.query)), "SELECT") {
+		res, err := engine.Query(s.query)
+		if err != nil {
+			return nil, err
+		}
+		return &typedRows{res: res}, nil
+	}
+
 	res, err := engine.Execute(s.query)
 	if err != nil {
 		return nil, err
@@ -95,3 +127,52 @@ func (r *rows) Next(dest []driver.Value) error {
 	}
 	return nil
 }
+
+// typedRows returns the values of a SELECT converted to driver types.
+type typedRows struct {
+	res *engine.ResultSet
+	idx int
+}
+
+func (r *typedRows) Columns() []string { return r.res.Columns }
+func (r *typedRows) Close() error      { return nil }
+
+// ColumnTypeDatabaseTypeName reports the MiniDB type of a column without
+// its parameters, e.g. DECIMAL for DECIMAL(10,2).
+func (r *typedRows) ColumnTypeDatabaseTypeName(index int) string {
+	return string(r.res.Types[index].Base())
+}
+
+func (r *typedRows) Next(dest []driver.Value) error {
+	if r.idx >= len(r.res.Rows) {
+		return io.EOF
+	}
+	row := r.res.Rows[r.idx]
+	r.idx++
+	for i, v := range row {
+		dest[i] = driverValue(v)
+	}
+	return nil
+}
+
+// driverValue maps an engine value onto the types allowed by database/sql:
+// integers become int64, TIMESTAMP and DATE become time.Time, BLOB becomes
+// []byte and DECIMAL is returned as its exact decimal string.
+func driverValue(v interface{}) driver.Value {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case int:
+		return int64(x)
+	case int64, float64, bool, string:
+		return x
+	case engine.Timestamp:
+		return x.Time()
+	case engine.Date:
+		return x.Time()
+	case engine.Blob:
+		return append([]byte(nil), x...)
+	default:
+		return fmt.Sprint(x)
+	}
+}
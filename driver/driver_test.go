@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"os"
 	"testing"
+	"time"
 
 	_ "minisql/driver"
 	"minisql/engine"
@@ -38,3 +39,127 @@ func TestSQLDriver(t *testing.T) {
 		t.Errorf("unexpected values: %s %s", id, name)
 	}
 }
+
+func TestSQLDriverTypes(t *testing.T) {
+	_ = os.Remove("data.mdb")
+	engine.Tables = make(map[string]*engine.Table)
+
+	db, err := sql.Open("minidb", "")
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	if _, err := db.Exec("CREATE TABLE typed (id BIGINT, ok BOOL, at TIMESTAMP, day DATE, data BLOB, price DECIMAL(6,2))"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO typed VALUES (7, true, '2024-05-06T07:08:09Z', '2024-05-06', X'0102', 3.5)"); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	rows, err := db.Query("SELECT * FROM typed")
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatalf("column types: %v", err)
+	}
+	if name := types[5].DatabaseTypeName(); name != "DECIMAL" {
+		t.Errorf("unexpected type name %q", name)
+	}
+	if !rows.Next() {
+		t.Fatalf("no rows: %v", rows.Err())
+	}
+	var (
+		id    int64
+		ok    bool
+		at    time.Time
+		day   time.Time
+		data  []byte
+		price string
+	)
+	if err := rows.Scan(&id, &ok, &at, &day, &data, &price); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if id != 7 || !ok || !at.Equal(time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)) ||
+		!day.Equal(time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)) || string(data) != "\x01\x02" || price != "3.50" {
+		t.Errorf("unexpected values: %d %v %v %v %x %s", id, ok, at, day, data, price)
+	}
+}
+
+func TestSQLDriverKeyDSN(t *testing.T) {
+	_ = os.Remove("data.mdb")
+	defer func() { _ = os.Remove("data.mdb") }()
+	defer func() { _ = engine.SetEncryptionKey(nil) }()
+	engine.Tables = make(map[string]*engine.Table)
+
+	db, _ := sql.Open("minidb", "key=xyz")
+	if err := db.Ping(); err == nil {
+		t.Errorf("expected error for an invalid key")
+	}
+	_ = db.Close()
+
+	// Names accepted before the key parameter still open.
+	for _, dsn := range []string{"data.mdb", "file:minidb?cache=shared;mode=rwc", "cache=1"} {
+		db, _ := sql.Open("minidb", dsn)
+		if err := db.Ping(); err != nil {
+			t.Errorf("DSN %q: %v", dsn, err)
+		}
+		_ = db.Close()
+	}
+
+	db, err := sql.Open("minidb", "cache=1&key=00112233445566778899aabbccddeeff")
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	if _, err := db.Exec("CREATE TABLE secrets (v TEXT)"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	data, _ := os.ReadFile("data.mdb")
+	if len(data) < 6 || data[5]&2 == 0 {
+		t.Errorf("data file not encrypted")
+	}
+}
+
+func TestSQLDriverLastInsertId(t *testing.T) {
+	_ = os.Remove("data.mdb")
+	defer func() { _ = os.Remove("data.mdb") }()
+	engine.Tables = make(map[string]*engine.Table)
+
+	db, err := sql.Open("minidb", "")
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	if _, err := db.Exec("CREATE TABLE people (id SERIAL PRIMARY KEY, name TEXT)"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	for _, c := range []struct {
+		query    string
+		id, rows int64
+	}{
+		{query: "INSERT INTO people (name) VALUES ('ann')", id: 1, rows: 1},
+		{query: "INSERT INTO people (name) VALUES ('bo'), ('cy')", id: 3, rows: 2},
+		{query: "INSERT INTO people VALUES (10, 'di')", id: 10, rows: 1},
+		{query: "INSERT INTO people VALUES (NULL, 'ed')", id: 11, rows: 1},
+		{query: "UPDATE people SET name = 'Ann' WHERE id = 1", id: 0, rows: 1},
+	} {
+		res, err := db.Exec(c.query)
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		id, _ := res.LastInsertId()
+		n, _ := res.RowsAffected()
+		if id != c.id || n != c.rows {
+			t.Errorf("%s: got id %d and %d rows, want %d and %d", c.query, id, n, c.id, c.rows)
+		}
+	}
+}
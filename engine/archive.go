@@ -0,0 +1,182 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WALArchiveDir is the directory that keeps WAL entries after they have
+// been applied to the data file. Each archived entry gets a log sequence
+// number (LSN) and a timestamp, so Restore can replay the changes made
+// after a backup up to a chosen point. Empty disables archiving. Set it
+// before Init.
+var WALArchiveDir string
+
+// walSegmentSize is the size after which archived entries go to a new
+// segment file.
+const walSegmentSize = 16 << 20
+
+// walArchive appends entries to the segment files of WALArchiveDir.
+// Segments are named after the LSN of their first entry, and every line
+// holds the LSN, the time in Unix nanoseconds and the WAL line as it was
+// written, so encrypted entries stay encrypted. The caller must hold walMu.
+type walArchive struct {
+	dir  string // directory lsn was read from
+	lsn  uint64 // last LSN assigned
+	seg  *os.File
+	size int64
+}
+
+var (
+	archive walArchive
+	// walArchived is the length of the start of walFile that is already
+	// archived. The caller must hold walMu.
+	walArchived int64
+)
+
+// open reads the last LSN of WALArchiveDir if it was not read yet.
+func (a *walArchive) open() error {
+	if a.dir == WALArchiveDir {
+		return nil
+	}
+	a.cut()
+	if err := os.MkdirAll(WALArchiveDir, 0700); err != nil {
+		return err
+	}
+	lsn := uint64(0)
+	err := readArchive(WALArchiveDir, func(n uint64, _ time.Time, _ string) (bool, error) {
+		lsn = n
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	a.dir, a.lsn = WALArchiveDir, lsn
+	return nil
+}
+
+// append archives WAL lines with consecutive LSNs.
+func (a *walArchive) append(lines []string, at time.Time) error {
+	if err := a.open(); err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if a.seg == nil || a.size >= walSegmentSize {
+			a.cut()
+			name := filepath.Join(a.dir, fmt.Sprintf("%020d.wal", a.lsn+1))
+			f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				return err
+			}
+			a.seg, a.size = f, 0
+		}
+		n, err := fmt.Fprintf(a.seg, "%d %d %s\n", a.lsn+1, at.UnixNano(), line)
+		if err != nil {
+			return err
+		}
+		a.lsn++
+		a.size += int64(n)
+	}
+	return nil
+}
+
+// cut closes the current segment so that the next entry starts a new one.
+func (a *walArchive) cut() {
+	if a.seg != nil {
+		_ = a.seg.Close()
+		a.seg = nil
+	}
+}
+
+// archiveWAL archives the complete entries of walFile that are not
+// archived yet. The caller must hold walMu.
+func archiveWAL() error {
+	if WALArchiveDir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(walFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if walArchived > int64(len(data)) {
+		walArchived = 0
+	}
+	data = data[walArchived:]
+	end := bytes.LastIndexByte(data, '\n') + 1
+	var lines []string
+	for _, line := range strings.Split(string(data[:end]), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := archive.append(lines, time.Now()); err != nil {
+		return err
+	}
+	walArchived += int64(end)
+	return nil
+}
+
+// readArchive calls fn for the entries of the archive in dir in LSN order
+// until fn returns false or an error.
+func readArchive(dir string, fn func(lsn uint64, at time.Time, line string) (bool, error)) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".wal") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		more, err := readSegment(filepath.Join(dir, name), fn)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+func readSegment(path string, fn func(uint64, time.Time, string) (bool, error)) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for i := 1; scanner.Scan(); i++ {
+		parts := strings.SplitN(scanner.Text(), " ", 3)
+		if len(parts) != 3 {
+			return false, fmt.Errorf("line %d: malformed entry", i)
+		}
+		lsn, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("line %d: invalid LSN", i)
+		}
+		nanos, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("line %d: invalid timestamp", i)
+		}
+		more, err := fn(lsn, time.Unix(0, nanos), parts[2])
+		if err != nil || !more {
+			return false, err
+		}
+	}
+	return true, scanner.Err()
+}
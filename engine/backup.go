@@ -0,0 +1,210 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// backupLabel is the file describing a backup. It is written last, so a
+// directory without it holds no complete backup.
+const backupLabel = "backup_label"
+
+// BackupInfo describes a backup.
+type BackupInfo struct {
+	LSN  uint64 // last archived WAL entry contained in the snapshot
+	Time time.Time
+}
+
+// RestoreTarget limits the archived WAL entries replayed by Restore. A zero
+// field sets no limit.
+type RestoreTarget struct {
+	LSN  uint64    // last entry to replay
+	Time time.Time // entries archived later are not replayed
+}
+
+// Backup writes a consistent snapshot of the database to dir. Changes are
+// blocked only while the tables are copied in memory; the copy is written
+// afterwards. Pending WAL entries are archived first and the archive moves
+// on to a new segment, so the archived entries after the returned LSN are
+// exactly the changes made after the snapshot.
+func Backup(dir string) (BackupInfo, error) {
+	if txCtx != nil {
+		return BackupInfo{}, errors.New("BACKUP cannot run inside a transaction")
+	}
+	label := filepath.Join(dir, backupLabel)
+	if _, err := os.Stat(label); err == nil {
+		return BackupInfo{}, fmt.Errorf("%s already holds a backup", dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return BackupInfo{}, err
+	}
+
+	// Statements write their WAL entry and apply it while holding the lock
+	// of their table, so with every table locked the archive position
+	// matches the copied tables. They are locked in name order like in
+	// statements that lock several tables.
+	dbMu.Lock()
+	tables := sortedTables()
+	for _, t := range tables {
+		t.mu.RLock()
+	}
+	walMu.Lock()
+	info := BackupInfo{Time: time.Now().UTC()}
+	err := archiveWAL()
+	if err == nil && WALArchiveDir != "" {
+		err = archive.open()
+		archive.cut()
+		info.LSN = archive.lsn
+	}
+	walMu.Unlock()
+	var snapshot map[string]*Table
+	if err == nil {
+		snapshot = cloneTables(Tables)
+	}
+	for _, t := range tables {
+		t.mu.RUnlock()
+	}
+	dbMu.Unlock()
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	err = writeDBFile(filepath.Join(dir, binaryDBFile), snapshot, false)
+	releaseTables(snapshot)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	content := fmt.Sprintf("lsn %d\ntime %s\n", info.LSN, info.Time.Format(time.RFC3339Nano))
+	if err := os.WriteFile(label, []byte(content), 0600); err != nil {
+		return BackupInfo{}, err
+	}
+	return info, nil
+}
+
+// Restore replaces the database with the backup in dir and replays the
+// entries of WALArchiveDir that follow it, up to target. It returns the
+// LSN the database was restored to. Use it instead of Init.
+func Restore(dir string, target RestoreTarget) (uint64, error) {
+	if txCtx != nil {
+		return 0, errors.New("restore cannot run inside a transaction")
+	}
+	info, err := readBackupLabel(filepath.Join(dir, backupLabel))
+	if err != nil {
+		return 0, err
+	}
+	if target.LSN != 0 && target.LSN < info.LSN {
+		return 0, fmt.Errorf("target LSN %d precedes the backup at LSN %d", target.LSN, info.LSN)
+	}
+	if !target.Time.IsZero() && target.Time.Before(info.Time) {
+		return 0, fmt.Errorf("target time precedes the backup taken at %s", info.Time.Format(time.RFC3339))
+	}
+	if WALArchiveDir == "" && (target.LSN != 0 || !target.Time.IsZero()) {
+		return 0, errors.New("a restore target needs a WAL archive")
+	}
+	if err := loadKeyFromEnv(); err != nil {
+		return 0, err
+	}
+	db, err := readDBFile(filepath.Join(dir, binaryDBFile))
+	if err != nil {
+		return 0, err
+	}
+	installDB(db)
+
+	// Entries left in the WAL belong to the database being replaced.
+	walMu.Lock()
+	err = os.Remove(walFile)
+	walArchived = 0
+	walMu.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	lsn := info.LSN
+	if WALArchiveDir != "" {
+		walReplay = true
+		err = readArchive(WALArchiveDir, func(n uint64, at time.Time, line string) (bool, error) {
+			switch {
+			case n <= info.LSN:
+				return true, nil
+			case target.LSN != 0 && n > target.LSN,
+				!target.Time.IsZero() && at.After(target.Time):
+				return false, nil
+			case n != lsn+1:
+				return false, fmt.Errorf("WAL archive is missing entries %d to %d", lsn+1, n-1)
+			}
+			entry, err := decodeWALEntry(line)
+			if err == nil {
+				_, err = HandleCommand(entry)
+			}
+			if err != nil {
+				return false, fmt.Errorf("replaying LSN %d: %w", n, err)
+			}
+			lsn = n
+			return true, nil
+		})
+		walReplay = false
+		if err != nil {
+			return 0, err
+		}
+		if target.LSN > lsn {
+			return 0, fmt.Errorf("WAL archive ends at LSN %d", lsn)
+		}
+	}
+	if err := SaveBinaryDB(); err != nil {
+		return 0, err
+	}
+	return lsn, nil
+}
+
+func readBackupLabel(path string) (BackupInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	defer func() { _ = f.Close() }()
+	var info BackupInfo
+	seen := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		switch key {
+		case "lsn":
+			info.LSN, err = strconv.ParseUint(value, 10, 64)
+		case "time":
+			info.Time, err = time.Parse(time.RFC3339Nano, value)
+		default:
+			continue
+		}
+		if err != nil {
+			return BackupInfo{}, fmt.Errorf("%s: invalid %s", backupLabel, key)
+		}
+		seen++
+	}
+	if err := scanner.Err(); err != nil {
+		return BackupInfo{}, err
+	}
+	if seen != 2 {
+		return BackupInfo{}, fmt.Errorf("%s is incomplete", backupLabel)
+	}
+	return info, nil
+}
+
+func handleBackup(query string) (string, error) {
+	fields := strings.Fields(query)
+	if len(fields) < 3 || strings.ToUpper(fields[1]) != "TO" {
+		return "", errors.New("invalid BACKUP syntax")
+	}
+	rest := strings.TrimSpace(strings.TrimSpace(query)[len(fields[0]):])
+	dir := unquote(strings.TrimSpace(rest[len(fields[1]):]))
+	info, err := Backup(dir)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Backup written to %s at LSN %d.", dir, info.LSN), nil
+}
@@ -0,0 +1,255 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"slices"
+)
+
+// ErrChecksum reports a table block whose contents do not match the CRC32
+// stored with it.
+var ErrChecksum = errors.New("checksum mismatch")
+
+// fileIDSize is the size of the random id that follows the flags of an
+// encrypted v12 file.
+const fileIDSize = 16
+
+// blockAD builds the additional data of the encrypted blocks of a v12 file:
+// the file header including its id, the index of the block in the file and
+// the table name. A block thus only decrypts at its place in its own file.
+// Table names themselves stay readable in the block headers.
+type blockAD struct {
+	header []byte
+	seq    uint32
+}
+
+func (a *blockAD) next(name string) []byte {
+	ad := binary.LittleEndian.AppendUint32(slices.Clone(a.header), a.seq)
+	a.seq++
+	return append(ad, name...)
+}
+
+// blockWriter writes every table as a block: the table name, the length of
+// the contents as a uvarint, the contents (compressed, then encrypted with
+// ad when the header says so) and a CRC32 of the stored contents. It reuses
+// its buffers between tables. With track set, it collects in spans where
+// the pages of paged tables are written to w, which must then be a
+// countingWriter.
+type blockWriter struct {
+	flags uint8
+	aead  cipher.AEAD
+	buf   bytes.Buffer
+	fw    *flate.Writer
+	ad    *blockAD
+	track bool
+	spans []pageSpan
+}
+
+func (bw *blockWriter) write(w io.Writer, table *Table) error {
+	bw.buf.Reset()
+	var tw io.Writer = &bw.buf
+	compressed := bw.flags&flagCompressed != 0
+	if compressed {
+		if bw.fw == nil {
+			fw, err := flate.NewWriter(&bw.buf, flate.DefaultCompression)
+			if err != nil {
+				return err
+			}
+			bw.fw = fw
+		} else {
+			bw.fw.Reset(&bw.buf)
+		}
+		tw = bw.fw
+	}
+	var cw *countingWriter
+	if bw.track {
+		cw = &countingWriter{w: tw}
+		tw = cw
+	}
+	if err := writeTable(tw, table); err != nil {
+		return err
+	}
+	if compressed {
+		if err := bw.fw.Close(); err != nil {
+			return err
+		}
+	}
+	contents := bw.buf.Bytes()
+	if bw.flags&flagEncrypted != 0 {
+		sealed, err := seal(bw.aead, contents, bw.ad.next(table.Name))
+		if err != nil {
+			return err
+		}
+		contents = sealed
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(table.Name))); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(table.Name)); err != nil {
+		return err
+	}
+	if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(contents)))); err != nil {
+		return err
+	}
+	if cw != nil {
+		// Only plain contents hold the pages as they are.
+		base := w.(*countingWriter).off
+		for _, s := range cw.spans {
+			s.off += base
+			if bw.flags != 0 {
+				s.off = -1
+			}
+			bw.spans = append(bw.spans, s)
+		}
+	}
+	if _, err := w.Write(contents); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, crc32.ChecksumIEEE(contents))
+}
+
+// readTableBlock reads one table block written by blockWriter; v10 blocks
+// have neither the name nor the checksum. ad is set for encrypted v12
+// files; older ones authenticate only the name. It returns io.EOF only when
+// the file ends before the block.
+func readTableBlock(r byteReader, version, flags uint8, ad *blockAD) (*Table, error) {
+	if version < 11 {
+		return readBlockContents(r, version, flags, nil)
+	}
+	var nameLen uint16
+	if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, nameLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	name := string(buf)
+	adata := buf
+	if ad != nil {
+		adata = ad.next(name)
+	}
+	table, err := readBlockContents(r, version, flags, adata)
+	if err != nil {
+		return nil, fmt.Errorf("table %s: %w", name, unexpectedEOF(err))
+	}
+	if table.Name != name {
+		table.release()
+		return nil, fmt.Errorf("table %s: block holds table %s", name, table.Name)
+	}
+	return table, nil
+}
+
+// readBlockContents reads the length, contents and checksum of a block
+// encrypted, if at all, with additional data ad. It returns io.EOF only
+// when r ends before the length.
+func readBlockContents(r byteReader, version, flags uint8, ad []byte) (*Table, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > math.MaxInt64 {
+		return nil, fmt.Errorf("block of %d bytes is too large", size)
+	}
+	sum := crc32.NewIEEE()
+	src := &io.LimitedReader{R: r, N: int64(size)}
+	contents := io.TeeReader(src, sum)
+
+	if flags&flagEncrypted != 0 {
+		// AES-GCM authenticates the block as a whole, so an encrypted block
+		// is read into memory first. Copy instead of allocating size bytes
+		// up front, so that a corrupt length fails on the short read rather
+		// than on the allocation.
+		var block bytes.Buffer
+		if _, err := io.Copy(&block, contents); err != nil {
+			return nil, err
+		}
+		if err := checkBlockEnd(r, src, sum, version); err != nil {
+			return nil, err
+		}
+		plain, err := unseal(currentCipher(), block.Bytes(), ad)
+		if err != nil {
+			return nil, err
+		}
+		return decodeBlock(bytes.NewBuffer(plain), version, flags)
+	}
+
+	// Other blocks are decoded while they are read, so that a table does
+	// not have to fit in memory twice. Whatever the decoder left is still
+	// read and checked first: a checksum mismatch explains a decoding error.
+	var br byteReader = bufio.NewReader(contents)
+	if cr, ok := r.(*countingReader); ok {
+		// The contents follow the length directly.
+		br = &countingReader{r: br, off: cr.off, src: cr.src}
+	}
+	table, err := decodeBlock(br, version, flags)
+	_, cerr := io.Copy(io.Discard, contents)
+	if cerr == nil {
+		cerr = checkBlockEnd(r, src, sum, version)
+	}
+	if cerr != nil {
+		if table != nil {
+			table.release()
+		}
+		return nil, cerr
+	}
+	return table, err
+}
+
+// checkBlockEnd verifies that the contents of a block were complete and,
+// since v11, match the checksum that follows them.
+func checkBlockEnd(r io.Reader, src *io.LimitedReader, sum hash.Hash32, version uint8) error {
+	if src.N > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	if version < 11 {
+		return nil
+	}
+	var stored uint32
+	if err := binary.Read(r, binary.LittleEndian, &stored); err != nil {
+		return unexpectedEOF(err)
+	}
+	if stored != sum.Sum32() {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// decodeBlock parses the table held by the contents of a block, which must
+// hold nothing else.
+func decodeBlock(br byteReader, version, flags uint8) (*Table, error) {
+	if flags&flagCompressed != 0 {
+		br = bufio.NewReader(flate.NewReader(br))
+	}
+	table, err := readTable(br, version)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		table.release()
+		if err == nil {
+			err = errors.New("trailing data")
+		}
+		return nil, err
+	}
+	return table, nil
+}
+
+// unexpectedEOF converts io.EOF into io.ErrUnexpectedEOF for reads that
+// must not end the file.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
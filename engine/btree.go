@@ -0,0 +1,360 @@
+package engine
+
+import "sort"
+
+// btreeDegree is the minimum degree of the index B-tree: every node except
+// the root holds between btreeDegree-1 and 2*btreeDegree-1 keys.
+const btreeDegree = 32
+
+type btreeItem struct {
+	key  interface{}
+	rows []int
+}
+
+type btreeNode struct {
+	items    []btreeItem
+	children []*btreeNode
+}
+
+// btree is an in-memory B-tree mapping column values to row positions.
+// Keys are ordered with compareValues.
+type btree struct {
+	root *btreeNode
+	size int
+}
+
+// bound limits a range scan. A nil *bound means the range is open on that side.
+type bound struct {
+	key       interface{}
+	inclusive bool
+}
+
+func newBTree() *btree {
+	return &btree{root: &btreeNode{}}
+}
+
+// Len returns the number of distinct keys stored in the tree.
+func (t *btree) Len() int { return t.size }
+
+// Get returns the row positions stored under key.
+func (t *btree) Get(key interface{}) []int {
+	if item := t.lookup(key); item != nil {
+		return item.rows
+	}
+	return nil
+}
+
+// Insert adds row to the posting list of key.
+func (t *btree) Insert(key interface{}, row int) {
+	if item := t.lookup(key); item != nil {
+		item.rows = append(item.rows, row)
+		return
+	}
+	if len(t.root.items) == 2*btreeDegree-1 {
+		root := &btreeNode{children: []*btreeNode{t.root}}
+		root.splitChild(0)
+		t.root = root
+	}
+	t.root.insertNonFull(btreeItem{key: key, rows: []int{row}})
+	t.size++
+}
+
+// Delete removes row from the posting list of key and drops the key once
+// no rows reference it.
+func (t *btree) Delete(key interface{}, row int) {
+	item := t.lookup(key)
+	if item == nil {
+		return
+	}
+	for i, r := range item.rows {
+		if r == row {
+			item.rows = append(item.rows[:i], item.rows[i+1:]...)
+			break
+		}
+	}
+	if len(item.rows) > 0 {
+		return
+	}
+	t.root.remove(key)
+	t.size--
+	if len(t.root.items) == 0 && !t.root.leaf() {
+		t.root = t.root.children[0]
+	}
+}
+
+// Min returns the smallest key in the tree.
+func (t *btree) Min() (interface{}, bool) {
+	if t.size == 0 {
+		return nil, false
+	}
+	n := t.root
+	for !n.leaf() {
+		n = n.children[0]
+	}
+	return n.items[0].key, true
+}
+
+// Max returns the largest key in the tree.
+func (t *btree) Max() (interface{}, bool) {
+	if t.size == 0 {
+		return nil, false
+	}
+	n := t.root
+	for !n.leaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n.items[len(n.items)-1].key, true
+}
+
+// Ascend calls fn for every key within [lo, hi] in ascending order until fn
+// returns false.
+func (t *btree) Ascend(lo, hi *bound, fn func(key interface{}, rows []int) bool) {
+	t.root.ascend(lo, hi, fn)
+}
+
+// Descend calls fn for every key within [lo, hi] in descending order until
+// fn returns false.
+func (t *btree) Descend(lo, hi *bound, fn func(key interface{}, rows []int) bool) {
+	t.root.descend(lo, hi, fn)
+}
+
+// mapRows replaces every row position p in the tree by fn(p). fn must keep
+// distinct positions distinct and in the same order.
+func (t *btree) mapRows(fn func(int) int) {
+	t.root.mapRows(fn)
+}
+
+func (t *btree) clone() *btree {
+	return &btree{root: t.root.clone(), size: t.size}
+}
+
+func (t *btree) lookup(key interface{}) *btreeItem {
+	n := t.root
+	for {
+		i, found := n.find(key)
+		if found {
+			return &n.items[i]
+		}
+		if n.leaf() {
+			return nil
+		}
+		n = n.children[i]
+	}
+}
+
+func (n *btreeNode) leaf() bool { return len(n.children) == 0 }
+
+// find returns the position of the first item not less than key and whether
+// that item equals key.
+func (n *btreeNode) find(key interface{}) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return compareValues(n.items[i].key, key) >= 0
+	})
+	return i, i < len(n.items) && compareValues(n.items[i].key, key) == 0
+}
+
+func (n *btreeNode) splitChild(i int) {
+	child := n.children[i]
+	mid := btreeDegree - 1
+	median := child.items[mid]
+
+	right := &btreeNode{items: append([]btreeItem(nil), child.items[mid+1:]...)}
+	if !child.leaf() {
+		right.children = append([]*btreeNode(nil), child.children[mid+1:]...)
+		child.children = child.children[:mid+1]
+	}
+	child.items = child.items[:mid]
+
+	n.items = append(n.items, btreeItem{})
+	copy(n.items[i+1:], n.items[i:])
+	n.items[i] = median
+
+	n.children = append(n.children, nil)
+	copy(n.children[i+2:], n.children[i+1:])
+	n.children[i+1] = right
+}
+
+func (n *btreeNode) insertNonFull(item btreeItem) {
+	i, _ := n.find(item.key)
+	if n.leaf() {
+		n.items = append(n.items, btreeItem{})
+		copy(n.items[i+1:], n.items[i:])
+		n.items[i] = item
+		return
+	}
+	if len(n.children[i].items) == 2*btreeDegree-1 {
+		n.splitChild(i)
+		if compareValues(item.key, n.items[i].key) > 0 {
+			i++
+		}
+	}
+	n.children[i].insertNonFull(item)
+}
+
+// remove deletes key from the subtree rooted at n. The caller guarantees n
+// holds at least btreeDegree items unless n is the root.
+func (n *btreeNode) remove(key interface{}) {
+	i, found := n.find(key)
+	if n.leaf() {
+		if found {
+			n.items = append(n.items[:i], n.items[i+1:]...)
+		}
+		return
+	}
+
+	if found {
+		left, right := n.children[i], n.children[i+1]
+		switch {
+		case len(left.items) >= btreeDegree:
+			pred := left.last()
+			n.items[i] = pred
+			left.remove(pred.key)
+		case len(right.items) >= btreeDegree:
+			succ := right.first()
+			n.items[i] = succ
+			right.remove(succ.key)
+		default:
+			n.merge(i)
+			left.remove(key)
+		}
+		return
+	}
+
+	child := n.children[i]
+	if len(child.items) < btreeDegree {
+		switch {
+		case i > 0 && len(n.children[i-1].items) >= btreeDegree:
+			left := n.children[i-1]
+			child.items = append([]btreeItem{n.items[i-1]}, child.items...)
+			n.items[i-1] = left.items[len(left.items)-1]
+			left.items = left.items[:len(left.items)-1]
+			if !left.leaf() {
+				child.children = append([]*btreeNode{left.children[len(left.children)-1]}, child.children...)
+				left.children = left.children[:len(left.children)-1]
+			}
+		case i < len(n.items) && len(n.children[i+1].items) >= btreeDegree:
+			right := n.children[i+1]
+			child.items = append(child.items, n.items[i])
+			n.items[i] = right.items[0]
+			right.items = right.items[1:]
+			if !right.leaf() {
+				child.children = append(child.children, right.children[0])
+				right.children = right.children[1:]
+			}
+		case i < len(n.items):
+			n.merge(i)
+		default:
+			n.merge(i - 1)
+			child = n.children[i-1]
+		}
+	}
+	child.remove(key)
+}
+
+// merge folds items[i] and children[i+1] into children[i].
+func (n *btreeNode) merge(i int) {
+	left, right := n.children[i], n.children[i+1]
+	left.items = append(left.items, n.items[i])
+	left.items = append(left.items, right.items...)
+	left.children = append(left.children, right.children...)
+	n.items = append(n.items[:i], n.items[i+1:]...)
+	n.children = append(n.children[:i+1], n.children[i+2:]...)
+}
+
+func (n *btreeNode) first() btreeItem {
+	for !n.leaf() {
+		n = n.children[0]
+	}
+	return n.items[0]
+}
+
+func (n *btreeNode) last() btreeItem {
+	for !n.leaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n.items[len(n.items)-1]
+}
+
+func (n *btreeNode) ascend(lo, hi *bound, fn func(interface{}, []int) bool) bool {
+	start := 0
+	if lo != nil {
+		start, _ = n.find(lo.key)
+	}
+	for i := start; i < len(n.items); i++ {
+		if !n.leaf() && !n.children[i].ascend(lo, hi, fn) {
+			return false
+		}
+		item := n.items[i]
+		if lo != nil && !lo.inclusive && compareValues(item.key, lo.key) == 0 {
+			continue
+		}
+		if hi != nil {
+			c := compareValues(item.key, hi.key)
+			if c > 0 || (c == 0 && !hi.inclusive) {
+				return false
+			}
+		}
+		if !fn(item.key, item.rows) {
+			return false
+		}
+	}
+	if !n.leaf() {
+		return n.children[len(n.items)].ascend(lo, hi, fn)
+	}
+	return true
+}
+
+func (n *btreeNode) descend(lo, hi *bound, fn func(interface{}, []int) bool) bool {
+	end := len(n.items) - 1
+	if hi != nil {
+		end = sort.Search(len(n.items), func(i int) bool {
+			return compareValues(n.items[i].key, hi.key) > 0
+		}) - 1
+	}
+	if !n.leaf() && !n.children[end+1].descend(lo, hi, fn) {
+		return false
+	}
+	for i := end; i >= 0; i-- {
+		item := n.items[i]
+		if hi == nil || hi.inclusive || compareValues(item.key, hi.key) != 0 {
+			if lo != nil {
+				c := compareValues(item.key, lo.key)
+				if c < 0 || (c == 0 && !lo.inclusive) {
+					return false
+				}
+			}
+			if !fn(item.key, item.rows) {
+				return false
+			}
+		}
+		if !n.leaf() && !n.children[i].descend(lo, hi, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *btreeNode) mapRows(fn func(int) int) {
+	for i := range n.items {
+		for k, pos := range n.items[i].rows {
+			n.items[i].rows[k] = fn(pos)
+		}
+	}
+	for _, child := range n.children {
+		child.mapRows(fn)
+	}
+}
+
+func (n *btreeNode) clone() *btreeNode {
+	c := &btreeNode{items: make([]btreeItem, len(n.items))}
+	for i, item := range n.items {
+		c.items[i] = btreeItem{key: item.key, rows: append([]int(nil), item.rows...)}
+	}
+	if !n.leaf() {
+		c.children = make([]*btreeNode, len(n.children))
+		for i, child := range n.children {
+			c.children[i] = child.clone()
+		}
+	}
+	return c
+}
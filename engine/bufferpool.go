@@ -0,0 +1,570 @@
+package engine
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// BufferPoolSize is the memory budget in bytes for the rows of row tables.
+// With a positive budget, tables created or loaded afterwards keep their
+// rows in pages that are read on demand and evicted when the budget is
+// exceeded; 0 keeps every table fully in memory. Index B-trees, Stats and
+// columnar tables always stay in memory and are not counted.
+var BufferPoolSize int64
+
+// pageRows is the number of rows in a page.
+const pageRows = 256
+
+// spillCompactMin is the size the spill file must reach before its unused
+// space is reclaimed.
+const spillCompactMin = 64 << 20
+
+// PoolStats reports the activity of the buffer pool.
+type PoolStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Pages     int   // resident pages
+	Resident  int64 // estimated bytes held by resident pages
+	Spilled   int64 // bytes of the spill file in use
+}
+
+// bufferPool keeps the resident pages of all paged tables in LRU order.
+// Evicted pages that were changed since they were last written go to a
+// spill file, which is unlinked right after it is created so that it
+// disappears with the process. Pages loaded from a data file that stores
+// rows plainly are read back from that file instead.
+type bufferPool struct {
+	mu    sync.Mutex
+	lru   list.List // of *page, most recently used first
+	used  int64
+	stats PoolStats
+
+	spill    *os.File
+	spillEnd int64
+	extents  map[*extent]struct{}
+	live     int64
+}
+
+var pool = &bufferPool{}
+
+// BufferPoolStats returns a snapshot of the buffer pool statistics.
+func BufferPoolStats() PoolStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	s := pool.stats
+	s.Pages = pool.lru.Len()
+	s.Resident = pool.used
+	s.Spilled = pool.live
+	return s
+}
+
+// extent is a page image in the spill file or, if src is set, in a data
+// file. Extents are never overwritten, so the pages of a transaction
+// snapshot can share them with the live table; refs counts the pages using
+// the extent.
+type extent struct {
+	src    *pageFile
+	off, n int64
+	aead   cipher.AEAD
+	refs   int
+}
+
+// pageFile is an open data file holding page images. refs counts the
+// extents in the file and the reader still loading it, and f is closed when
+// it drops to zero. A save moves the pages of the live tables to the new
+// data file (see replaceFile), so the file is not kept open across it.
+type pageFile struct {
+	f    *os.File
+	path string
+	refs int
+}
+
+// countingReader tracks the offset in src of the data read through it.
+type countingReader struct {
+	r   byteReader
+	off int64
+	src *pageFile
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.off += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.off++
+	}
+	return b, err
+}
+
+// countingWriter tracks the offset of the data written through it and
+// records where the pages of the table being written end up.
+type countingWriter struct {
+	w     io.Writer
+	off   int64
+	spans []pageSpan
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.off += int64(n)
+	return n, err
+}
+
+// pageSpan is the image of page p at [off, off+n) of a new data file, or
+// off -1 if the file does not store it plainly. ext is the extent p had
+// when it was written.
+type pageSpan struct {
+	p      *page
+	ext    *extent
+	off, n int64
+}
+
+// page holds up to pageRows consecutive rows of a table.
+type page struct {
+	cols  []Column
+	rows  []Row // nil while not resident
+	count int
+	size  int64 // memory estimate of rows
+	dirty bool  // rows differ from ext
+	ext   *extent
+	elem  *list.Element
+}
+
+// pagedStore holds the rows of a table in buffer pool pages.
+type pagedStore struct {
+	columns []Column
+	pages   []*page
+	n       int
+}
+
+func newPagedStore(columns []Column) *pagedStore {
+	return &pagedStore{columns: columns}
+}
+
+func (s *pagedStore) row(i int) (Row, error) {
+	rows, err := pool.rows(s.pages[i/pageRows])
+	if err != nil {
+		return nil, err
+	}
+	return rows[i%pageRows], nil
+}
+
+func (s *pagedStore) each(fn func(int, Row) bool) error {
+	for pi, p := range s.pages {
+		rows, err := pool.rows(p)
+		if err != nil {
+			return err
+		}
+		for j, row := range rows {
+			if !fn(pi*pageRows+j, row) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (s *pagedStore) append(row Row) error {
+	// A page left empty by a failed append is reused.
+	if s.n == len(s.pages)*pageRows {
+		p := &page{cols: s.columns, dirty: true}
+		s.pages = append(s.pages, p)
+		pool.add(p)
+	}
+	p := s.pages[len(s.pages)-1]
+	if err := pool.update(p, func(rows []Row) []Row { return append(rows, row) }, rowMemSize(row)); err != nil {
+		return err
+	}
+	s.n++
+	return nil
+}
+
+func (s *pagedStore) set(i int, row Row) error {
+	p := s.pages[i/pageRows]
+	rows, err := pool.rows(p)
+	if err != nil {
+		return err
+	}
+	old := rowMemSize(rows[i%pageRows])
+	return pool.update(p, func(rows []Row) []Row {
+		rows[i%pageRows] = row
+		return rows
+	}, rowMemSize(row)-old)
+}
+
+// attach records that the last page, which is complete, is stored as is at
+// [off, off+n) of src, so that evicting it needs no write.
+func (s *pagedStore) attach(src *pageFile, off, n int64) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	p := s.pages[len(s.pages)-1]
+	src.refs++
+	pool.unref(p.ext)
+	p.ext, p.dirty = &extent{src: src, off: off, n: n, refs: 1}, false
+}
+
+// extent returns the extent p is stored in.
+func (bp *bufferPool) extent(p *page) *extent {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return p.ext
+}
+
+// clone returns a copy of the store for a transaction snapshot. Resident
+// pages are copied; the others share their spill file extent.
+func (s *pagedStore) clone() *pagedStore {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	c := &pagedStore{columns: s.columns, pages: make([]*page, len(s.pages)), n: s.n}
+	for i, p := range s.pages {
+		cp := &page{cols: p.cols, count: p.count, dirty: p.dirty, ext: p.ext}
+		if p.ext != nil {
+			p.ext.refs++
+		}
+		if p.rows != nil {
+			cp.rows = append(make([]Row, 0, pageRows), p.rows...)
+			cp.size = p.size
+			cp.elem = pool.lru.PushFront(cp)
+			pool.used += cp.size
+		}
+		c.pages[i] = cp
+	}
+	// The copies are evicted by the next page the pool loads.
+	return c
+}
+
+// release drops the pages of a store that is no longer used.
+func (s *pagedStore) release() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for _, p := range s.pages {
+		if p.elem != nil {
+			pool.lru.Remove(p.elem)
+			pool.used -= p.size
+		}
+		pool.unref(p.ext)
+		*p = page{}
+	}
+	s.pages, s.n = nil, 0
+}
+
+// add registers a new, empty page as resident.
+func (bp *bufferPool) add(p *page) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	p.rows = make([]Row, 0, pageRows)
+	p.elem = bp.lru.PushFront(p)
+}
+
+// rows returns the rows of p, reading them back if needed. The returned
+// slice stays valid after the page is evicted.
+func (bp *bufferPool) rows(p *page) ([]Row, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if err := bp.load(p); err != nil {
+		return nil, err
+	}
+	rows := p.rows
+	return rows, bp.evict(p)
+}
+
+// update changes the rows of p with fn and adjusts its size by delta. Room
+// is made before the change, so on error p is unchanged.
+func (bp *bufferPool) update(p *page, fn func([]Row) []Row, delta int64) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if err := bp.load(p); err != nil {
+		return err
+	}
+	if err := bp.evict(p); err != nil {
+		return err
+	}
+	p.rows = fn(p.rows)
+	p.count = len(p.rows)
+	p.size += delta
+	bp.used += delta
+	p.dirty = true
+	return nil
+}
+
+// load makes p resident and most recently used. The caller must hold bp.mu
+// and then call evict.
+func (bp *bufferPool) load(p *page) error {
+	if p.rows != nil {
+		bp.stats.Hits++
+		bp.lru.MoveToFront(p.elem)
+		return nil
+	}
+	bp.stats.Misses++
+	rows, size, err := bp.readPage(p)
+	if err != nil {
+		return err
+	}
+	p.rows, p.size = rows, size
+	p.elem = bp.lru.PushFront(p)
+	bp.used += size
+	return nil
+}
+
+// evict drops least recently used pages, other than keep, until the
+// resident pages fit the budget. A page that cannot be written to the
+// spill file stays resident. The caller must hold bp.mu.
+func (bp *bufferPool) evict(keep *page) error {
+	for e := bp.lru.Back(); e != nil && bp.used > BufferPoolSize; {
+		prev := e.Prev()
+		p := e.Value.(*page)
+		if p != keep {
+			if p.dirty {
+				if err := bp.writePage(p); err != nil {
+					return fmt.Errorf("buffer pool: %w", err)
+				}
+			}
+			bp.lru.Remove(e)
+			bp.used -= p.size
+			p.rows, p.elem, p.size = nil, nil, 0
+			bp.stats.Evictions++
+		}
+		e = prev
+	}
+	return nil
+}
+
+// writePage stores the rows of p in a new extent at the end of the spill
+// file, encrypted if a key is set. The caller must hold bp.mu.
+func (bp *bufferPool) writePage(p *page) error {
+	if bp.spill == nil {
+		f, err := os.CreateTemp("", "minidb-spill-*")
+		if err != nil {
+			return err
+		}
+		_ = os.Remove(f.Name())
+		bp.spill, bp.extents = f, make(map[*extent]struct{})
+	}
+	var buf []byte
+	for _, row := range p.rows {
+		for i, v := range row {
+			buf = appendValue(buf, v, p.cols[i].Type)
+		}
+	}
+	ext := &extent{aead: currentCipher(), refs: 1}
+	if ext.aead != nil {
+		sealed, err := seal(ext.aead, buf, nil)
+		if err != nil {
+			return err
+		}
+		buf = sealed
+	}
+	ext.off, ext.n = bp.spillEnd, int64(len(buf))
+	if _, err := bp.spill.WriteAt(buf, ext.off); err != nil {
+		return err
+	}
+	bp.spillEnd += ext.n
+	bp.live += ext.n
+	bp.extents[ext] = struct{}{}
+	bp.unref(p.ext)
+	p.ext, p.dirty = ext, false
+	return bp.compact()
+}
+
+// readPage decodes the rows of p from its extent. The caller must hold
+// bp.mu.
+func (bp *bufferPool) readPage(p *page) ([]Row, int64, error) {
+	if p.ext == nil {
+		return nil, 0, fmt.Errorf("page of %d rows was never written", p.count)
+	}
+	f := bp.spill
+	if p.ext.src != nil {
+		f = p.ext.src.f
+	}
+	buf := make([]byte, p.ext.n)
+	if _, err := f.ReadAt(buf, p.ext.off); err != nil {
+		return nil, 0, fmt.Errorf("buffer pool: %w", err)
+	}
+	if p.ext.aead != nil {
+		plain, err := unseal(p.ext.aead, buf, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		buf = plain
+	}
+	r := bytes.NewReader(buf)
+	rows := make([]Row, 0, pageRows)
+	var size int64
+	for i := 0; i < p.count; i++ {
+		row := make(Row, len(p.cols))
+		for j := range row {
+			v, err := readValue(r, p.cols[j].Type)
+			if err != nil {
+				return nil, 0, fmt.Errorf("buffer pool: %w", err)
+			}
+			row[j] = v
+		}
+		rows = append(rows, row)
+		size += rowMemSize(row)
+	}
+	if r.Len() != 0 {
+		return nil, 0, fmt.Errorf("buffer pool: %w", io.ErrUnexpectedEOF)
+	}
+	return rows, size, nil
+}
+
+// unref drops a reference to ext, freeing it when no page uses it. The
+// caller must hold bp.mu.
+func (bp *bufferPool) unref(ext *extent) {
+	if ext == nil {
+		return
+	}
+	ext.refs--
+	switch {
+	case ext.refs > 0:
+	case ext.src != nil:
+		bp.closeFile(ext.src)
+	default:
+		bp.live -= ext.n
+		delete(bp.extents, ext)
+	}
+}
+
+// replaceFile renames the data file written at tmp over path and moves the
+// pages in spans that are still read from a data file to their images in
+// the new one, which is opened by path. Pages changed since leave the old
+// file for memory or, if the new file does not store them plainly, for the
+// spill file. The old file is thus closed before the rename unless a
+// snapshot still uses it, so no page reads a replaced file and Windows
+// allows the rename.
+func (bp *bufferPool) replaceFile(tmp, path string, spans []pageSpan) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	var moved []pageSpan
+	for _, s := range spans {
+		p := s.p
+		if p.ext == nil || p.ext != s.ext || p.ext.src == nil {
+			continue
+		}
+		switch {
+		case p.dirty || p.rows != nil && s.off < 0:
+			bp.unref(p.ext)
+			p.ext, p.dirty = nil, true
+		case s.off < 0:
+			if err := bp.spillPage(p); err != nil {
+				return fmt.Errorf("buffer pool: %w", err)
+			}
+		default:
+			moved = append(moved, s)
+		}
+	}
+	for _, s := range moved {
+		s.p.ext = nil
+		bp.unref(s.ext)
+	}
+
+	err := os.Rename(tmp, path)
+	if err != nil {
+		// The old file is unchanged; the pages go back to it.
+		for _, s := range moved {
+			src := s.ext.src
+			if src.refs == 0 {
+				f, oerr := os.Open(src.path)
+				if oerr != nil {
+					return errors.Join(err, oerr)
+				}
+				src.f = f
+			}
+			src.refs++
+			s.ext.refs++
+			s.p.ext = s.ext
+		}
+		return err
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		// The pages are lost until the file is loaded again.
+		return fmt.Errorf("buffer pool: %w", err)
+	}
+	src := &pageFile{f: f, path: path, refs: len(moved)}
+	for _, s := range moved {
+		s.p.ext = &extent{src: src, off: s.off, n: s.n, refs: 1}
+	}
+	return nil
+}
+
+// spillPage moves a page that is not resident from its extent to the spill
+// file. The caller must hold bp.mu.
+func (bp *bufferPool) spillPage(p *page) error {
+	rows, _, err := bp.readPage(p)
+	if err != nil {
+		return err
+	}
+	p.rows = rows
+	err = bp.writePage(p)
+	p.rows = nil
+	return err
+}
+
+// closeFile drops a reference to src, closing it when nothing uses it. The
+// caller must hold bp.mu.
+func (bp *bufferPool) closeFile(src *pageFile) {
+	src.refs--
+	if src.refs == 0 {
+		_ = src.f.Close()
+	}
+}
+
+// compact copies the extents in use to a new spill file once at least
+// three quarters of the current one are unused. The caller must hold
+// bp.mu.
+func (bp *bufferPool) compact() error {
+	if bp.spillEnd < spillCompactMin || bp.live*4 > bp.spillEnd {
+		return nil
+	}
+	f, err := os.CreateTemp("", "minidb-spill-*")
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(f.Name())
+	var end int64
+	for ext := range bp.extents {
+		buf := make([]byte, ext.n)
+		if _, err := bp.spill.ReadAt(buf, ext.off); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if _, err := f.WriteAt(buf, end); err != nil {
+			_ = f.Close()
+			return err
+		}
+		ext.off = end
+		end += ext.n
+	}
+	_ = bp.spill.Close()
+	bp.spill, bp.spillEnd = f, end
+	return nil
+}
+
+// rowMemSize estimates the memory held by a row.
+func rowMemSize(row Row) int64 {
+	size := int64(24 + 16*len(row))
+	for _, v := range row {
+		switch v := v.(type) {
+		case string:
+			size += int64(len(v))
+		case Blob:
+			size += int64(len(v))
+		}
+	}
+	return size
+}
@@ -2,69 +2,156 @@ package engine
 
 import (
 	"container/list"
+	"sync"
 )
 
-// Cache implements a simple LRU cache storing SELECT results.
+// Cache implements a simple LRU cache storing SELECT results. Every entry
+// remembers the tables it was computed from so that writes can invalidate
+// exactly the affected results. It is safe for concurrent use.
 type Cache struct {
-	limit int
-	size  int
-	ll    *list.List
-	items map[string]*list.Element
+	mu      sync.Mutex
+	limit   int
+	size    int
+	ll      *list.List
+	items   map[string]*list.Element
+	byTable map[string]map[string]struct{}
+	stats   CacheStats
+}
+
+// CacheStats reports how the cache has been used since it was created.
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	Invalidations uint64
+	Entries       int
+	Size          int
 }
 
 type entry struct {
-	key   string
-	value string
-	size  int
+	key    string
+	value  *ResultSet
+	size   int
+	tables []string
 }
 
 // NewCache creates a cache with the given size limit in bytes.
 func NewCache(limit int) *Cache {
-	return &Cache{limit: limit, ll: list.New(), items: make(map[string]*list.Element)}
+	return &Cache{
+		limit:   limit,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+		byTable: make(map[string]map[string]struct{}),
+	}
 }
 
-// Get returns a cached value and true if present.
-func (c *Cache) Get(k string) (string, bool) {
+// Get returns a cached result and true if present. The result must not be
+// modified.
+func (c *Cache) Get(k string) (*ResultSet, bool) {
 	if c == nil {
-		return "", false
+		return nil, false
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if e, ok := c.items[k]; ok {
 		c.ll.MoveToFront(e)
+		c.stats.Hits++
 		return e.Value.(*entry).value, true
 	}
-	return "", false
+	c.stats.Misses++
+	return nil, false
 }
 
-// Add inserts a key/value pair into the cache.
-func (c *Cache) Add(k, v string) {
+// Add inserts a result into the cache. tables lists the tables the result
+// was computed from. The size of an entry is the length of its text form.
+func (c *Cache) Add(k string, v *ResultSet, tables ...string) {
 	if c == nil || c.limit <= 0 {
 		return
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if e, ok := c.items[k]; ok {
-		c.ll.MoveToFront(e)
-		ent := e.Value.(*entry)
-		c.size -= ent.size
-		ent.value = v
-		ent.size = len(v)
-		c.size += ent.size
-	} else {
-		ent := &entry{key: k, value: v, size: len(v)}
-		c.items[k] = c.ll.PushFront(ent)
-		c.size += ent.size
+		c.remove(e)
+	}
+	ent := &entry{key: k, value: v, size: len(v.String()), tables: tables}
+	c.items[k] = c.ll.PushFront(ent)
+	c.size += ent.size
+	for _, t := range tables {
+		keys, ok := c.byTable[t]
+		if !ok {
+			keys = make(map[string]struct{})
+			c.byTable[t] = keys
+		}
+		keys[k] = struct{}{}
 	}
 	for c.size > c.limit {
 		c.removeOldest()
 	}
 }
 
+// InvalidateTable drops every entry computed from the given table.
+func (c *Cache) InvalidateTable(table string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.byTable[table] {
+		if e, ok := c.items[k]; ok {
+			c.remove(e)
+			c.stats.Invalidations++
+		}
+	}
+}
+
+// Purge drops every entry.
+func (c *Cache) Purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Invalidations += uint64(len(c.items))
+	c.size = 0
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.byTable = make(map[string]map[string]struct{})
+}
+
+// Stats returns a snapshot of the cache statistics.
+func (c *Cache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = len(c.items)
+	s.Size = c.size
+	return s
+}
+
 func (c *Cache) removeOldest() {
 	e := c.ll.Back()
 	if e == nil {
 		return
 	}
+	c.remove(e)
+	c.stats.Evictions++
+}
+
+func (c *Cache) remove(e *list.Element) {
 	c.ll.Remove(e)
 	ent := e.Value.(*entry)
 	delete(c.items, ent.key)
+	for _, t := range ent.tables {
+		if keys, ok := c.byTable[t]; ok {
+			delete(keys, ent.key)
+			if len(keys) == 0 {
+				delete(c.byTable, t)
+			}
+		}
+	}
 	c.size -= ent.size
 }
 
@@ -74,3 +161,8 @@ var resultCache *Cache
 func InitCache(limit int) {
 	resultCache = NewCache(limit)
 }
+
+// ResultCacheStats returns the statistics of the global query result cache.
+func ResultCacheStats() CacheStats {
+	return resultCache.Stats()
+}
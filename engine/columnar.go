@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"bytes"
+	"cmp"
+)
+
+// columnVector holds the values of one column of a columnar table.
+type columnVector interface {
+	get(i int) interface{}
+	set(i int, v interface{})
+	append(v interface{})
+	// extreme returns the smallest (or with max the largest) non-NULL value
+	// or nil if there is none.
+	extreme(max bool) interface{}
+	// remove deletes the values at the positions in gone, which must be
+	// sorted, moving the values that follow up.
+	remove(gone []int)
+	clone() columnVector
+}
+
+// vector is a column of values of type T. Values of any other type, such
+// as NULL or legacy text that never parsed into the column type, are kept
+// aside in other so that vals stays densely typed.
+type vector[T any] struct {
+	vals  []T
+	other map[int]interface{}
+	less  func(a, b T) bool
+}
+
+func (v *vector[T]) get(i int) interface{} {
+	if x, ok := v.other[i]; ok {
+		return x
+	}
+	return v.vals[i]
+}
+
+func (v *vector[T]) set(i int, x interface{}) {
+	if typed, ok := x.(T); ok {
+		v.vals[i] = typed
+		delete(v.other, i)
+		return
+	}
+	var zero T
+	v.vals[i] = zero
+	if v.other == nil {
+		v.other = make(map[int]interface{})
+	}
+	v.other[i] = x
+}
+
+func (v *vector[T]) append(x interface{}) {
+	var zero T
+	v.vals = append(v.vals, zero)
+	v.set(len(v.vals)-1, x)
+}
+
+func (v *vector[T]) extreme(max bool) interface{} {
+	var (
+		best  T
+		found bool
+	)
+	for i, x := range v.vals {
+		if len(v.other) > 0 {
+			if _, skip := v.other[i]; skip {
+				continue
+			}
+		}
+		if !found || (max && v.less(best, x)) || (!max && v.less(x, best)) {
+			best, found = x, true
+		}
+	}
+	var res interface{}
+	if found {
+		res = best
+	}
+	for _, x := range v.other {
+		if x == nil {
+			continue
+		}
+		if c := compareValues(x, res); res == nil || (max && c > 0) || (!max && c < 0) {
+			res = x
+		}
+	}
+	return res
+}
+
+func (v *vector[T]) remove(gone []int) {
+	var other map[int]interface{}
+	n := 0
+	for i, x := range v.vals {
+		if len(gone) > 0 && gone[0] == i {
+			gone = gone[1:]
+			continue
+		}
+		v.vals[n] = x
+		if o, ok := v.other[i]; ok {
+			if other == nil {
+				other = make(map[int]interface{})
+			}
+			other[n] = o
+		}
+		n++
+	}
+	clear(v.vals[n:])
+	v.vals, v.other = v.vals[:n], other
+}
+
+func (v *vector[T]) clone() columnVector {
+	c := &vector[T]{vals: append([]T(nil), v.vals...), less: v.less}
+	if len(v.other) > 0 {
+		c.other = make(map[int]interface{}, len(v.other))
+		for i, x := range v.other {
+			c.other[i] = x
+		}
+	}
+	return c
+}
+
+// newVector returns an empty vector holding the Go type of column type ct.
+func newVector(ct ColumnType) columnVector {
+	switch ct.Base() {
+	case TypeInt:
+		return &vector[int]{less: cmp.Less[int]}
+	case TypeBigInt:
+		return &vector[int64]{less: cmp.Less[int64]}
+	case TypeFloat:
+		return &vector[float64]{less: func(a, b float64) bool { return compareFloats(a, b) < 0 }}
+	case TypeBool:
+		return &vector[bool]{less: func(a, b bool) bool { return !a && b }}
+	case TypeTimestamp:
+		return &vector[Timestamp]{less: cmp.Less[Timestamp]}
+	case TypeDate:
+		return &vector[Date]{less: cmp.Less[Date]}
+	case TypeBlob:
+		return &vector[Blob]{less: func(a, b Blob) bool { return bytes.Compare(a, b) < 0 }}
+	case TypeDecimal:
+		return &vector[Decimal]{less: func(a, b Decimal) bool { return compareValues(a, b) < 0 }}
+	default:
+		return &vector[string]{less: cmp.Less[string]}
+	}
+}
+
+// columnStore holds the rows of a columnar table.
+type columnStore struct {
+	n    int
+	cols []columnVector
+}
+
+func newColumnStore(columns []Column) *columnStore {
+	s := &columnStore{cols: make([]columnVector, len(columns))}
+	for i, c := range columns {
+		s.cols[i] = newVector(c.Type)
+	}
+	return s
+}
+
+// row assembles row i. When cols is not nil only those columns are filled
+// and the others are left nil.
+func (s *columnStore) row(i int, cols []int) Row {
+	row := make(Row, len(s.cols))
+	if cols == nil {
+		for c, vec := range s.cols {
+			row[c] = vec.get(i)
+		}
+		return row
+	}
+	for _, c := range cols {
+		row[c] = s.cols[c].get(i)
+	}
+	return row
+}
+
+func (s *columnStore) append(row Row) {
+	for c, vec := range s.cols {
+		vec.append(row[c])
+	}
+	s.n++
+}
+
+func (s *columnStore) set(i int, row Row) {
+	for c, vec := range s.cols {
+		vec.set(i, row[c])
+	}
+}
+
+// remove deletes the rows at the positions in gone, which must be sorted.
+func (s *columnStore) remove(gone []int) {
+	for _, vec := range s.cols {
+		vec.remove(gone)
+	}
+	s.n -= len(gone)
+}
+
+func (s *columnStore) clone() *columnStore {
+	c := &columnStore{n: s.n, cols: make([]columnVector, len(s.cols))}
+	for i, vec := range s.cols {
+		c.cols[i] = vec.clone()
+	}
+	return c
+}
@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CompressionKind selects how table blocks are compressed in the data file.
+type CompressionKind string
+
+const (
+	CompressionNone  CompressionKind = "none"
+	CompressionFlate CompressionKind = "flate"
+)
+
+// Compression is the compression used when the data file is written.
+// LoadBinaryDB sets it from the file header, so a database keeps its
+// compression until it is changed explicitly.
+var Compression = CompressionNone
+
+// Header flags stored after the format version since v10.
+const (
+	flagCompressed uint8 = 1 << iota
+	flagEncrypted
+)
+
+// ParseCompression validates a compression name such as "flate".
+func ParseCompression(s string) (CompressionKind, error) {
+	switch kind := CompressionKind(strings.ToLower(s)); kind {
+	case CompressionNone, CompressionFlate:
+		return kind, nil
+	default:
+		return "", fmt.Errorf("unknown compression %s", s)
+	}
+}
+
+func headerFlags() uint8 {
+	var flags uint8
+	if Compression == CompressionFlate {
+		flags |= flagCompressed
+	}
+	if currentCipher() != nil {
+		flags |= flagEncrypted
+	}
+	return flags
+}
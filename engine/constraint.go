@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultValue evaluates the DEFAULT clause of the column. A column without
+// one defaults to NULL. CURRENT_TIMESTAMP and CURRENT_DATE take the current
+// time in UTC.
+func (c Column) defaultValue() (interface{}, error) {
+	switch lit := strings.ToUpper(c.Default); {
+	case lit == "" || lit == "NULL":
+		return nil, nil
+	case lit == "CURRENT_TIMESTAMP" && c.Type == TypeTimestamp:
+		return Timestamp(time.Now().UnixMicro()), nil
+	case lit == "CURRENT_DATE" && c.Type == TypeDate:
+		return Date(time.Now().Unix() / secondsPerDay), nil
+	case lit == "CURRENT_TIMESTAMP" || lit == "CURRENT_DATE":
+		return nil, fmt.Errorf("%s is not a valid DEFAULT for %s column %s", lit, c.Type, c.Name)
+	}
+	v, err := parseValue(unquote(c.Default), c.Type)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEFAULT %s for %s column %s", c.Default, c.Type, c.Name)
+	}
+	return v, nil
+}
+
+// volatileDefault reports whether the default of the column changes from
+// one statement to the next.
+func (c Column) volatileDefault() bool {
+	switch strings.ToUpper(c.Default) {
+	case "CURRENT_TIMESTAMP", "CURRENT_DATE":
+		return true
+	}
+	return false
+}
+
+// defaultRow returns a row holding the default value of every column. It
+// is evaluated once per statement, so every row inserted by a statement
+// gets the same CURRENT_TIMESTAMP.
+func (t *Table) defaultRow() Row {
+	row := make(Row, len(t.Columns))
+	for i, c := range t.Columns {
+		// Defaults are validated by CREATE TABLE.
+		row[i], _ = c.defaultValue()
+	}
+	return row
+}
+
+// hasVolatileDefault reports whether replaying an INSERT on the table may
+// produce different values than the original statement. Such inserts log
+// their rows instead of the statement.
+func (t *Table) hasVolatileDefault() bool {
+	for _, c := range t.Columns {
+		if c.volatileDefault() {
+			return true
+		}
+	}
+	return false
+}
+
+// insertEntries returns WAL entries inserting exactly rows.
+func (t *Table) insertEntries(rows []Row) []string {
+	entries := make([]string, len(rows))
+	for k, row := range rows {
+		entries[k] = strings.TrimSuffix(buildInsertSQL(t, row), ";\n")
+	}
+	return entries
+}
+
+// checkConstraint is the compiled CHECK clause of a column.
+type checkConstraint struct {
+	column string
+	expr   string
+	conds  []condition
+}
+
+// compileChecks parses the CHECK clauses of the table into t.checks.
+func (t *Table) compileChecks() error {
+	var checks []checkConstraint
+	for _, c := range t.Columns {
+		if c.Check == "" {
+			continue
+		}
+		conds, err := parseWhere(c.Check)
+		if err != nil {
+			return fmt.Errorf("invalid CHECK for column %s: %w", c.Name, err)
+		}
+		for i := range conds {
+			if err := conds[i].bind(t); err != nil {
+				return fmt.Errorf("invalid CHECK for column %s: %w", c.Name, err)
+			}
+		}
+		checks = append(checks, checkConstraint{column: c.Name, expr: c.Check, conds: conds})
+	}
+	t.checks = checks
+	return nil
+}
+
+// checkRows validates rows against the CHECK clauses of the table and
+// returns the position of the first row that fails. As in SQL, a
+// comparison with NULL does not fail the check.
+func (t *Table) checkRows(rows []Row) (int, error) {
+	for k, row := range rows {
+		for _, check := range t.checks {
+			for i := range check.conds {
+				cond := &check.conds[i]
+				if row[cond.col] != nil && !cond.matches(row) {
+					return k, fmt.Errorf("%w: CHECK (%s) failed for column %s", ErrConstraint, check.expr, check.column)
+				}
+			}
+		}
+	}
+	return -1, nil
+}
@@ -0,0 +1,458 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// copyFormat is a file format of COPY.
+type copyFormat string
+
+const (
+	copyCSV   copyFormat = "csv"
+	copyJSON  copyFormat = "json"  // an array of objects
+	copyJSONL copyFormat = "jsonl" // one object per line
+)
+
+// copyOptions are the options of a COPY statement.
+type copyOptions struct {
+	format copyFormat
+	header bool // CSV only: the first record names the columns
+	// null is the CSV field that stands for NULL, set by the NULL option.
+	// Without it NULL is an empty field, which in a TEXT column is read
+	// back as an empty string.
+	null    string
+	nullSet bool
+}
+
+// handleCopy runs COPY <table> TO|FROM '<file>' [WITH (FORMAT csv|json|jsonl,
+// HEADER, NULL '<marker>')]. Values are written as the query output shows
+// them and read back with parseValue for the type of their column. NULL is
+// the NULL marker in CSV and null in JSON. A JSON object without a column
+// gives it its default.
+func handleCopy(query string) (string, error) {
+	fields := strings.Fields(query)
+	if len(fields) < 4 {
+		return "", errors.New("invalid COPY syntax")
+	}
+	tableName, dir := fields[1], strings.ToUpper(fields[2])
+	if dir != "TO" && dir != "FROM" {
+		return "", errors.New("invalid COPY syntax")
+	}
+	rest := strings.TrimSpace(query)
+	for _, f := range fields[:3] {
+		rest = strings.TrimSpace(rest[strings.Index(rest, f)+len(f):])
+	}
+	path, rest, err := splitQuoted(rest)
+	if err != nil {
+		return "", errors.New("invalid COPY syntax: file name must be quoted")
+	}
+	opts, err := parseCopyOptions(rest)
+	if err != nil {
+		return "", err
+	}
+
+	var table *Table
+	var exists bool
+	if txCtx != nil {
+		table, exists = Tables[tableName]
+	} else {
+		dbMu.RLock()
+		table, exists = Tables[tableName]
+		dbMu.RUnlock()
+	}
+	if !exists {
+		return "", errors.New("table does not exist")
+	}
+
+	if dir == "TO" {
+		n, err := copyTo(table, path, opts)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d rows exported to %s.", n, path), nil
+	}
+	n, err := copyFrom(table, path, opts)
+	if err != nil {
+		return "", err
+	}
+	if err := SaveBinaryDB(); err != nil {
+		return "", err
+	}
+	if err := clearWAL(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d rows imported.", n), nil
+}
+
+// splitQuoted splits a leading quoted string off s and returns it unquoted
+// along with the rest of s.
+func splitQuoted(s string) (string, string, error) {
+	if !strings.HasPrefix(s, "'") {
+		return "", "", errors.New("expected a quoted string")
+	}
+	for i := 1; i < len(s); i++ {
+		if s[i] != '\'' {
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '\'' {
+			i++
+			continue
+		}
+		return unquote(s[:i+1]), strings.TrimSpace(s[i+1:]), nil
+	}
+	return "", "", errors.New("unterminated quoted string")
+}
+
+func parseCopyOptions(s string) (copyOptions, error) {
+	opts := copyOptions{format: copyCSV}
+	if s == "" {
+		return opts, nil
+	}
+	if !strings.HasPrefix(strings.ToUpper(s), "WITH") {
+		return opts, fmt.Errorf("unexpected %q in COPY", s)
+	}
+	s = strings.TrimSpace(s[4:])
+	if !strings.HasPrefix(s, "(") || matchingParen(s, 0) != len(s)-1 {
+		return opts, errors.New("invalid COPY options")
+	}
+	for _, opt := range splitTopLevel(s[1:len(s)-1], ',') {
+		name, value := cutField(opt)
+		switch strings.ToUpper(name) {
+		case "FORMAT":
+			switch f := copyFormat(strings.ToLower(unquote(value))); f {
+			case copyCSV, copyJSON, copyJSONL:
+				opts.format = f
+			default:
+				return opts, fmt.Errorf("unknown COPY format %q", value)
+			}
+		case "HEADER":
+			switch strings.ToLower(unquote(value)) {
+			case "", "true":
+				opts.header = true
+			case "false":
+				opts.header = false
+			default:
+				return opts, fmt.Errorf("invalid HEADER value %q", value)
+			}
+		case "NULL":
+			marker, rest, err := splitQuoted(value)
+			if err != nil || rest != "" {
+				return opts, errors.New("NULL requires a quoted marker")
+			}
+			opts.null, opts.nullSet = marker, true
+		case "":
+			return opts, fmt.Errorf("invalid COPY option %q", strings.TrimSpace(opt))
+		default:
+			return opts, fmt.Errorf("unknown COPY option %s", name)
+		}
+	}
+	if opts.header && opts.format != copyCSV {
+		return opts, errors.New("HEADER is only supported for CSV")
+	}
+	if opts.nullSet && opts.format != copyCSV {
+		return opts, errors.New("NULL is only supported for CSV")
+	}
+	return opts, nil
+}
+
+// copyTo writes the rows of t to path.
+func copyTo(t *Table, path string, opts copyOptions) (n int, err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	w := bufio.NewWriter(f)
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	switch opts.format {
+	case copyCSV:
+		cw := csv.NewWriter(w)
+		record := make([]string, len(t.Columns))
+		if opts.header {
+			for i, c := range t.Columns {
+				record[i] = c.Name
+			}
+			err = cw.Write(record)
+		}
+		serr := t.eachRow(func(_ int, row Row) bool {
+			if err != nil {
+				return false
+			}
+			n++
+			for i, v := range row {
+				record[i] = opts.null
+				if v == nil {
+					continue
+				}
+				if record[i] = formatValue(v); opts.nullSet && record[i] == opts.null {
+					err = fmt.Errorf("row %d: value of column %s equals the NULL marker", n, t.Columns[i].Name)
+					return false
+				}
+			}
+			err = cw.Write(record)
+			return true
+		})
+		if err == nil {
+			err = serr
+		}
+		if err == nil {
+			cw.Flush()
+			err = cw.Error()
+		}
+	default:
+		if opts.format == copyJSON {
+			_, err = w.WriteString("[")
+		}
+		serr := t.eachRow(func(_ int, row Row) bool {
+			if err != nil {
+				return false
+			}
+			sep := "\n"
+			if opts.format == copyJSON && n > 0 {
+				sep = ",\n"
+			}
+			if _, err = w.WriteString(sep); err == nil {
+				_, err = w.Write(jsonRow(t.Columns, row))
+			}
+			n++
+			return true
+		})
+		if err == nil {
+			err = serr
+		}
+		if err == nil {
+			if opts.format == copyJSON {
+				_, err = w.WriteString("\n]\n")
+			} else if n > 0 {
+				_, err = w.WriteString("\n")
+			}
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, w.Flush()
+}
+
+// jsonRow encodes a row as an object with the keys in column order.
+// Numbers and booleans become JSON numbers and booleans, other values
+// strings.
+func jsonRow(cols []Column, row Row) []byte {
+	b := []byte{'{'}
+	for i, v := range row {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		name, _ := json.Marshal(cols[i].Name)
+		b = append(append(b, name...), ':')
+		switch v.(type) {
+		case nil, int, int64, float64, bool:
+			enc, err := json.Marshal(v)
+			if err == nil {
+				b = append(b, enc...)
+				continue
+			}
+		}
+		enc, _ := json.Marshal(formatValue(v))
+		b = append(b, enc...)
+	}
+	return append(b, '}')
+}
+
+// copyFrom reads the rows in path and inserts them into t all at once. The
+// error of a malformed or rejected row names its position in the file,
+// counting from 1 and not counting a CSV header.
+func copyFrom(t *Table, path string, opts copyOptions) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var records []Row
+	if opts.format == copyCSV {
+		records, err = readCSVRecords(f, t, opts)
+	} else {
+		records, err = readJSONRecords(f, t, opts.format)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if len(records) == 0 {
+		return 0, nil
+	}
+	defaults := t.defaultRow()
+	rows := make([]Row, len(records))
+	for k, record := range records {
+		row := append(Row(nil), defaults...)
+		for i, c := range t.Columns {
+			field, ok := record[i].(string)
+			if !ok {
+				if record[i] != useDefault {
+					row[i] = nil
+				}
+				continue
+			}
+			v, err := parseValue(field, c.Type)
+			if err != nil {
+				return 0, fmt.Errorf("row %d: invalid %s value for column %s", k+1, c.Type, c.Name)
+			}
+			row[i] = v
+		}
+		if err := t.checkNotNull(row); err != nil {
+			return 0, fmt.Errorf("row %d: %w", k+1, err)
+		}
+		rows[k] = row
+	}
+	if k, err := t.insertRows(rows, t.insertEntries(rows)...); err != nil {
+		if k >= 0 {
+			return 0, fmt.Errorf("row %d: %w", k+1, err)
+		}
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+// useDefault is the field of an imported record that leaves a column out.
+// The column gets its default.
+var useDefault = new(struct{})
+
+// readCSVRecords returns the records of a CSV file with their fields in
+// column order: a string, or nil for the NULL marker. Without the NULL
+// option an empty field in a TEXT column is an empty string. With a header
+// the fields may come in any order.
+func readCSVRecords(r io.Reader, t *Table, opts copyOptions) ([]Row, error) {
+	cols := t.Columns
+	cr := csv.NewReader(bufio.NewReader(r))
+	cr.FieldsPerRecord = -1
+	order := make([]int, len(cols))
+	for i := range order {
+		order[i] = i
+	}
+	if opts.header {
+		names, err := cr.Read()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("header: %w", err)
+		}
+		if order, err = headerOrder(t, names); err != nil {
+			return nil, err
+		}
+	}
+	var records []Row
+	for k := 1; ; k++ {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", k, err)
+		}
+		if len(fields) != len(cols) {
+			return nil, fmt.Errorf("row %d: expected %d fields, got %d", k, len(cols), len(fields))
+		}
+		record := make(Row, len(cols))
+		for i, j := range order {
+			if fields[i] != opts.null || !opts.nullSet && cols[j].Type.Base() == TypeText {
+				record[j] = fields[i]
+			}
+		}
+		records = append(records, record)
+	}
+}
+
+// headerOrder maps the fields named by a CSV header to columns.
+func headerOrder(t *Table, names []string) ([]int, error) {
+	cols := t.Columns
+	if len(names) != len(cols) {
+		return nil, fmt.Errorf("header: expected %d columns, got %d", len(cols), len(names))
+	}
+	order := make([]int, len(names))
+	seen := make(map[int]bool, len(names))
+	for i, name := range names {
+		j := t.columnIndex(strings.TrimSpace(name))
+		if j == -1 || seen[j] {
+			return nil, fmt.Errorf("header: unexpected column %q", name)
+		}
+		seen[j] = true
+		order[i] = j
+	}
+	return order, nil
+}
+
+// readJSONRecords returns the objects of a JSON array or a JSON lines file
+// as records in column order: a string, nil for null, or useDefault for a
+// column the object leaves out.
+func readJSONRecords(r io.Reader, t *Table, format copyFormat) ([]Row, error) {
+	cols := t.Columns
+	dec := json.NewDecoder(bufio.NewReader(r))
+	dec.UseNumber()
+	if format == copyJSON {
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			return nil, errors.New("expected a JSON array of objects")
+		}
+	}
+	var records []Row
+	for k := 1; ; k++ {
+		if format == copyJSON && !dec.More() {
+			if _, err := dec.Token(); err != nil {
+				return nil, fmt.Errorf("row %d: %w", k, err)
+			}
+			return records, nil
+		}
+		var obj map[string]interface{}
+		if err := dec.Decode(&obj); err == io.EOF && format == copyJSONL {
+			return records, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("row %d: %w", k, err)
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if t.columnIndex(name) == -1 {
+				return nil, fmt.Errorf("row %d: unknown column %s", k, name)
+			}
+		}
+		record := make(Row, len(cols))
+		for i, c := range cols {
+			v, ok := obj[c.Name]
+			if !ok {
+				record[i] = useDefault
+				continue
+			}
+			switch v := v.(type) {
+			case nil:
+			case string:
+				record[i] = v
+			case json.Number:
+				record[i] = v.String()
+			case bool:
+				record[i] = strconv.FormatBool(v)
+			default:
+				return nil, fmt.Errorf("row %d: unsupported value for column %s", k, c.Name)
+			}
+		}
+		records = append(records, record)
+	}
+}
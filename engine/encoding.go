@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Value tags of the typed row encoding (format v8). Every value starts with
+// a tag byte so that NULLs and legacy values that do not match the column
+// type survive a round trip.
+const (
+	tagNull  = 0
+	tagValue = 1
+	tagText  = 2
+)
+
+// byteReader is what the typed row decoder needs from its input.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// appendValue encodes v as a value of column type ct: INT, BIGINT,
+// TIMESTAMP, DATE and the unscaled DECIMAL as zig-zag varints, FLOAT as its
+// IEEE-754 bits, BOOL as one byte and TEXT and BLOB as a uvarint length
+// followed by the bytes. Values of any other Go type are stored as text.
+func appendValue(buf []byte, v interface{}, ct ColumnType) []byte {
+	if v == nil {
+		return append(buf, tagNull)
+	}
+	switch ct.Base() {
+	case TypeInt:
+		if n, ok := v.(int); ok {
+			return binary.AppendVarint(append(buf, tagValue), int64(n))
+		}
+	case TypeBigInt:
+		if n, ok := v.(int64); ok {
+			return binary.AppendVarint(append(buf, tagValue), n)
+		}
+	case TypeTimestamp:
+		if n, ok := v.(Timestamp); ok {
+			return binary.AppendVarint(append(buf, tagValue), int64(n))
+		}
+	case TypeDate:
+		if n, ok := v.(Date); ok {
+			return binary.AppendVarint(append(buf, tagValue), int64(n))
+		}
+	case TypeDecimal:
+		_, scale := ct.decimalSpec()
+		if d, ok := v.(Decimal); ok && d.Scale == scale {
+			return binary.AppendVarint(append(buf, tagValue), d.Unscaled)
+		}
+	case TypeFloat:
+		if f, ok := v.(float64); ok {
+			return binary.LittleEndian.AppendUint64(append(buf, tagValue), math.Float64bits(f))
+		}
+	case TypeBool:
+		if b, ok := v.(bool); ok {
+			var x byte
+			if b {
+				x = 1
+			}
+			return append(buf, tagValue, x)
+		}
+	case TypeBlob:
+		if b, ok := v.(Blob); ok {
+			return appendBytes(append(buf, tagValue), b)
+		}
+	case TypeText:
+		if s, ok := v.(string); ok {
+			return appendBytes(append(buf, tagValue), []byte(s))
+		}
+	}
+	return appendBytes(append(buf, tagText), []byte(fmt.Sprint(v)))
+}
+
+func appendBytes(buf, b []byte) []byte {
+	return append(binary.AppendUvarint(buf, uint64(len(b))), b...)
+}
+
+// readValue decodes a value written by appendValue for column type ct.
+func readValue(r byteReader, ct ColumnType) (interface{}, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case tagNull:
+		return nil, nil
+	case tagText:
+		b, err := readBytes(r)
+		return string(b), err
+	case tagValue:
+	default:
+		return nil, fmt.Errorf("invalid value tag %d", tag)
+	}
+
+	switch ct.Base() {
+	case TypeInt, TypeBigInt, TypeTimestamp, TypeDate, TypeDecimal:
+		n, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		switch ct.Base() {
+		case TypeInt:
+			return int(n), nil
+		case TypeBigInt:
+			return n, nil
+		case TypeTimestamp:
+			return Timestamp(n), nil
+		case TypeDate:
+			return Date(n), nil
+		default:
+			_, scale := ct.decimalSpec()
+			return Decimal{Unscaled: n, Scale: scale}, nil
+		}
+	case TypeFloat:
+		var bits [8]byte
+		if _, err := io.ReadFull(r, bits[:]); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(bits[:])), nil
+	case TypeBool:
+		b, err := r.ReadByte()
+		return b != 0, err
+	case TypeBlob:
+		b, err := readBytes(r)
+		return Blob(b), err
+	default:
+		b, err := readBytes(r)
+		return string(b), err
+	}
+}
+
+// maxValueLen bounds the length prefix of a single value so that a corrupt
+// file cannot make the decoder allocate unbounded memory.
+const maxValueLen = 1 << 30
+
+func readBytes(r byteReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxValueLen {
+		return nil, errors.New("value length exceeds limit")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
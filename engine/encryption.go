@@ -0,0 +1,194 @@
+package engine
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// KeyEnv names the environment variable Init reads the encryption key from
+// when none has been set.
+const KeyEnv = "MINIDB_KEY"
+
+// walEncryptedPrefix marks an encrypted WAL entry. No statement starts with
+// it, so plaintext and encrypted entries can be told apart.
+const walEncryptedPrefix = "!aes-gcm:"
+
+// walQuotedPrefix marks a plaintext WAL entry spanning several lines, stored
+// as a Go string literal.
+const walQuotedPrefix = "!quoted:"
+
+var (
+	// ErrNoKey is returned when an encrypted file is read without a key.
+	ErrNoKey = errors.New("data is encrypted and no key was supplied")
+	// ErrDecrypt is returned when data does not decrypt with the key in use.
+	ErrDecrypt = errors.New("decryption failed: wrong key or corrupt data")
+)
+
+// dataKey holds the AES-GCM cipher for the data file and the WAL, or nil
+// when encryption is off.
+var dataKey atomic.Pointer[cipher.AEAD]
+
+// ParseKey decodes a hex-encoded AES key of 16, 24 or 32 bytes.
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("key must be hex-encoded: %w", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("key must be 16, 24 or 32 bytes, got %d", len(key))
+	}
+}
+
+// SetEncryptionKey sets the AES key used to encrypt the data file and the
+// WAL from now on; a nil key turns encryption off. The files on disk are
+// rewritten by the next save.
+func SetEncryptionKey(key []byte) error {
+	if key == nil {
+		dataKey.Store(nil)
+		return nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	dataKey.Store(&aead)
+	return nil
+}
+
+// loadKeyFromEnv sets the key from KeyEnv unless one is already set.
+func loadKeyFromEnv() error {
+	s := os.Getenv(KeyEnv)
+	if s == "" || dataKey.Load() != nil {
+		return nil
+	}
+	key, err := ParseKey(s)
+	if err != nil {
+		return fmt.Errorf("%s: %w", KeyEnv, err)
+	}
+	return SetEncryptionKey(key)
+}
+
+func currentCipher() cipher.AEAD {
+	if p := dataKey.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// seal encrypts plain with a fresh random nonce and returns the nonce
+// followed by the ciphertext. ad is authenticated but not encrypted.
+func seal(aead cipher.AEAD, plain, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, ad), nil
+}
+
+// unseal reverses seal.
+func unseal(aead cipher.AEAD, data, ad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+// encodeWALEntry returns the line stored in the WAL for entry: the entry
+// itself, quoted if it spans lines, or, with a key set, its encryption in
+// base64 after a marker.
+func encodeWALEntry(entry string) (string, error) {
+	aead := currentCipher()
+	if aead == nil {
+		if strings.ContainsAny(entry, "\r\n") {
+			return walQuotedPrefix + strconv.Quote(entry), nil
+		}
+		return entry, nil
+	}
+	data, err := seal(aead, []byte(entry), nil)
+	if err != nil {
+		return "", err
+	}
+	return walEncryptedPrefix + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// decodeWALEntry reverses encodeWALEntry.
+func decodeWALEntry(line string) (string, error) {
+	if strings.HasPrefix(line, walQuotedPrefix) {
+		entry, err := strconv.Unquote(line[len(walQuotedPrefix):])
+		if err != nil {
+			return "", errors.New("malformed quoted WAL entry")
+		}
+		return entry, nil
+	}
+	if !strings.HasPrefix(line, walEncryptedPrefix) {
+		return line, nil
+	}
+	aead := currentCipher()
+	if aead == nil {
+		return "", ErrNoKey
+	}
+	data, err := base64.StdEncoding.DecodeString(line[len(walEncryptedPrefix):])
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	plain, err := unseal(aead, data, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// handleRotate handles ROTATE KEY '<hex key>': the data file is rewritten
+// encrypted with the new key and the WAL, whose entries are already in the
+// data file, is removed. The statement itself is never logged.
+func handleRotate(query string) (string, error) {
+	fields := strings.Fields(query)
+	if len(fields) != 3 || strings.ToUpper(fields[1]) != "KEY" {
+		return "", errors.New("invalid ROTATE KEY syntax")
+	}
+	if txCtx != nil {
+		return "", errors.New("ROTATE KEY cannot run inside a transaction")
+	}
+	key, err := ParseKey(unquote(fields[2]))
+	if err != nil {
+		return "", err
+	}
+
+	dbMu.Lock()
+	old := dataKey.Load()
+	if err := SetEncryptionKey(key); err != nil {
+		dbMu.Unlock()
+		return "", err
+	}
+	if err := saveBinaryDBNoLock(); err != nil {
+		dataKey.Store(old)
+		dbMu.Unlock()
+		return "", err
+	}
+	dbMu.Unlock()
+
+	if err := clearWAL(); err != nil {
+		return "", err
+	}
+	return "Key rotated.", nil
+}
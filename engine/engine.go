@@ -1,7 +1,51 @@
 package engine
 
+import (
+	"strconv"
+	"strings"
+)
+
 func Execute(query string) (string, error) {
 	res, err := HandleCommand(query)
 
 	return res, err
 }
+
+// Result describes the effect of a statement run by Exec.
+type Result struct {
+	Message      string // the text Execute returns
+	RowsAffected int64
+	// LastInsertID is the AUTOINCREMENT value of the last row inserted by
+	// an INSERT, or 0 if the table has no AUTOINCREMENT column.
+	LastInsertID int64
+}
+
+// Exec runs a statement like Execute and also reports the number of rows
+// it changed and the last AUTOINCREMENT value it inserted.
+func Exec(query string) (Result, error) {
+	query = strings.TrimSpace(query)
+	if strings.HasPrefix(strings.ToUpper(query), "INSERT INTO") {
+		return execInsert(query)
+	}
+	msg, err := HandleCommand(query)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Message: msg, RowsAffected: affectedRows(msg)}, nil
+}
+
+// affectedRows reads the row count from the message of a statement that
+// changes rows, such as "3 rows updated.".
+func affectedRows(msg string) int64 {
+	fields := strings.Fields(msg)
+	if len(fields) != 3 || fields[1] != "row" && fields[1] != "rows" {
+		return 0
+	}
+	switch fields[2] {
+	case "inserted.", "updated.", "deleted.", "imported.":
+	default:
+		return 0
+	}
+	n, _ := strconv.ParseInt(fields[0], 10, 64)
+	return n
+}
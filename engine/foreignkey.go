@@ -0,0 +1,599 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Actions taken on the referencing rows when a referenced row is deleted.
+const (
+	OnDeleteRestrict = "RESTRICT"
+	OnDeleteCascade  = "CASCADE"
+	OnDeleteSetNull  = "SET NULL"
+)
+
+// ForeignKey is the REFERENCES constraint of a column: every non-NULL value
+// of the column must exist in the referenced PRIMARY KEY or UNIQUE column.
+type ForeignKey struct {
+	Table    string
+	Column   string
+	OnDelete string // OnDeleteRestrict, OnDeleteCascade or OnDeleteSetNull
+}
+
+// String renders the constraint as it is written in CREATE TABLE.
+func (fk *ForeignKey) String() string {
+	s := fmt.Sprintf("REFERENCES %s(%s)", fk.Table, fk.Column)
+	if fk.OnDelete != OnDeleteRestrict {
+		s += " ON DELETE " + fk.OnDelete
+	}
+	return s
+}
+
+// parseForeignKey parses "<table>(<column>)" after REFERENCES and returns
+// the rest of s.
+func parseForeignKey(s string) (*ForeignKey, string, error) {
+	name, rest := cutWord(s)
+	close := -1
+	if strings.HasPrefix(rest, "(") {
+		close = matchingParen(rest, 0)
+	}
+	if name == "" || close == -1 || strings.TrimSpace(rest[1:close]) == "" {
+		return nil, "", errors.New("invalid REFERENCES syntax")
+	}
+	fk := &ForeignKey{Table: name, Column: strings.TrimSpace(rest[1:close]), OnDelete: OnDeleteRestrict}
+	return fk, rest[close+1:], nil
+}
+
+// parseOnDelete parses the action after ON DELETE and returns the rest of s.
+// NO ACTION is the same as RESTRICT, since constraints are never deferred.
+func parseOnDelete(s string) (string, string, error) {
+	word, rest := cutWord(s)
+	switch strings.ToUpper(word) {
+	case "RESTRICT":
+		return OnDeleteRestrict, rest, nil
+	case "CASCADE":
+		return OnDeleteCascade, rest, nil
+	case "SET", "NO":
+		next, after := cutWord(rest)
+		switch {
+		case strings.EqualFold(word, "SET") && strings.EqualFold(next, "NULL"):
+			return OnDeleteSetNull, after, nil
+		case strings.EqualFold(word, "NO") && strings.EqualFold(next, "ACTION"):
+			return OnDeleteRestrict, after, nil
+		}
+	}
+	return "", "", errors.New("invalid ON DELETE action")
+}
+
+// fkRef is a column of a table that references another table.
+type fkRef struct {
+	table *Table
+	col   int
+	fk    *ForeignKey
+}
+
+// index returns the index on the referencing column, which CREATE TABLE
+// and loading give every REFERENCES column.
+func (r fkRef) index() (*Index, error) {
+	name := r.table.Columns[r.col].Name
+	if idx := r.table.Indexes[name]; idx != nil {
+		return idx, nil
+	}
+	return nil, fmt.Errorf("column %s.%s has no index", r.table.Name, name)
+}
+
+// referencingColumns returns the columns that reference the table named
+// parent, in table order. The caller must hold dbMu unless a transaction
+// is active.
+func referencingColumns(parent string) []fkRef {
+	var refs []fkRef
+	for _, t := range sortedTables() {
+		for i, c := range t.Columns {
+			if c.References != nil && c.References.Table == parent {
+				refs = append(refs, fkRef{table: t, col: i, fk: c.References})
+			}
+		}
+	}
+	return refs
+}
+
+// checkForeignKeys validates the REFERENCES constraints of a table that is
+// being created. The caller must hold dbMu unless a transaction is active.
+func (t *Table) checkForeignKeys() error {
+	for _, c := range t.Columns {
+		fk := c.References
+		if fk == nil {
+			continue
+		}
+		parent, ok := Tables[fk.Table]
+		if fk.Table == t.Name {
+			parent, ok = t, true
+		}
+		if !ok {
+			return fmt.Errorf("table %s referenced by column %s does not exist", fk.Table, c.Name)
+		}
+		i := parent.columnIndex(fk.Column)
+		if i == -1 {
+			return fmt.Errorf("column %s.%s referenced by column %s does not exist", fk.Table, fk.Column, c.Name)
+		}
+		pc := parent.Columns[i]
+		if !pc.PrimaryKey && !pc.Unique {
+			return fmt.Errorf("column %s.%s referenced by column %s is not PRIMARY KEY or UNIQUE", fk.Table, fk.Column, c.Name)
+		}
+		if pc.Type.Base() != c.Type.Base() {
+			return fmt.Errorf("column %s of type %s cannot reference %s.%s of type %s", c.Name, c.Type, fk.Table, fk.Column, pc.Type)
+		}
+		if fk.OnDelete == OnDeleteSetNull && c.PrimaryKey {
+			return fmt.Errorf("PRIMARY KEY column %s cannot be SET NULL on delete", c.Name)
+		}
+	}
+	// A table that others reference cannot be replaced under them.
+	if Tables[t.Name] != nil {
+		for _, ref := range referencingColumns(t.Name) {
+			if ref.table.Name != t.Name {
+				return fmt.Errorf("table %s is referenced by %s.%s", t.Name, ref.table.Name, ref.table.Columns[ref.col].Name)
+			}
+		}
+	}
+	return nil
+}
+
+// referencedTables returns the tables referenced by the columns of t,
+// other than t itself.
+func (t *Table) referencedTables() []*Table {
+	if txCtx == nil {
+		dbMu.RLock()
+		defer dbMu.RUnlock()
+	}
+	var parents []*Table
+	for _, c := range t.Columns {
+		if fk := c.References; fk != nil && fk.Table != t.Name {
+			if parent, ok := Tables[fk.Table]; ok {
+				parents = append(parents, parent)
+			}
+		}
+	}
+	return parents
+}
+
+// updatedReferences returns the columns that reference the columns of t
+// set by an UPDATE.
+func (t *Table) updatedReferences(updates map[int]interface{}) []fkRef {
+	if txCtx == nil {
+		dbMu.RLock()
+		defer dbMu.RUnlock()
+	}
+	var refs []fkRef
+	for _, ref := range referencingColumns(t.Name) {
+		if _, ok := updates[t.columnIndex(ref.fk.Column)]; ok {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// parentTable returns the table referenced by fk among parents.
+func (t *Table) parentTable(fk *ForeignKey, parents []*Table) (*Table, error) {
+	if fk.Table == t.Name {
+		return t, nil
+	}
+	for _, p := range parents {
+		if p.Name == fk.Table {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("table %s does not exist", fk.Table)
+}
+
+// lockTables write-locks the tables in write and read-locks those in read
+// that are not also written. Tables are locked in name order, so
+// statements locking several tables cannot deadlock. It returns the
+// function that unlocks them.
+func lockTables(write, read []*Table) func() {
+	mode := make(map[*Table]bool, len(write)+len(read))
+	for _, t := range read {
+		mode[t] = false
+	}
+	for _, t := range write {
+		mode[t] = true
+	}
+	tables := make([]*Table, 0, len(mode))
+	for t := range mode {
+		tables = append(tables, t)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+	for _, t := range tables {
+		if mode[t] {
+			t.mu.Lock()
+		} else {
+			t.mu.RLock()
+		}
+	}
+	return func() {
+		for _, t := range tables {
+			if mode[t] {
+				t.mu.Unlock()
+			} else {
+				t.mu.RUnlock()
+			}
+		}
+	}
+}
+
+// checkReferences verifies that the values rows hold in referencing
+// columns exist in the referenced tables, which the caller must have
+// locked. A row may reference a row of the same table inserted with it.
+// On a violation it returns the position of the first offending row.
+func (t *Table) checkReferences(rows []Row, parents []*Table) (int, error) {
+	for col, c := range t.Columns {
+		fk := c.References
+		if fk == nil {
+			continue
+		}
+		parent, err := t.parentTable(fk, parents)
+		if err != nil {
+			return -1, err
+		}
+		pcol := parent.columnIndex(fk.Column)
+		idx := parent.Indexes[fk.Column]
+		if pcol == -1 || idx == nil {
+			return -1, fmt.Errorf("column %s.%s does not exist or has no index", fk.Table, fk.Column)
+		}
+		var batch *btree
+		if parent == t {
+			batch = newBTree()
+			for k, row := range rows {
+				if row[pcol] != nil {
+					batch.Insert(row[pcol], k)
+				}
+			}
+		}
+		for k, row := range rows {
+			v := row[col]
+			if v == nil || len(idx.Lookup(v)) > 0 || batch != nil && len(batch.Get(v)) > 0 {
+				continue
+			}
+			return k, fmt.Errorf("%w: value %v of column %s not found in %s.%s", ErrConstraint, v, c.Name, fk.Table, fk.Column)
+		}
+	}
+	return -1, nil
+}
+
+// checkReferencedUpdate verifies that replacing the rows at positions
+// matched with newRows does not change a value that is still referenced.
+// The caller must have locked the referencing tables in refs.
+func (t *Table) checkReferencedUpdate(matched []int, newRows []Row, refs []fkRef) error {
+	for _, ref := range refs {
+		col := t.columnIndex(ref.fk.Column)
+		kept := newBTree()
+		for _, row := range newRows {
+			if row[col] != nil {
+				kept.Insert(row[col], 0)
+			}
+		}
+		changed := newBTree()
+		for k, i := range matched {
+			old, err := t.value(i, col)
+			if err != nil {
+				return err
+			}
+			if old != nil && compareValues(old, newRows[k][col]) != 0 && len(kept.Get(old)) == 0 {
+				changed.Insert(old, i)
+			}
+		}
+		if err := t.checkNotReferenced(changed, ref, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNotReferenced returns an error if a row of ref.table other than
+// those in ignore references one of keys. The rows are looked up in the
+// index on the referencing column, so only the referencing rows are read.
+func (t *Table) checkNotReferenced(keys *btree, ref fkRef, ignore map[int]bool) error {
+	idx, err := ref.index()
+	if err != nil {
+		return err
+	}
+	keys.Ascend(nil, nil, func(key interface{}, _ []int) bool {
+		for _, i := range idx.Lookup(key) {
+			if !ignore[i] {
+				err = fmt.Errorf("%w: value %v of %s.%s is referenced by %s.%s", ErrConstraint,
+					key, t.Name, ref.fk.Column, ref.table.Name, ref.table.Columns[ref.col].Name)
+				return false
+			}
+		}
+		return true
+	})
+	return err
+}
+
+// deletePlan lists the changes of a DELETE: the rows removed from every
+// affected table and the referencing columns set to NULL.
+type deletePlan struct {
+	deleted map[*Table]map[int]bool
+	nulls   map[*Table]map[int][]int // table -> row -> columns
+}
+
+// deleteClosure returns t and every table that references it directly or
+// through other references. The caller must hold dbMu unless a
+// transaction is active.
+func deleteClosure(t *Table) []*Table {
+	tables := []*Table{t}
+	seen := map[*Table]bool{t: true}
+	for i := 0; i < len(tables); i++ {
+		for _, ref := range referencingColumns(tables[i].Name) {
+			if !seen[ref.table] {
+				seen[ref.table] = true
+				tables = append(tables, ref.table)
+			}
+		}
+	}
+	return tables
+}
+
+// planDelete follows the ON DELETE actions of the references to the rows
+// of t at positions rows. RESTRICT fails only if the referencing row is not
+// deleted by the same statement. The caller must hold dbMu unless a
+// transaction is active, and the tables of deleteClosure(t).
+func planDelete(t *Table, rows []int) (*deletePlan, error) {
+	p := &deletePlan{deleted: map[*Table]map[int]bool{}, nulls: map[*Table]map[int][]int{}}
+	type pending struct {
+		t    *Table
+		rows []int
+	}
+	type restricted struct {
+		parent *Table
+		ref    fkRef
+		keys   *btree
+	}
+	var restrict []restricted
+	p.deleted[t] = make(map[int]bool, len(rows))
+	for _, i := range rows {
+		p.deleted[t][i] = true
+	}
+	queue := []pending{{t, rows}}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, ref := range referencingColumns(cur.t.Name) {
+			pcol := cur.t.columnIndex(ref.fk.Column)
+			keys := newBTree()
+			for _, i := range cur.rows {
+				v, err := cur.t.value(i, pcol)
+				if err != nil {
+					return nil, err
+				}
+				if v != nil {
+					keys.Insert(v, i)
+				}
+			}
+			if ref.fk.OnDelete == OnDeleteRestrict {
+				restrict = append(restrict, restricted{cur.t, ref, keys})
+				continue
+			}
+			idx, err := ref.index()
+			if err != nil {
+				return nil, err
+			}
+			var next []int
+			keys.Ascend(nil, nil, func(key interface{}, _ []int) bool {
+				for _, i := range idx.Lookup(key) {
+					switch {
+					case p.deleted[ref.table][i]:
+					case ref.fk.OnDelete == OnDeleteCascade:
+						if p.deleted[ref.table] == nil {
+							p.deleted[ref.table] = make(map[int]bool)
+						}
+						p.deleted[ref.table][i] = true
+						next = append(next, i)
+					default:
+						if p.nulls[ref.table] == nil {
+							p.nulls[ref.table] = make(map[int][]int)
+						}
+						p.nulls[ref.table][i] = append(p.nulls[ref.table][i], ref.col)
+					}
+				}
+				return true
+			})
+			if len(next) > 0 {
+				queue = append(queue, pending{ref.table, next})
+			}
+		}
+	}
+	for _, r := range restrict {
+		if err := r.parent.checkNotReferenced(r.keys, r.ref, p.deleted[r.ref.table]); err != nil {
+			return nil, err
+		}
+	}
+	for child, rows := range p.nulls {
+		var (
+			matched []int
+			newRows []Row
+		)
+		for i, cols := range rows {
+			if p.deleted[child][i] {
+				continue
+			}
+			old, err := child.row(i)
+			if err != nil {
+				return nil, err
+			}
+			row := append(Row(nil), old...)
+			for _, c := range cols {
+				row[c] = nil
+			}
+			matched = append(matched, i)
+			newRows = append(newRows, row)
+		}
+		if err := child.checkUniqueUpdate(matched, newRows); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// apply makes the planned changes. Columns are set to NULL first, since
+// removing rows moves the rows that follow them. An error reading or
+// writing paged rows stops it part way, with the rows before it changed.
+func (p *deletePlan) apply() error {
+	for t, rows := range p.nulls {
+		resultCache.InvalidateTable(t.Name)
+		for i, cols := range rows {
+			if p.deleted[t][i] {
+				continue
+			}
+			old, err := t.row(i)
+			if err != nil {
+				return err
+			}
+			row := append(Row(nil), old...)
+			for _, c := range cols {
+				row[c] = nil
+			}
+			if err := t.setRow(i, row); err != nil {
+				return err
+			}
+			t.updateIndexes(old, row, i)
+		}
+	}
+	for t, rows := range p.deleted {
+		resultCache.InvalidateTable(t.Name)
+		if len(rows) > 0 {
+			if err := t.removeRows(rows); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func handleDelete(query string) (string, error) {
+	rest := strings.TrimSpace(query[len("DELETE"):])
+	if !strings.EqualFold(firstWord(rest), "FROM") {
+		return "", errors.New("invalid DELETE syntax")
+	}
+	rest = strings.TrimSpace(rest[len("FROM"):])
+	tableName, condRaw := rest, ""
+	if idx := keywordIndex(rest, "WHERE"); idx != -1 {
+		tableName, condRaw = strings.TrimSpace(rest[:idx]), rest[idx+len("WHERE"):]
+	}
+	if tableName == "" {
+		return "", errors.New("invalid DELETE syntax")
+	}
+
+	// The schema must not change while the references are followed.
+	if txCtx == nil {
+		dbMu.RLock()
+	}
+	matched, err := deleteRows(tableName, condRaw, query)
+	if txCtx == nil {
+		dbMu.RUnlock()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := SaveBinaryDB(); err != nil {
+		return "", err
+	}
+	if err := clearWAL(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d rows deleted.", len(matched)), nil
+}
+
+// deleteRows deletes the rows of the named table that match the WHERE
+// condition in condRaw and logs query. The caller must hold dbMu unless a
+// transaction is active.
+func deleteRows(tableName, condRaw, query string) ([]int, error) {
+	table, exists := Tables[tableName]
+	if !exists {
+		return nil, errors.New("table does not exist")
+	}
+	var conds []condition
+	if condRaw != "" {
+		var err error
+		if conds, err = parseWhere(condRaw); err != nil {
+			return nil, err
+		}
+		for i := range conds {
+			if err := conds[i].bind(table); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	unlock := lockTables(deleteClosure(table), nil)
+	defer unlock()
+	var matched []int
+	if err := table.scan(conds, func(i int, _ Row) bool {
+		matched = append(matched, i)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	plan, err := planDelete(table, matched)
+	if err != nil {
+		return nil, err
+	}
+	if err := appendWAL(query); err != nil {
+		return nil, err
+	}
+	if err := plan.apply(); err != nil {
+		return nil, err
+	}
+	return matched, nil
+}
+
+// firstWord returns the first whitespace-separated word of s.
+func firstWord(s string) string {
+	word, _ := cutField(s)
+	return word
+}
+
+// dumpOrder orders tables so that every table follows the tables it
+// references, keeping name order otherwise.
+func dumpOrder(tables []*Table) []*Table {
+	pending := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		pending[t.Name] = true
+	}
+	ordered := make([]*Table, 0, len(tables))
+	for len(ordered) < len(tables) {
+		progress := false
+		for _, t := range tables {
+			if !pending[t.Name] || t.waitsFor(pending) {
+				continue
+			}
+			pending[t.Name] = false
+			ordered = append(ordered, t)
+			progress = true
+		}
+		if !progress {
+			// References always point to tables created earlier, so this
+			// only guards against a damaged schema.
+			for _, t := range tables {
+				if pending[t.Name] {
+					pending[t.Name] = false
+					ordered = append(ordered, t)
+				}
+			}
+		}
+	}
+	return ordered
+}
+
+// waitsFor reports whether t references a table in pending other than
+// itself.
+func (t *Table) waitsFor(pending map[string]bool) bool {
+	for _, c := range t.Columns {
+		if fk := c.References; fk != nil && fk.Table != t.Name && pending[fk.Table] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,707 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Cost model constants. Costs are measured in rows read by a sequential
+// scan; fetching a row through an index is slightly more expensive because
+// the rows are visited out of storage order.
+const (
+	indexRowCost           = 1.2
+	sortRowCost            = 0.5
+	openRangeSelectivity   = 1.0 / 3
+	closedRangeSelectivity = 1.0 / 9
+)
+
+// planNode is an operator of a query plan. Operators push rows to their
+// parent: execute calls fn for every produced row until fn returns false.
+// It fails only when paged rows cannot be read.
+type planNode interface {
+	execute(fn func(rid int, row Row) bool) error
+	describe() string
+	input() planNode
+}
+
+// selectPlan is a planned SELECT: the operator tree producing the result
+// rows and the header and type of every result column.
+type selectPlan struct {
+	root    planNode
+	headers []string
+	types   []ColumnType
+}
+
+// planSelect resolves stmt against the table and builds its plan. The
+// caller must hold t.mu for reading.
+func (t *Table) planSelect(stmt *selectStmt) (*selectPlan, error) {
+	var (
+		headers []string
+		types   []ColumnType
+		colIdx  []int
+		aggs    int
+	)
+	for _, item := range stmt.items {
+		if item.agg != "" {
+			aggs++
+		}
+		if item.column == "*" && item.agg == "" {
+			for i, c := range t.Columns {
+				headers = append(headers, c.Name)
+				types = append(types, c.Type)
+				colIdx = append(colIdx, i)
+			}
+			continue
+		}
+		idx := t.columnIndex(item.column)
+		if idx == -1 {
+			return nil, fmt.Errorf("unknown column %s", item.column)
+		}
+		headers = append(headers, item.label())
+		types = append(types, t.Columns[idx].Type)
+		colIdx = append(colIdx, idx)
+	}
+	if aggs > 0 && aggs != len(stmt.items) {
+		return nil, errors.New("cannot mix aggregate and plain columns")
+	}
+
+	conds := append([]condition(nil), stmt.where...)
+	for i := range conds {
+		if err := conds[i].bind(t); err != nil {
+			return nil, err
+		}
+	}
+	orderCol := -1
+	if stmt.orderBy != "" {
+		orderCol = t.columnIndex(stmt.orderBy)
+		if orderCol == -1 {
+			return nil, fmt.Errorf("unknown column %s", stmt.orderBy)
+		}
+	}
+
+	var root planNode
+	if aggs > 0 {
+		root = t.planAggregate(stmt.items, colIdx, conds)
+	} else {
+		var ordered bool
+		root, ordered = t.planWhere(conds, orderCol, stmt.desc, stmt.limit, neededColumns(colIdx, conds, orderCol))
+		if orderCol != -1 && !ordered {
+			root = &sortNode{in: root, col: orderCol, name: stmt.orderBy, desc: stmt.desc}
+		}
+	}
+	if stmt.limit != -1 {
+		root = &limitNode{in: root, n: stmt.limit}
+	}
+	if aggs == 0 {
+		root = &projectNode{in: root, headers: headers, cols: colIdx}
+	}
+	return &selectPlan{root: root, headers: headers, types: types}, nil
+}
+
+// explain renders the plan as a single-column result, one operator per
+// line, with inputs indented below their parents.
+func (p *selectPlan) explain() string {
+	var b strings.Builder
+	b.WriteString("plan\n")
+	depth := 0
+	for n := p.root; n != nil; n = n.input() {
+		b.WriteString(strings.Repeat("  ", depth))
+		b.WriteString(n.describe())
+		b.WriteString("\n")
+		depth++
+	}
+	return b.String()
+}
+
+// execSelect runs a parsed SELECT against the table. The caller must hold
+// t.mu for reading.
+func (t *Table) execSelect(stmt *selectStmt) (*ResultSet, error) {
+	plan, err := t.planSelect(stmt)
+	if err != nil {
+		return nil, err
+	}
+	res := &ResultSet{Columns: plan.headers, Types: plan.types}
+	if err := plan.root.execute(func(_ int, row Row) bool {
+		res.Rows = append(res.Rows, row)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	res.text = res.render()
+	return res, nil
+}
+
+// scan calls fn with the position and contents of every row matching conds
+// until fn returns false.
+func (t *Table) scan(conds []condition, fn func(int, Row) bool) error {
+	node, _ := t.planWhere(conds, -1, false, -1, nil)
+	return node.execute(fn)
+}
+
+// planWhere builds the cheapest access path for conds followed by a filter
+// for the conditions the path does not guarantee. The returned flag reports
+// whether rows come out in ORDER BY order. A full scan of a columnar table
+// reads only the columns in need; nil means all of them.
+func (t *Table) planWhere(conds []condition, orderCol int, desc bool, limit int, need []int) (planNode, bool) {
+	access := t.chooseAccess(conds, orderCol, desc, limit)
+	if scan, ok := access.node.(*tableScan); ok && t.store != nil {
+		scan.cols = need
+	}
+	var residual []condition
+	for i := range conds {
+		if !access.used[i] {
+			residual = append(residual, conds[i])
+		}
+	}
+	if len(residual) == 0 {
+		return access.node, access.ordered
+	}
+	return &filterNode{in: access.node, conds: residual}, access.ordered
+}
+
+// accessCandidate is one way of reaching the rows of a table together with
+// the conditions it answers exactly and its estimated cost.
+type accessCandidate struct {
+	node    planNode
+	used    map[int]bool
+	ordered bool
+	cost    float64
+}
+
+// chooseAccess compares a full scan with every usable index: equality on a
+// prefix of an index's columns, a range over a single-column index and an
+// ordered walk of the index on the ORDER BY column. The cheapest candidate
+// wins; on ties the earlier one (the full scan, then indexes by name) is kept.
+func (t *Table) chooseAccess(conds []condition, orderCol int, desc bool, limit int) accessCandidate {
+	rows := float64(t.rowCount())
+	cost := func(fetch float64, viaIndex, ordered bool, used map[int]bool) float64 {
+		if ordered && limit >= 0 && len(used) == len(conds) {
+			// Nothing is filtered out, so the scan stops after limit rows.
+			fetch = math.Min(fetch, float64(limit))
+		}
+		c := fetch
+		if viaIndex {
+			c = math.Log2(rows+1) + fetch*indexRowCost
+		}
+		if !ordered {
+			c += fetch * math.Log2(fetch+1) * sortRowCost
+		}
+		return c
+	}
+
+	best := accessCandidate{node: &tableScan{t: t}, ordered: orderCol == -1}
+	best.cost = cost(rows, false, best.ordered, nil)
+	consider := func(c accessCandidate, fetch float64) {
+		c.cost = cost(fetch, true, c.ordered, c.used)
+		if c.cost < best.cost {
+			best = c
+		}
+	}
+
+	names := make([]string, 0, len(t.Indexes))
+	for name := range t.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		idx := t.Indexes[name]
+
+		// Equality on a prefix of the index columns.
+		lookup := &indexLookup{t: t, index: idx}
+		used := make(map[int]bool)
+		for _, col := range idx.cols {
+			found := false
+			for i := range conds {
+				if conds[i].col == col && conds[i].op == "=" {
+					lookup.prefix = append(lookup.prefix, conds[i].value)
+					lookup.conds = append(lookup.conds, conds[i])
+					used[i] = true
+					found = true
+					break
+				}
+			}
+			if !found {
+				break
+			}
+		}
+		if lookup.prefix != nil {
+			lookup.est = t.estimateEqual(idx, len(lookup.prefix))
+			ordered := orderCol == -1
+			for _, col := range idx.cols[:len(lookup.prefix)] {
+				// Every produced row has the same value in the fixed columns.
+				ordered = ordered || col == orderCol
+			}
+			consider(accessCandidate{node: lookup, used: used, ordered: ordered}, lookup.est)
+		}
+
+		if len(idx.cols) != 1 {
+			continue
+		}
+		col := idx.cols[0]
+
+		// Range over a single-column index.
+		rng := &indexScan{t: t, index: idx, desc: desc && col == orderCol}
+		used = make(map[int]bool)
+		for i := range conds {
+			if conds[i].col != col {
+				continue
+			}
+			lo, hi, ok := conds[i].rangeBounds(t.Columns[col].Type)
+			if !ok {
+				continue
+			}
+			rng.lo = tightenLow(rng.lo, lo)
+			rng.hi = tightenHigh(rng.hi, hi)
+			rng.conds = append(rng.conds, conds[i])
+			if conds[i].op != "LIKE" {
+				// A LIKE range only narrows the scan to the literal prefix.
+				used[i] = true
+			}
+		}
+		ordered := orderCol == -1 || col == orderCol
+		if rng.conds != nil {
+			rng.est = rows * t.estimateRange(col, rng.lo, rng.hi)
+			consider(accessCandidate{node: rng, used: used, ordered: ordered}, rng.est)
+		} else if col == orderCol {
+			// An ordered walk of the whole index replaces the sort.
+			rng.est = rows
+			consider(accessCandidate{node: rng, ordered: true}, rows)
+		}
+	}
+	return best
+}
+
+// estimateEqual estimates how many rows share one value of the first k
+// columns of idx. With ANALYZE statistics the selectivities of the columns
+// are multiplied; otherwise the number of distinct keys in the index is
+// spread evenly over the columns.
+func (t *Table) estimateEqual(idx *Index, k int) float64 {
+	rows := float64(t.rowCount())
+	if idx.Unique && k == len(idx.cols) {
+		return math.Min(1, rows)
+	}
+	if t.Stats != nil {
+		est := rows
+		for _, name := range idx.Columns[:k] {
+			cs := t.Stats.column(name)
+			if cs == nil || cs.Distinct == 0 {
+				est = -1
+				break
+			}
+			est /= float64(cs.Distinct)
+		}
+		if est >= 0 {
+			return est
+		}
+	}
+	distinct := float64(idx.tree.Len())
+	if distinct == 0 {
+		return 0
+	}
+	return rows / math.Pow(distinct, float64(k)/float64(len(idx.cols)))
+}
+
+// estimateRange returns the fraction of rows of column col expected within
+// [lo, hi]. Numeric columns with ANALYZE statistics interpolate between the
+// recorded minimum and maximum; otherwise fixed selectivities are used.
+func (t *Table) estimateRange(col int, lo, hi *bound) float64 {
+	if cs := t.Stats.column(t.Columns[col].Name); cs != nil && isNumeric(cs.Min) && isNumeric(cs.Max) &&
+		(lo == nil || isNumeric(lo.key)) && (hi == nil || isNumeric(hi.key)) {
+		minV, maxV := toFloat(cs.Min), toFloat(cs.Max)
+		from, to := minV, maxV
+		if lo != nil {
+			from = math.Max(from, toFloat(lo.key))
+		}
+		if hi != nil {
+			to = math.Min(to, toFloat(hi.key))
+		}
+		switch {
+		case from > to:
+			return 0
+		case maxV == minV:
+			return 1
+		}
+		return (to - from) / (maxV - minV)
+	}
+	if lo != nil && hi != nil {
+		return closedRangeSelectivity
+	}
+	return openRangeSelectivity
+}
+
+// planAggregate answers MIN and MAX from index bounds, or from the column
+// vectors of a columnar table, when there is no WHERE clause and reads the
+// matching rows otherwise.
+func (t *Table) planAggregate(items []selectItem, cols []int, conds []condition) planNode {
+	n := &aggregateNode{items: items, cols: cols, indexes: make([]*Index, len(items)), vectors: make([]columnVector, len(items))}
+	needRows := len(conds) > 0
+	for i := range items {
+		idx, ok := t.Indexes[t.Columns[cols[i]].Name]
+		switch {
+		case len(conds) > 0:
+			needRows = true
+		case ok:
+			n.indexes[i] = idx
+		case t.store != nil:
+			n.vectors[i] = t.store.cols[cols[i]]
+		default:
+			needRows = true
+		}
+	}
+	if needRows {
+		n.in, _ = t.planWhere(conds, -1, false, -1, neededColumns(cols, conds, -1))
+	}
+	return n
+}
+
+// neededColumns returns the sorted positions of the columns a query reads:
+// the selected ones, those in conds and the ORDER BY column if any.
+func neededColumns(cols []int, conds []condition, orderCol int) []int {
+	seen := make(map[int]bool)
+	need := []int{}
+	add := func(c int) {
+		if c >= 0 && !seen[c] {
+			seen[c] = true
+			need = append(need, c)
+		}
+	}
+	for _, c := range cols {
+		add(c)
+	}
+	for i := range conds {
+		add(conds[i].col)
+	}
+	add(orderCol)
+	sort.Ints(need)
+	return need
+}
+
+// visitRows calls fn for the rows at the given positions until fn returns
+// false and reports whether every row was visited. A row that cannot be
+// read stops the visit with *err set.
+func (t *Table) visitRows(rids []int, fn func(int, Row) bool, err *error) bool {
+	n := t.rowCount()
+	for _, rid := range rids {
+		if rid >= n {
+			continue
+		}
+		row, rerr := t.row(rid)
+		if rerr != nil {
+			*err = rerr
+			return false
+		}
+		if !fn(rid, row) {
+			return false
+		}
+	}
+	return true
+}
+
+// tableScan reads every row in storage order. On a columnar table only the
+// columns in cols are read and the others are left nil; nil cols reads all.
+type tableScan struct {
+	t    *Table
+	cols []int
+}
+
+func (n *tableScan) execute(fn func(int, Row) bool) error {
+	if n.t.store != nil {
+		for i := 0; i < n.t.store.n; i++ {
+			if !fn(i, n.t.store.row(i, n.cols)) {
+				break
+			}
+		}
+		return nil
+	}
+	return n.t.eachRow(fn)
+}
+
+func (n *tableScan) describe() string {
+	if n.t.store == nil {
+		return fmt.Sprintf("TableScan %s (rows %d)", n.t.Name, n.t.rowCount())
+	}
+	cols := n.t.Columns
+	if n.cols != nil {
+		cols = make([]Column, len(n.cols))
+		for i, c := range n.cols {
+			cols[i] = n.t.Columns[c]
+		}
+	}
+	names := make([]string, len(cols))
+	for i, c := range cols {
+		names[i] = c.Name
+	}
+	return fmt.Sprintf("ColumnScan %s [%s] (rows %d)", n.t.Name, strings.Join(names, ", "), n.t.store.n)
+}
+
+func (n *tableScan) input() planNode { return nil }
+
+// indexLookup reads the rows whose leading index columns equal prefix.
+type indexLookup struct {
+	t      *Table
+	index  *Index
+	prefix tuple
+	conds  []condition
+	est    float64
+}
+
+func (n *indexLookup) execute(fn func(int, Row) bool) error {
+	var err error
+	if len(n.prefix) == len(n.index.cols) {
+		n.t.visitRows(n.index.tree.Get(n.index.keyOf(n.prefix)), fn, &err)
+		return err
+	}
+	n.index.tree.Ascend(&bound{key: n.prefix, inclusive: true}, nil, func(key interface{}, rows []int) bool {
+		if !key.(tuple).hasPrefix(n.prefix) {
+			return false
+		}
+		return n.t.visitRows(rows, fn, &err)
+	})
+	return err
+}
+
+func (n *indexLookup) describe() string {
+	return fmt.Sprintf("IndexLookup %s using index (%s): %s (est. rows %d)",
+		n.t.Name, strings.Join(n.index.Columns, ", "), joinConditions(n.conds), int(math.Ceil(n.est)))
+}
+
+func (n *indexLookup) input() planNode { return nil }
+
+// indexScan walks a single-column index in key order, optionally limited to
+// the range [lo, hi].
+type indexScan struct {
+	t      *Table
+	index  *Index
+	lo, hi *bound
+	desc   bool
+	conds  []condition
+	est    float64
+}
+
+func (n *indexScan) execute(fn func(int, Row) bool) error {
+	var err error
+	visit := func(key interface{}, rows []int) bool {
+		// NULL keys sort last and satisfy no condition, so a range stops
+		// short of them.
+		if key == nil && n.conds != nil {
+			return n.desc
+		}
+		return n.t.visitRows(rows, fn, &err)
+	}
+	if n.desc {
+		n.index.tree.Descend(n.lo, n.hi, visit)
+	} else {
+		n.index.tree.Ascend(n.lo, n.hi, visit)
+	}
+	return err
+}
+
+func (n *indexScan) describe() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "IndexScan %s using index (%s)", n.t.Name, strings.Join(n.index.Columns, ", "))
+	if n.desc {
+		b.WriteString(" DESC")
+	}
+	if n.conds != nil {
+		b.WriteString(": " + joinConditions(n.conds))
+	}
+	fmt.Fprintf(&b, " (est. rows %d)", int(math.Ceil(n.est)))
+	return b.String()
+}
+
+func (n *indexScan) input() planNode { return nil }
+
+// filterNode drops the rows that do not satisfy every condition.
+type filterNode struct {
+	in    planNode
+	conds []condition
+}
+
+func (n *filterNode) execute(fn func(int, Row) bool) error {
+	return n.in.execute(func(rid int, row Row) bool {
+		if !matchesAll(n.conds, row) {
+			return true
+		}
+		return fn(rid, row)
+	})
+}
+
+func (n *filterNode) describe() string { return "Filter: " + joinConditions(n.conds) }
+func (n *filterNode) input() planNode  { return n.in }
+
+// sortNode buffers its input and emits it ordered by one column. The sort
+// is stable so rows with equal keys keep their input order.
+type sortNode struct {
+	in   planNode
+	col  int
+	name string
+	desc bool
+}
+
+func (n *sortNode) execute(fn func(int, Row) bool) error {
+	var rids []int
+	var rows []Row
+	if err := n.in.execute(func(rid int, row Row) bool {
+		rids = append(rids, rid)
+		rows = append(rows, row)
+		return true
+	}); err != nil {
+		return err
+	}
+	order := make([]int, len(rows))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		c := compareValues(rows[order[i]][n.col], rows[order[j]][n.col])
+		if n.desc {
+			return c > 0
+		}
+		return c < 0
+	})
+	for _, i := range order {
+		if !fn(rids[i], rows[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (n *sortNode) describe() string {
+	if n.desc {
+		return "Sort: " + n.name + " DESC"
+	}
+	return "Sort: " + n.name
+}
+
+func (n *sortNode) input() planNode { return n.in }
+
+// limitNode stops its input after n rows.
+type limitNode struct {
+	in planNode
+	n  int
+}
+
+func (n *limitNode) execute(fn func(int, Row) bool) error {
+	if n.n == 0 {
+		return nil
+	}
+	count := 0
+	return n.in.execute(func(rid int, row Row) bool {
+		count++
+		return fn(rid, row) && count < n.n
+	})
+}
+
+func (n *limitNode) describe() string { return fmt.Sprintf("Limit: %d", n.n) }
+func (n *limitNode) input() planNode  { return n.in }
+
+// projectNode reduces every row to the selected columns.
+type projectNode struct {
+	in      planNode
+	headers []string
+	cols    []int
+}
+
+func (n *projectNode) execute(fn func(int, Row) bool) error {
+	return n.in.execute(func(rid int, row Row) bool {
+		out := make(Row, len(n.cols))
+		for i, c := range n.cols {
+			out[i] = row[c]
+		}
+		return fn(rid, out)
+	})
+}
+
+func (n *projectNode) describe() string { return "Project: " + strings.Join(n.headers, ", ") }
+func (n *projectNode) input() planNode  { return n.in }
+
+// aggregateNode computes MIN and MAX aggregates and emits a single row in
+// which an aggregate over no values is nil. Items with a non-nil entry in
+// indexes read the bound of that index, items with a non-nil entry in
+// vectors scan that column vector; the others consume the input.
+type aggregateNode struct {
+	in      planNode
+	items   []selectItem
+	cols    []int
+	indexes []*Index
+	vectors []columnVector
+}
+
+func (n *aggregateNode) execute(fn func(int, Row) bool) error {
+	out := make(Row, len(n.items))
+	if n.in != nil {
+		if err := n.in.execute(func(_ int, row Row) bool {
+			for i, item := range n.items {
+				if n.indexes[i] != nil || n.vectors[i] != nil {
+					continue
+				}
+				v := row[n.cols[i]]
+				if v == nil {
+					// MIN and MAX ignore NULL.
+					continue
+				}
+				if out[i] == nil {
+					out[i] = v
+					continue
+				}
+				c := compareValues(v, out[i])
+				if (item.agg == "MIN" && c < 0) || (item.agg == "MAX" && c > 0) {
+					out[i] = v
+				}
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+	}
+	for i, vec := range n.vectors {
+		if vec != nil {
+			out[i] = vec.extreme(n.items[i].agg == "MAX")
+		}
+	}
+	for i, idx := range n.indexes {
+		if idx == nil {
+			continue
+		}
+		if n.items[i].agg == "MIN" {
+			// NULL keys sort last, so the smallest key is NULL only when
+			// every key is.
+			out[i], _ = idx.tree.Min()
+			continue
+		}
+		idx.tree.Descend(nil, nil, func(key interface{}, _ []int) bool {
+			out[i] = key
+			return key == nil
+		})
+	}
+	fn(-1, out)
+	return nil
+}
+
+func (n *aggregateNode) describe() string {
+	parts := make([]string, len(n.items))
+	for i, item := range n.items {
+		parts[i] = item.label()
+		if n.indexes[i] != nil {
+			parts[i] += " using index (" + strings.Join(n.indexes[i].Columns, ", ") + ")"
+		} else if n.vectors[i] != nil {
+			parts[i] += " using column vector"
+		}
+	}
+	return "Aggregate: " + strings.Join(parts, ", ")
+}
+
+func (n *aggregateNode) input() planNode { return n.in }
+
+func joinConditions(conds []condition) string {
+	parts := make([]string, len(conds))
+	for i := range conds {
+		parts[i] = conds[i].String()
+	}
+	return strings.Join(parts, " AND ")
+}
@@ -0,0 +1,512 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// selectItem is a single entry of the SELECT list: either a column name
+// (or "*") or an aggregate over a column.
+type selectItem struct {
+	agg    string
+	column string
+}
+
+func (s selectItem) label() string {
+	if s.agg == "" {
+		return s.column
+	}
+	return fmt.Sprintf("%s(%s)", s.agg, s.column)
+}
+
+// selectStmt is a parsed SELECT query.
+type selectStmt struct {
+	table   string
+	items   []selectItem
+	where   []condition
+	orderBy string
+	desc    bool
+	limit   int
+}
+
+// condition is a single predicate of a WHERE clause. Predicates are always
+// combined with AND.
+type condition struct {
+	column  string
+	op      string
+	raw     string
+	rawHigh string
+
+	col   int
+	value interface{}
+	high  interface{}
+}
+
+func parseSelect(query string) (*selectStmt, error) {
+	rest := strings.TrimSpace(query[len("SELECT"):])
+	fromIdx := keywordIndex(rest, "FROM")
+	if fromIdx == -1 {
+		return nil, errors.New("invalid SELECT syntax")
+	}
+	stmt := &selectStmt{limit: -1}
+	for _, raw := range splitTopLevel(rest[:fromIdx], ',') {
+		item, err := parseSelectItem(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, err
+		}
+		stmt.items = append(stmt.items, item)
+	}
+
+	clauses, err := splitClauses(rest[fromIdx+len("FROM"):], "WHERE", "ORDER BY", "LIMIT")
+	if err != nil {
+		return nil, err
+	}
+	tableFields := strings.Fields(clauses[""])
+	if len(tableFields) != 1 {
+		return nil, errors.New("invalid SELECT syntax")
+	}
+	stmt.table = tableFields[0]
+
+	if raw, ok := clauses["WHERE"]; ok {
+		if stmt.where, err = parseWhere(raw); err != nil {
+			return nil, err
+		}
+	}
+	if raw, ok := clauses["ORDER BY"]; ok {
+		fields := strings.Fields(raw)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, errors.New("invalid ORDER BY syntax")
+		}
+		stmt.orderBy = fields[0]
+		if len(fields) == 2 {
+			switch strings.ToUpper(fields[1]) {
+			case "ASC":
+			case "DESC":
+				stmt.desc = true
+			default:
+				return nil, errors.New("invalid ORDER BY syntax")
+			}
+		}
+	}
+	if raw, ok := clauses["LIMIT"]; ok {
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil || n < 0 {
+			return nil, errors.New("invalid LIMIT value")
+		}
+		stmt.limit = n
+	}
+	return stmt, nil
+}
+
+func parseSelectItem(raw string) (selectItem, error) {
+	if raw == "" {
+		return selectItem{}, errors.New("invalid SELECT syntax")
+	}
+	open := strings.Index(raw, "(")
+	if open == -1 {
+		return selectItem{column: raw}, nil
+	}
+	if !strings.HasSuffix(raw, ")") {
+		return selectItem{}, errors.New("invalid SELECT syntax")
+	}
+	agg := strings.ToUpper(strings.TrimSpace(raw[:open]))
+	switch agg {
+	case "MIN", "MAX":
+	default:
+		return selectItem{}, fmt.Errorf("unsupported function %s", agg)
+	}
+	return selectItem{agg: agg, column: strings.TrimSpace(raw[open+1 : len(raw)-1])}, nil
+}
+
+// splitClauses cuts s at the given keywords, which must appear in the listed
+// order. The text before the first keyword is stored under "".
+func splitClauses(s string, keywords ...string) (map[string]string, error) {
+	clauses := make(map[string]string)
+	current := ""
+	for _, kw := range keywords {
+		idx := keywordIndex(s, kw)
+		if idx == -1 {
+			continue
+		}
+		clauses[current] = s[:idx]
+		current = kw
+		s = s[idx+len(kw):]
+	}
+	clauses[current] = s
+	for _, kw := range keywords {
+		for _, text := range clauses {
+			if keywordIndex(text, kw) != -1 {
+				return nil, fmt.Errorf("unexpected %s", kw)
+			}
+		}
+	}
+	return clauses, nil
+}
+
+func parseWhere(raw string) ([]condition, error) {
+	var parts []string
+	for {
+		idx := keywordIndex(raw, "AND")
+		if idx == -1 {
+			parts = append(parts, raw)
+			break
+		}
+		parts = append(parts, raw[:idx])
+		raw = raw[idx+len("AND"):]
+	}
+
+	var conds []condition
+	for i := 0; i < len(parts); i++ {
+		part := parts[i]
+		// BETWEEN consumes the following AND as part of its own syntax.
+		if keywordIndex(part, "BETWEEN") != -1 && i+1 < len(parts) {
+			part += " AND " + parts[i+1]
+			i++
+		}
+		cond, err := parseCondition(part)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, cond)
+	}
+	return conds, nil
+}
+
+func parseCondition(raw string) (condition, error) {
+	raw = strings.TrimSpace(raw)
+	if idx := keywordIndex(raw, "BETWEEN"); idx != -1 {
+		bounds := raw[idx+len("BETWEEN"):]
+		andIdx := keywordIndex(bounds, "AND")
+		if andIdx == -1 {
+			return condition{}, errors.New("invalid BETWEEN syntax")
+		}
+		return condition{
+			column:  strings.TrimSpace(raw[:idx]),
+			op:      "BETWEEN",
+			raw:     unquote(bounds[:andIdx]),
+			rawHigh: unquote(bounds[andIdx+len("AND"):]),
+		}, nil
+	}
+	if idx := keywordIndex(raw, "LIKE"); idx != -1 {
+		return condition{
+			column: strings.TrimSpace(raw[:idx]),
+			op:     "LIKE",
+			raw:    unquote(raw[idx+len("LIKE"):]),
+		}, nil
+	}
+
+	inQuote := false
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		if ch == '\'' {
+			inQuote = !inQuote
+		}
+		if inQuote || !strings.ContainsRune("<>=!", rune(ch)) {
+			continue
+		}
+		op := string(ch)
+		if i+1 < len(raw) {
+			switch raw[i : i+2] {
+			case "<=", ">=", "!=", "<>":
+				op = raw[i : i+2]
+			}
+		}
+		if op == "!" {
+			break
+		}
+		if op == "<>" {
+			op = "!="
+		}
+		column := strings.TrimSpace(raw[:i])
+		if column == "" {
+			break
+		}
+		return condition{column: column, op: op, raw: unquote(raw[i+len(op):])}, nil
+	}
+	return condition{}, errors.New("invalid WHERE syntax")
+}
+
+// bind resolves the condition column against the table and parses the
+// literals into the column type.
+func (c *condition) bind(t *Table) error {
+	c.col = t.columnIndex(c.column)
+	if c.col == -1 {
+		return fmt.Errorf("unknown column %s", c.column)
+	}
+	if c.op == "LIKE" {
+		c.value = c.raw
+		return nil
+	}
+	ct := t.Columns[c.col].Type
+	v, err := parseValue(c.raw, ct)
+	if err != nil {
+		return fmt.Errorf("invalid %s value for column %s", ct, c.column)
+	}
+	c.value = v
+	if c.op == "BETWEEN" {
+		h, err := parseValue(c.rawHigh, ct)
+		if err != nil {
+			return fmt.Errorf("invalid %s value for column %s", ct, c.column)
+		}
+		c.high = h
+	}
+	return nil
+}
+
+// String renders the condition as it would be written in SQL.
+func (c *condition) String() string {
+	switch c.op {
+	case "BETWEEN":
+		return fmt.Sprintf("%s BETWEEN %s AND %s", c.column, sqlLiteral(c.value), sqlLiteral(c.high))
+	case "LIKE":
+		return fmt.Sprintf("%s LIKE %s", c.column, sqlLiteral(c.raw))
+	}
+	return fmt.Sprintf("%s %s %s", c.column, c.op, sqlLiteral(c.value))
+}
+
+func (c *condition) matches(row Row) bool {
+	v := row[c.col]
+	if v == nil {
+		// A comparison with NULL is unknown, which no row passes.
+		return false
+	}
+	switch c.op {
+	case "LIKE":
+		return likeMatch(fmt.Sprint(v), c.raw)
+	case "BETWEEN":
+		return compareValues(v, c.value) >= 0 && compareValues(v, c.high) <= 0
+	}
+	cmp := compareValues(v, c.value)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// rangeBounds returns the index range implied by the condition, or ok=false
+// when the condition cannot be answered by an ordered index scan.
+func (c *condition) rangeBounds(ct ColumnType) (lo, hi *bound, ok bool) {
+	switch c.op {
+	case ">":
+		return &bound{key: c.value}, nil, true
+	case ">=":
+		return &bound{key: c.value, inclusive: true}, nil, true
+	case "<":
+		return nil, &bound{key: c.value}, true
+	case "<=":
+		return nil, &bound{key: c.value, inclusive: true}, true
+	case "BETWEEN":
+		return &bound{key: c.value, inclusive: true}, &bound{key: c.high, inclusive: true}, true
+	case "LIKE":
+		prefix := likePrefix(c.raw)
+		if ct != TypeText || prefix == "" {
+			return nil, nil, false
+		}
+		lo = &bound{key: prefix, inclusive: true}
+		if upper, ok := prefixSuccessor(prefix); ok {
+			hi = &bound{key: upper}
+		}
+		return lo, hi, true
+	}
+	return nil, nil, false
+}
+
+func matchesAll(conds []condition, row Row) bool {
+	for i := range conds {
+		if !conds[i].matches(row) {
+			return false
+		}
+	}
+	return true
+}
+
+func tightenLow(cur, b *bound) *bound {
+	if b == nil {
+		return cur
+	}
+	if cur == nil {
+		return b
+	}
+	c := compareValues(b.key, cur.key)
+	if c > 0 || (c == 0 && !b.inclusive) {
+		return b
+	}
+	return cur
+}
+
+func tightenHigh(cur, b *bound) *bound {
+	if b == nil {
+		return cur
+	}
+	if cur == nil {
+		return b
+	}
+	c := compareValues(b.key, cur.key)
+	if c < 0 || (c == 0 && !b.inclusive) {
+		return b
+	}
+	return cur
+}
+
+func (t *Table) columnIndex(name string) int {
+	for i, c := range t.Columns {
+		if c.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// likeMatch reports whether s matches a SQL LIKE pattern where % matches any
+// sequence of characters and _ matches exactly one.
+func likeMatch(s, pattern string) bool {
+	str, pat := []rune(s), []rune(pattern)
+	si, pi := 0, 0
+	star, mark := -1, 0
+	for si < len(str) {
+		switch {
+		case pi < len(pat) && pat[pi] == '%':
+			star, mark = pi, si
+			pi++
+		case pi < len(pat) && (pat[pi] == '_' || pat[pi] == str[si]):
+			si++
+			pi++
+		case star != -1:
+			pi = star + 1
+			mark++
+			si = mark
+		default:
+			return false
+		}
+	}
+	for pi < len(pat) && pat[pi] == '%' {
+		pi++
+	}
+	return pi == len(pat)
+}
+
+// likePrefix returns the literal prefix of a LIKE pattern.
+func likePrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "%_"); i != -1 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// prefixSuccessor returns the smallest string greater than every string
+// starting with prefix.
+func prefixSuccessor(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// sqlLiteral renders v as a SQL literal, quoting strings.
+func sqlLiteral(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	}
+	return fmt.Sprint(v)
+}
+
+// keywordIndex finds the first occurrence of kw in s as a whole word outside
+// of quoted literals, ignoring case. It returns -1 if kw is not present.
+func keywordIndex(s, kw string) int {
+	inQuote := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\'' {
+			inQuote = !inQuote
+			continue
+		}
+		if inQuote || i+len(kw) > len(s) || !strings.EqualFold(s[i:i+len(kw)], kw) {
+			continue
+		}
+		if i > 0 && isWordByte(s[i-1]) {
+			continue
+		}
+		if j := i + len(kw); j < len(s) && isWordByte(s[j]) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// splitTopLevel splits s on sep, ignoring separators inside quoted literals
+// and parentheses.
+func splitTopLevel(s string, sep byte) []string {
+	var (
+		parts   []string
+		depth   int
+		inQuote bool
+		start   int
+	)
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == '\'':
+			inQuote = !inQuote
+		case inQuote:
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+		case ch == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// matchingParen returns the position of the parenthesis closing the one at
+// open, or -1 if it is not closed.
+func matchingParen(s string, open int) int {
+	depth, inQuote := 0, false
+	for i := open; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == '\'':
+			inQuote = !inQuote
+		case inQuote:
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// unquote trims s and strips surrounding single quotes, unescaping doubled
+// quotes inside the literal.
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'")
+	}
+	return s
+}
@@ -0,0 +1,49 @@
+package engine
+
+import (
+	"errors"
+	"strings"
+)
+
+// ResultSet is the typed result of a SELECT. Values use the engine's Go
+// types: int for INT, int64 for BIGINT, float64, bool, string, Timestamp,
+// Date, Blob and Decimal; nil is NULL.
+type ResultSet struct {
+	Columns []string
+	Types   []ColumnType
+	Rows    []Row
+
+	text string
+}
+
+// String renders the result the way the CLI prints it: a tab-separated
+// header line followed by one line per row.
+func (r *ResultSet) String() string {
+	if r.text != "" {
+		return r.text
+	}
+	return r.render()
+}
+
+func (r *ResultSet) render() string {
+	var b strings.Builder
+	b.WriteString(strings.Join(r.Columns, "\t") + "\n")
+	vals := make([]string, len(r.Columns))
+	for _, row := range r.Rows {
+		for i, v := range row {
+			vals[i] = formatValue(v)
+		}
+		b.WriteString(strings.Join(vals, "\t") + "\n")
+	}
+	return b.String()
+}
+
+// Query runs a SELECT and returns its typed result. Results may come from
+// the query cache and must not be modified.
+func Query(query string) (*ResultSet, error) {
+	query = strings.TrimSpace(query)
+	if !strings.HasPrefix(strings.ToUpper(query), "SELECT") {
+		return nil, errors.New("only SELECT statements return rows")
+	}
+	return selectResult(query)
+}
@@ -1,16 +1,22 @@
 package engine
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 )
 
 var (
 	magicHeader = []byte("MYDB")
-	dbVersion   = uint8(3)
+	dbVersion   = uint8(12)
 )
 
 const binaryDBFile = "data.mdb"
@@ -29,97 +35,186 @@ func SaveBinaryDB() error {
 }
 
 func saveBinaryDBNoLock() error {
-	file, err := os.OpenFile(binaryDBFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	return writeDBFile(binaryDBFile, Tables, true)
+}
 
+// writeDBFile writes tables to a data file at path. The file is written
+// under a temporary name and renamed over path, so a reader of path sees
+// either the previous file or the new one in full. live says that tables
+// are the live tables, whose pages then move to the new file.
+func writeDBFile(path string, tables map[string]*Table, live bool) (err error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return err
 	}
+	bw := &blockWriter{flags: headerFlags(), aead: currentCipher(), track: live}
 	defer func() {
-		_ = file.Close()
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil && live {
+			err = pool.replaceFile(file.Name(), path, bw.spans)
+		} else if err == nil {
+			err = os.Rename(file.Name(), path)
+		}
+		if err != nil {
+			_ = os.Remove(file.Name())
+		}
 	}()
+	bufw := bufio.NewWriter(file)
+	w := &countingWriter{w: bufw}
 
-	if _, err := file.Write(magicHeader); err != nil {
+	if _, err := w.Write(magicHeader); err != nil {
 		return err
 	}
 
-	if err := binary.Write(file, binary.LittleEndian, dbVersion); err != nil {
+	if err := binary.Write(w, binary.LittleEndian, dbVersion); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, bw.flags); err != nil {
 		return err
 	}
+	if bw.flags&flagEncrypted != 0 {
+		// Encrypted blocks are bound to the header and a random id of the
+		// file, so that they cannot be replayed from another file.
+		id := make([]byte, fileIDSize)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		if _, err := w.Write(id); err != nil {
+			return err
+		}
+		bw.ad = &blockAD{header: append(append(slices.Clone(magicHeader), dbVersion, bw.flags), id...)}
+	}
 
-	for _, table := range Tables {
+	for _, table := range tables {
 		table.mu.RLock()
-		err := writeTable(file, table)
+		err := bw.write(w, table)
 		table.mu.RUnlock()
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return bufw.Flush()
 }
 
 func LoadBinaryDB() error {
-	file, err := os.Open(binaryDBFile)
+	db, err := readDBFile(binaryDBFile)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
 		}
 		return err
 	}
+
+	installDB(db)
+
+	if db.version < dbVersion {
+		return SaveBinaryDB()
+	}
+
+	return nil
+}
+
+// installDB replaces the live tables with those of db.
+func installDB(db *dbFile) {
+	dbMu.Lock()
+	releaseTables(Tables)
+	Tables = db.tables
+	Compression = CompressionNone
+	if db.flags&flagCompressed != 0 {
+		Compression = CompressionFlate
+	}
+	dbMu.Unlock()
+	resultCache.Purge()
+}
+
+// dbFile is the parsed contents of a data file.
+type dbFile struct {
+	version uint8
+	flags   uint8
+	tables  map[string]*Table
+}
+
+// readDBFile parses a data file without touching the live database.
+func readDBFile(path string) (*dbFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// Tables loaded with the buffer pool enabled keep reading their pages
+	// from the file; it is closed once the last of them is released.
+	src := &pageFile{f: file, path: path, refs: 1}
 	defer func() {
-		_ = file.Close()
+		pool.mu.Lock()
+		pool.closeFile(src)
+		pool.mu.Unlock()
 	}()
+	r := &countingReader{r: bufio.NewReader(file), src: src}
 
 	header := make([]byte, len(magicHeader))
-	if _, err := io.ReadFull(file, header); err != nil {
-		return fmt.Errorf("reading header: %w", err)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
 	}
 
 	if !bytes.Equal(header, magicHeader) {
-		return fmt.Errorf("invalid file format: bad magic header")
+		return nil, fmt.Errorf("invalid file format: bad magic header")
 	}
 
-	var version uint8
-	if err := binary.Read(file, binary.LittleEndian, &version); err != nil {
-		return fmt.Errorf("reading version: %w", err)
+	db := &dbFile{tables: make(map[string]*Table)}
+	if err := binary.Read(r, binary.LittleEndian, &db.version); err != nil {
+		return nil, fmt.Errorf("reading version: %w", err)
 	}
 
-	if version > dbVersion {
-		return fmt.Errorf("unsupported db version: %d", version)
+	if db.version > dbVersion {
+		return nil, fmt.Errorf("unsupported db version: %d", db.version)
+	}
+	if db.version >= 10 {
+		if err := binary.Read(r, binary.LittleEndian, &db.flags); err != nil {
+			return nil, fmt.Errorf("reading flags: %w", err)
+		}
+		if db.flags&^(flagCompressed|flagEncrypted) != 0 {
+			return nil, fmt.Errorf("unsupported header flags: %#x", db.flags)
+		}
+		if db.flags&flagEncrypted != 0 && currentCipher() == nil {
+			return nil, ErrNoKey
+		}
+	}
+	var ad *blockAD
+	if db.version >= 12 && db.flags&flagEncrypted != 0 {
+		id := make([]byte, fileIDSize)
+		if _, err := io.ReadFull(r, id); err != nil {
+			return nil, fmt.Errorf("reading file id: %w", err)
+		}
+		ad = &blockAD{header: append(append(slices.Clone(magicHeader), db.version, db.flags), id...)}
 	}
 
-	newTables := make(map[string]*Table)
 	for {
 		var (
 			table *Table
 			err   error
 		)
-		switch version {
+		switch db.version {
 		case 1:
-			table, err = readTableV1(file)
+			table, err = readTableV1(r)
 		case 2:
-			table, err = readTableV2(file)
+			table, err = readTableV2(r)
+		case 3, 4, 5, 6, 7, 8, 9:
+			table, err = readTable(r, db.version)
 		default:
-			table, err = readTableV3(file)
+			table, err = readTableBlock(r, db.version, db.flags, ad)
 		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
+			releaseTables(db.tables)
+			return nil, err
 		}
-		newTables[table.Name] = table
+		db.tables[table.Name] = table
 	}
-
-	dbMu.Lock()
-	Tables = newTables
-	dbMu.Unlock()
-
-	if version < dbVersion {
-		return SaveBinaryDB()
-	}
-
-	return nil
+	return db, nil
 }
 
 func writeTable(w io.Writer, table *Table) error {
@@ -152,29 +247,406 @@ func writeTable(w io.Writer, table *Table) error {
 		if _, err := w.Write([]byte(col.Type)); err != nil {
 			return err
 		}
+
+		if err := writeOptions(w, columnOptions(col)); err != nil {
+			return err
+		}
+	}
+	if err := writeOptions(w, tableOptions(table)); err != nil {
+		return err
 	}
 
-	rowCount := uint64(len(table.Rows))
+	rowCount := uint64(table.rowCount())
 	if err := binary.Write(w, binary.LittleEndian, rowCount); err != nil {
 		return err
 	}
 
-	for _, row := range table.Rows {
-		for _, val := range row {
-			str := fmt.Sprint(val)
-			dataLen := uint32(len(str))
-			if err := binary.Write(w, binary.LittleEndian, dataLen); err != nil {
+	var (
+		buf  []byte
+		werr error
+	)
+	// The blocks of a save record where the pages of a paged table go.
+	cw, _ := w.(*countingWriter)
+	if table.pages == nil {
+		cw = nil
+	}
+	var start int64
+	n := table.rowCount()
+	serr := table.eachRow(func(i int, row Row) bool {
+		if cw != nil && i%pageRows == 0 {
+			start = cw.off
+		}
+		buf = buf[:0]
+		for i, val := range row {
+			buf = appendValue(buf, val, table.Columns[i].Type)
+		}
+		if _, werr = w.Write(buf); werr != nil {
+			return false
+		}
+		if cw != nil && (i%pageRows == pageRows-1 || i == n-1) {
+			p := table.pages.pages[i/pageRows]
+			cw.spans = append(cw.spans, pageSpan{p: p, ext: pool.extent(p), off: start, n: cw.off - start})
+		}
+		return true
+	})
+	if werr == nil {
+		werr = serr
+	}
+	if werr != nil {
+		return werr
+	}
+
+	if err := writeIndexDefs(w, table); err != nil {
+		return err
+	}
+	return writeTableStats(w, table.Stats)
+}
+
+// option is a key/value pair stored for a column constraint or a table
+// setting, so that new ones can be added without changing the file layout.
+type option struct {
+	key   string
+	value string
+}
+
+func columnOptions(c Column) []option {
+	var opts []option
+	if c.PrimaryKey {
+		opts = append(opts, option{key: "primary_key"})
+	}
+	if c.Unique {
+		opts = append(opts, option{key: "unique"})
+	}
+	if c.AutoIncrement {
+		opts = append(opts, option{key: "autoincrement"})
+	}
+	if c.Default != "" {
+		opts = append(opts, option{key: "default", value: c.Default})
+	}
+	if c.Check != "" {
+		opts = append(opts, option{key: "check", value: c.Check})
+	}
+	if fk := c.References; fk != nil {
+		opts = append(opts, option{key: "references", value: fk.Table + "(" + fk.Column + ")"})
+		opts = append(opts, option{key: "on_delete", value: fk.OnDelete})
+	}
+	return opts
+}
+
+// applyColumnOption restores a constraint read from disk. Unknown keys are
+// ignored.
+func applyColumnOption(c *Column, opt option) {
+	switch opt.key {
+	case "primary_key":
+		c.PrimaryKey = true
+	case "unique":
+		c.Unique = true
+	case "autoincrement":
+		c.AutoIncrement = true
+	case "default":
+		c.Default = opt.value
+	case "check":
+		c.Check = opt.value
+	case "references":
+		if fk, _, err := parseForeignKey(opt.value); err == nil {
+			c.References = fk
+		}
+	case "on_delete":
+		if c.References != nil {
+			c.References.OnDelete = opt.value
+		}
+	}
+}
+
+func tableOptions(t *Table) []option {
+	var opts []option
+	if t.Storage != "" && t.Storage != StorageRow {
+		opts = append(opts, option{key: "storage", value: string(t.Storage)})
+	}
+	if t.Sequence > 0 {
+		opts = append(opts, option{key: "sequence", value: strconv.FormatInt(t.Sequence, 10)})
+	}
+	return opts
+}
+
+// applyTableOption restores a table setting read from disk. Unknown keys are
+// ignored.
+func applyTableOption(t *Table, opt option) {
+	switch opt.key {
+	case "storage":
+		if kind, err := parseStorageKind(opt.value); err == nil {
+			t.Storage = kind
+		}
+	case "sequence":
+		if n, err := strconv.ParseInt(opt.value, 10, 64); err == nil {
+			t.Sequence = n
+		}
+	}
+}
+
+func writeOptions(w io.Writer, opts []option) error {
+	if err := binary.Write(w, binary.LittleEndian, uint8(len(opts))); err != nil {
+		return err
+	}
+	for _, opt := range opts {
+		if err := binary.Write(w, binary.LittleEndian, uint8(len(opt.key))); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(opt.key)); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint16(len(opt.value))); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(opt.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readOptions(r io.Reader) ([]option, error) {
+	var count uint8
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	opts := make([]option, 0, count)
+	for i := 0; i < int(count); i++ {
+		var keyLen uint8
+		if err := binary.Read(r, binary.LittleEndian, &keyLen); err != nil {
+			return nil, err
+		}
+		key := make([]byte, keyLen)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, err
+		}
+		var valLen uint16
+		if err := binary.Read(r, binary.LittleEndian, &valLen); err != nil {
+			return nil, err
+		}
+		val := make([]byte, valLen)
+		if _, err := io.ReadFull(r, val); err != nil {
+			return nil, err
+		}
+		opts = append(opts, option{key: string(key), value: string(val)})
+	}
+	return opts, nil
+}
+
+// indexDef describes an index stored in the binary file; the index itself
+// is rebuilt from the rows on load.
+type indexDef struct {
+	columns []string
+	unique  bool
+}
+
+// writeIndexDefs stores the indexed columns so that the indexes can be
+// rebuilt when the table is loaded.
+func writeIndexDefs(w io.Writer, table *Table) error {
+	names := make([]string, 0, len(table.Indexes))
+	for name := range table.Indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(names))); err != nil {
+		return err
+	}
+	for _, name := range names {
+		idx := table.Indexes[name]
+		if err := binary.Write(w, binary.LittleEndian, uint16(len(idx.Columns))); err != nil {
+			return err
+		}
+		for _, col := range idx.Columns {
+			if err := binary.Write(w, binary.LittleEndian, uint16(len(col))); err != nil {
 				return err
 			}
-			if _, err := w.Write([]byte(str)); err != nil {
+			if _, err := w.Write([]byte(col)); err != nil {
 				return err
 			}
 		}
+		var flags uint8
+		if idx.Unique {
+			flags |= 1
+		}
+		if err := binary.Write(w, binary.LittleEndian, flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readIndexDefs(r io.Reader, version uint8) ([]indexDef, error) {
+	var count uint16
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	defs := make([]indexDef, 0, count)
+	for i := 0; i < int(count); i++ {
+		colCount := uint16(1)
+		if version >= 6 {
+			if err := binary.Read(r, binary.LittleEndian, &colCount); err != nil {
+				return nil, err
+			}
+		}
+		var def indexDef
+		for j := 0; j < int(colCount); j++ {
+			var colLen uint16
+			if err := binary.Read(r, binary.LittleEndian, &colLen); err != nil {
+				return nil, err
+			}
+			colBytes := make([]byte, colLen)
+			if _, err := io.ReadFull(r, colBytes); err != nil {
+				return nil, err
+			}
+			def.columns = append(def.columns, string(colBytes))
+		}
+		if version >= 5 {
+			var flags uint8
+			if err := binary.Read(r, binary.LittleEndian, &flags); err != nil {
+				return nil, err
+			}
+			def.unique = flags&1 != 0
+		}
+		defs = append(defs, def)
 	}
+	return defs, nil
+}
 
+// writeTableStats stores the ANALYZE statistics of a table: a presence flag
+// followed by the row count and, per column, its name, distinct and NULL
+// counts and the textual minimum and maximum.
+func writeTableStats(w io.Writer, stats *TableStats) error {
+	if stats == nil {
+		return binary.Write(w, binary.LittleEndian, uint8(0))
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint8(1)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(stats.Rows)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(stats.Columns))); err != nil {
+		return err
+	}
+	for _, cs := range stats.Columns {
+		if err := writeString(w, cs.Name); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint64(cs.Distinct)); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint64(cs.Nulls)); err != nil {
+			return err
+		}
+		var flags uint8
+		if cs.Min != nil {
+			flags |= 1
+		}
+		if err := binary.Write(w, binary.LittleEndian, flags); err != nil {
+			return err
+		}
+		if cs.Min == nil {
+			continue
+		}
+		if err := writeString(w, fmt.Sprint(cs.Min)); err != nil {
+			return err
+		}
+		if err := writeString(w, fmt.Sprint(cs.Max)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// readTableStats reads the statistics written by writeTableStats, parsing
+// the minimum and maximum into the types of the matching columns. Entries
+// for columns that no longer exist are dropped.
+func readTableStats(r io.Reader, columns []Column) (*TableStats, error) {
+	var present uint8
+	if err := binary.Read(r, binary.LittleEndian, &present); err != nil {
+		return nil, err
+	}
+	if present == 0 {
+		return nil, nil
+	}
+	var rows uint64
+	if err := binary.Read(r, binary.LittleEndian, &rows); err != nil {
+		return nil, err
+	}
+	var count uint16
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	stats := &TableStats{Rows: int(rows)}
+	for i := 0; i < int(count); i++ {
+		name, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		var distinct, nulls uint64
+		if err := binary.Read(r, binary.LittleEndian, &distinct); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &nulls); err != nil {
+			return nil, err
+		}
+		var flags uint8
+		if err := binary.Read(r, binary.LittleEndian, &flags); err != nil {
+			return nil, err
+		}
+		var col *Column
+		for j := range columns {
+			if columns[j].Name == name {
+				col = &columns[j]
+				break
+			}
+		}
+		cs := ColumnStats{Name: name, Distinct: int(distinct), Nulls: int(nulls)}
+		if flags&1 != 0 {
+			var bounds [2]interface{}
+			for j := range bounds {
+				raw, err := readString(r)
+				if err != nil {
+					return nil, err
+				}
+				bounds[j] = raw
+				if col == nil {
+					continue
+				}
+				if v, err := parseValue(raw, col.Type); err == nil {
+					bounds[j] = v
+				}
+			}
+			cs.Min, cs.Max = bounds[0], bounds[1]
+		}
+		if col != nil {
+			stats.Columns = append(stats.Columns, cs)
+		}
+	}
+	return stats, nil
+}
+
+func writeString(w io.Writer, s string) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte(s))
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
 func readTableV1(r io.Reader) (*Table, error) {
 	// READ: Table name
 	var nameLen uint8
@@ -367,11 +839,23 @@ func readTableV2(r io.Reader) (*Table, error) {
 	}, nil
 }
 
-func readTableV3(r io.Reader) (*Table, error) {
+// readTable reads a table stored in format v3 or later. Sections added in
+// later versions are only read when the file version contains them.
+func readTable(r byteReader, version uint8) (_ *Table, err error) {
 	var nameLen uint16
 	if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
 		return nil, err
 	}
+	var table *Table
+	defer func() {
+		// Only the start of a table may end the file.
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil && table != nil {
+			table.release()
+		}
+	}()
 	nameBytes := make([]byte, nameLen)
 	if _, err := io.ReadFull(r, nameBytes); err != nil {
 		return nil, err
@@ -400,7 +884,23 @@ func readTableV3(r io.Reader) (*Table, error) {
 		if _, err := io.ReadFull(r, typeBytes); err != nil {
 			return nil, err
 		}
-		columns = append(columns, Column{Name: string(colBytes), Type: ColumnType(string(typeBytes))})
+		column := Column{Name: string(colBytes), Type: ColumnType(string(typeBytes))}
+		if version >= 5 {
+			opts, err := readOptions(r)
+			if err != nil {
+				return nil, err
+			}
+			for _, opt := range opts {
+				applyColumnOption(&column, opt)
+			}
+		}
+		columns = append(columns, column)
+	}
+	var tableOpts []option
+	if version >= 9 {
+		if tableOpts, err = readOptions(r); err != nil {
+			return nil, err
+		}
 	}
 
 	var rowCount uint64
@@ -411,9 +911,44 @@ func readTableV3(r io.Reader) (*Table, error) {
 		return nil, fmt.Errorf("row count %d exceeds limit", rowCount)
 	}
 
-	rows := make([]Row, 0, rowCount)
+	table = &Table{Name: tableName, Columns: columns}
+	for _, opt := range tableOpts {
+		applyTableOption(table, opt)
+	}
+	if err := table.compileChecks(); err != nil {
+		return nil, err
+	}
+	if err := table.setStorage(table.Storage); err != nil {
+		return nil, err
+	}
+	// Rows read straight from a data file are stored as pages use them, so
+	// a complete page is left where it is rather than spilled.
+	cr, _ := r.(*countingReader)
+	if table.pages == nil || cr == nil || cr.src == nil {
+		cr = nil
+	}
+	var start int64
 	for i := 0; i < int(rowCount); i++ {
 		row := make(Row, 0, colCount)
+		if version >= 8 {
+			if cr != nil && i%pageRows == 0 {
+				start = cr.off
+			}
+			for j := 0; j < int(colCount); j++ {
+				v, err := readValue(r, columns[j].Type)
+				if err != nil {
+					return nil, err
+				}
+				row = append(row, v)
+			}
+			if _, err := table.appendRow(row); err != nil {
+				return nil, err
+			}
+			if cr != nil && (i%pageRows == pageRows-1 || i == int(rowCount)-1) {
+				table.pages.attach(cr.src, start, cr.off-start)
+			}
+			continue
+		}
 		for j := 0; j < int(colCount); j++ {
 			var valLen uint32
 			if err := binary.Read(r, binary.LittleEndian, &valLen); err != nil {
@@ -423,6 +958,10 @@ func readTableV3(r io.Reader) (*Table, error) {
 			if _, err := io.ReadFull(r, valBytes); err != nil {
 				return nil, err
 			}
+			if columns[j].Type == TypeBlob {
+				row = append(row, Blob(valBytes))
+				continue
+			}
 			valStr := string(valBytes)
 			parsed, err := parseValue(valStr, columns[j].Type)
 			if err != nil {
@@ -431,8 +970,35 @@ func readTableV3(r io.Reader) (*Table, error) {
 				row = append(row, parsed)
 			}
 		}
-		rows = append(rows, row)
+		if _, err := table.appendRow(row); err != nil {
+			return nil, err
+		}
 	}
 
-	return &Table{Name: tableName, Columns: columns, Rows: rows}, nil
+	if version >= 4 {
+		defs, err := readIndexDefs(r, version)
+		if err != nil {
+			return nil, err
+		}
+		for _, def := range defs {
+			if err := table.createIndex(def.columns, def.unique); err != nil {
+				return nil, fmt.Errorf("rebuilding index on %s(%s): %w", tableName, indexName(def.columns), err)
+			}
+		}
+		for _, c := range columns {
+			if (c.PrimaryKey || c.Unique || c.References != nil) && table.Indexes[c.Name] == nil {
+				if err := table.createIndex([]string{c.Name}, c.PrimaryKey || c.Unique); err != nil {
+					return nil, fmt.Errorf("rebuilding index on %s(%s): %w", tableName, c.Name, err)
+				}
+			}
+		}
+	}
+	if version >= 7 {
+		stats, err := readTableStats(r, columns)
+		if err != nil {
+			return nil, err
+		}
+		table.Stats = stats
+	}
+	return table, nil
 }
@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// sourceProgressEvery is the number of statements between progress reports
+// of LoadSQLFile.
+const sourceProgressEvery = 1000
+
+// LoadSQLFile executes the statements of a SQL file, such as a dump written
+// by SaveSQLDump, in a single transaction. Statements end with ';' and may
+// span lines; lines starting with "--" are comments. If progress is not nil
+// it is called with the number of statements executed every
+// sourceProgressEvery statements. On error nothing is applied and the
+// error names the line the failing statement starts on.
+func LoadSQLFile(path string, progress func(statements int)) (int, error) {
+	if txCtx != nil {
+		return 0, errors.New("SOURCE cannot run inside a transaction")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	tx := BeginTx()
+	n := 0
+	err = scanStatements(f, func(line int, stmt string) error {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		n++
+		if progress != nil && n%sourceProgressEvery == 0 {
+			progress(n)
+		}
+		return nil
+	})
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// scanStatements calls fn with each statement of r and the line it starts
+// on. A ';' or "--" inside a string literal does not end the statement.
+func scanStatements(r io.Reader, fn func(line int, stmt string) error) error {
+	br := bufio.NewReader(r)
+	var (
+		stmt    strings.Builder
+		inQuote bool
+		line    int
+		start   int // line of the first character of stmt, 0 while empty
+	)
+	emit := func() error {
+		s := strings.TrimSpace(stmt.String())
+		stmt.Reset()
+		first := start
+		start = 0
+		if s == "" {
+			return nil
+		}
+		return fn(first, s)
+	}
+	for {
+		text, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if text == "" && err == io.EOF {
+			break
+		}
+		line++
+		seg := 0
+	scan:
+		for i := 0; i < len(text); i++ {
+			ch := text[i]
+			switch {
+			case ch == '\'':
+				inQuote = !inQuote
+			case inQuote:
+			case ch == '-' && strings.HasPrefix(text[i:], "--"):
+				text = text[:i]
+				break scan
+			case ch == ';':
+				stmt.WriteString(text[seg:i])
+				if err := emit(); err != nil {
+					return err
+				}
+				seg = i + 1
+				continue
+			}
+			if start == 0 && ch != ' ' && ch != '\t' && ch != '\r' && ch != '\n' {
+				start = line
+			}
+		}
+		stmt.WriteString(text[seg:])
+		if err == io.EOF {
+			break
+		}
+	}
+	if inQuote {
+		return fmt.Errorf("line %d: unterminated string literal", start)
+	}
+	return emit()
+}
+
+func handleSource(query string) (string, error) {
+	fields := strings.Fields(query)
+	if len(fields) < 2 {
+		return "", errors.New("invalid SOURCE syntax")
+	}
+	path := unquote(strings.TrimSpace(strings.TrimSpace(query)[len(fields[0]):]))
+	n, err := LoadSQLFile(path, nil)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d statements executed from %s.", n, path), nil
+}
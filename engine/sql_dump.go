@@ -1,36 +1,280 @@
 package engine
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// dumpBatchRows is the default number of rows per INSERT in a dump.
+const dumpBatchRows = 100
+
+// DumpOptions selects what SaveSQLDumpWith writes.
+type DumpOptions struct {
+	SchemaOnly bool     // only CREATE TABLE and CREATE INDEX statements
+	DataOnly   bool     // only INSERT statements
+	Tables     []string // tables to dump; empty dumps every table
+	BatchRows  int      // rows per INSERT; 0 means dumpBatchRows
+}
+
 // SaveSQLDump exports all tables to a SQL file.
 func SaveSQLDump(filename string) error {
-	dbMu.RLock()
-	defer dbMu.RUnlock()
+	return SaveSQLDumpWith(filename, DumpOptions{})
+}
+
+// SaveSQLDumpWith exports tables to a SQL file. Tables are written in name
+// order, except that a table follows the tables it references, and rows in
+// storage order, so dumping the same data twice gives the same file. Each
+// table gets its CREATE TABLE statement, INSERT statements of up to
+// opts.BatchRows rows, one row per line, and then its CREATE INDEX
+// statements.
+func SaveSQLDumpWith(filename string, opts DumpOptions) error {
+	if opts.SchemaOnly && opts.DataOnly {
+		return errors.New("schema-only and data-only dumps are exclusive")
+	}
+	if opts.BatchRows <= 0 {
+		opts.BatchRows = dumpBatchRows
+	}
+	if txCtx == nil {
+		dbMu.RLock()
+		defer dbMu.RUnlock()
+	}
+
+	tables := sortedTables()
+	if len(opts.Tables) > 0 {
+		tables = tables[:0]
+		for _, name := range opts.Tables {
+			t, ok := Tables[name]
+			if !ok {
+				return fmt.Errorf("table %s does not exist", name)
+			}
+			tables = append(tables, t)
+		}
+		sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+	}
+	tables = dumpOrder(tables)
 
 	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = f.Close() }()
+	w := bufio.NewWriter(f)
 
-	for _, table := range Tables {
-		if _, err := f.WriteString(buildCreateSQL(table)); err != nil {
+	for _, table := range tables {
+		table.mu.RLock()
+		err := writeTableSQL(w, table, opts)
+		table.mu.RUnlock()
+		if err != nil {
 			return err
 		}
-		for _, row := range table.Rows {
-			if _, err := f.WriteString(buildInsertSQL(table, row)); err != nil {
-				return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func writeTableSQL(w *bufio.Writer, t *Table, opts DumpOptions) error {
+	if !opts.DataOnly {
+		if _, err := w.WriteString(buildCreateSQL(t)); err != nil {
+			return err
+		}
+	}
+	if !opts.SchemaOnly {
+		b := &insertBatcher{w: w, table: t.Name, size: opts.BatchRows}
+		var (
+			updates []string
+			err     error
+		)
+		if refs := t.selfReferences(); len(refs) > 0 {
+			updates, err = writeParentsFirst(b, t, refs)
+		} else {
+			err = t.eachRow(func(_ int, row Row) bool {
+				return b.add(row) == nil
+			})
+		}
+		if err == nil {
+			err = b.close()
+		}
+		for _, u := range updates {
+			if err != nil {
+				break
 			}
+			_, err = w.WriteString(u)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !opts.DataOnly {
+		if _, err := w.WriteString(buildIndexSQL(t)); err != nil {
+			return err
 		}
 	}
-
 	return nil
 }
 
+// insertBatcher writes rows as INSERT statements of up to size rows, one
+// row per line.
+type insertBatcher struct {
+	w     *bufio.Writer
+	table string
+	size  int
+	n     int
+	err   error
+}
+
+func (b *insertBatcher) add(row Row) error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.n%b.size == 0 {
+		_, b.err = fmt.Fprintf(b.w, "INSERT INTO %s VALUES %s", b.table, buildValuesSQL(row))
+	} else {
+		_, b.err = fmt.Fprintf(b.w, ",\n  %s", buildValuesSQL(row))
+	}
+	b.n++
+	if b.err == nil && b.n%b.size == 0 {
+		_, b.err = b.w.WriteString(";\n")
+	}
+	return b.err
+}
+
+// close ends the last INSERT.
+func (b *insertBatcher) close() error {
+	if b.err == nil && b.n%b.size != 0 {
+		_, b.err = b.w.WriteString(";\n")
+	}
+	return b.err
+}
+
+// selfRef is a column of a table that references a column of the same
+// table, with the index of the referenced column.
+type selfRef struct {
+	col int
+	idx *Index
+}
+
+// selfReferences returns the columns of t that reference t itself.
+func (t *Table) selfReferences() []selfRef {
+	var refs []selfRef
+	for i, c := range t.Columns {
+		if fk := c.References; fk != nil && fk.Table == t.Name {
+			if idx := t.Indexes[fk.Column]; idx != nil {
+				refs = append(refs, selfRef{col: i, idx: idx})
+			}
+		}
+	}
+	return refs
+}
+
+// writeParentsFirst writes the rows of a table that references itself so
+// that every row follows the rows it references: an INSERT only finds the
+// rows written before it or in the same statement. Rows are otherwise kept
+// in storage order. A reference that closes a cycle is written as NULL and
+// set by one of the returned UPDATE statements, which must follow the
+// INSERTs. Only the positions of the rows being written are kept, so paged
+// rows are read one at a time.
+func writeParentsFirst(b *insertBatcher, t *Table, refs []selfRef) ([]string, error) {
+	const (
+		pending = iota
+		visiting
+		written
+	)
+	type frame struct {
+		pos      int
+		row      Row
+		next     int   // next reference to follow
+		deferred []int // columns set by UPDATE
+	}
+	state := make([]byte, t.rowCount())
+	var updates []string
+	for start := range state {
+		if state[start] != pending {
+			continue
+		}
+		row, err := t.row(start)
+		if err != nil {
+			return nil, err
+		}
+		state[start] = visiting
+		stack := []*frame{{pos: start, row: row}}
+		for len(stack) > 0 {
+			f := stack[len(stack)-1]
+			if f.next == len(refs) {
+				if len(f.deferred) > 0 {
+					u, err := t.deferredUpdate(f.row, f.deferred)
+					if err != nil {
+						return nil, err
+					}
+					updates = append(updates, u)
+					f.row = append(Row(nil), f.row...)
+					for _, c := range f.deferred {
+						f.row[c] = nil
+					}
+				}
+				if err := b.add(f.row); err != nil {
+					return nil, err
+				}
+				state[f.pos] = written
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			ref := refs[f.next]
+			f.next++
+			v := f.row[ref.col]
+			if v == nil {
+				continue
+			}
+			for _, p := range ref.idx.Lookup(v) {
+				switch {
+				case p == f.pos || state[p] == written:
+					// A row may reference itself.
+				case state[p] == visiting:
+					f.deferred = append(f.deferred, ref.col)
+				default:
+					parent, err := t.row(p)
+					if err != nil {
+						return nil, err
+					}
+					state[p] = visiting
+					stack = append(stack, &frame{pos: p, row: parent})
+				}
+			}
+		}
+	}
+	return updates, nil
+}
+
+// deferredUpdate returns the UPDATE that sets the columns cols of row
+// after it was written with them NULL. The row is found by a PRIMARY KEY
+// or UNIQUE column it does not leave NULL; a row in a cycle of references
+// always has one, since another row references it.
+func (t *Table) deferredUpdate(row Row, cols []int) (string, error) {
+	key := -1
+	for i, c := range t.Columns {
+		if (c.PrimaryKey || c.Unique) && row[i] != nil && !slices.Contains(cols, i) {
+			key = i
+			break
+		}
+	}
+	if key == -1 {
+		return "", fmt.Errorf("cannot dump a cycle of references in table %s without a key", t.Name)
+	}
+	sets := make([]string, len(cols))
+	for k, c := range cols {
+		sets[k] = t.Columns[c].Name + " = " + dumpLiteral(row[c])
+	}
+	return fmt.Sprintf("UPDATE %s SET %s WHERE %s = %s;\n",
+		t.Name, strings.Join(sets, ", "), t.Columns[key].Name, dumpLiteral(row[key])), nil
+}
+
 func buildCreateSQL(t *Table) string {
 	var b strings.Builder
 	b.WriteString("CREATE TABLE ")
@@ -40,31 +284,114 @@ func buildCreateSQL(t *Table) string {
 		b.WriteString(c.Name)
 		b.WriteString(" ")
 		b.WriteString(string(c.Type))
+		if c.PrimaryKey {
+			b.WriteString(" PRIMARY KEY")
+		}
+		if c.Unique {
+			b.WriteString(" UNIQUE")
+		}
+		if c.AutoIncrement {
+			b.WriteString(" AUTOINCREMENT")
+		}
+		if c.Default != "" {
+			b.WriteString(" DEFAULT ")
+			b.WriteString(c.Default)
+		}
+		if c.Check != "" {
+			fmt.Fprintf(&b, " CHECK (%s)", c.Check)
+		}
+		if c.References != nil {
+			b.WriteString(" ")
+			b.WriteString(c.References.String())
+		}
 		if i != len(t.Columns)-1 {
 			b.WriteString(", ")
 		}
 	}
-	b.WriteString(");\n")
+	b.WriteString(")")
+	if opts := tableOptions(t); len(opts) > 0 {
+		b.WriteString(" WITH (")
+		for i, opt := range opts {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "%s=%s", opt.key, opt.value)
+		}
+		b.WriteString(")")
+	}
+	b.WriteString(";\n")
 	return b.String()
 }
 
-func buildInsertSQL(t *Table, row Row) string {
+func buildIndexSQL(t *Table) string {
+	names := make([]string, 0, len(t.Indexes))
+	for name, idx := range t.Indexes {
+		// Indexes backing PRIMARY KEY, UNIQUE and REFERENCES columns are
+		// recreated by CREATE TABLE itself.
+		if c := t.Columns[idx.cols[0]]; len(idx.cols) == 1 && (c.PrimaryKey || c.Unique || c.References != nil && !idx.Unique) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
 	var b strings.Builder
-	b.WriteString("INSERT INTO ")
-	b.WriteString(t.Name)
-	b.WriteString(" VALUES (")
-	for i, val := range row {
-		if t.Columns[i].Type == TypeText {
-			b.WriteString("'")
-			b.WriteString(strings.ReplaceAll(fmt.Sprint(val), "'", "''"))
-			b.WriteString("'")
+	for _, name := range names {
+		idx := t.Indexes[name]
+		if idx.Unique {
+			b.WriteString("CREATE UNIQUE INDEX ON ")
 		} else {
-			b.WriteString(fmt.Sprint(val))
+			b.WriteString("CREATE INDEX ON ")
 		}
-		if i != len(row)-1 {
+		b.WriteString(t.Name)
+		b.WriteString("(")
+		b.WriteString(strings.Join(idx.Columns, ", "))
+		b.WriteString(");\n")
+	}
+	return b.String()
+}
+
+func buildInsertSQL(t *Table, row Row) string {
+	return "INSERT INTO " + t.Name + " VALUES " + buildValuesSQL(row) + ";\n"
+}
+
+// buildValuesSQL renders a row as a parenthesized list of SQL literals.
+func buildValuesSQL(row Row) string {
+	var b strings.Builder
+	b.WriteString("(")
+	for i, val := range row {
+		if i > 0 {
 			b.WriteString(", ")
 		}
+		b.WriteString(dumpLiteral(val))
 	}
-	b.WriteString(");\n")
+	b.WriteString(")")
 	return b.String()
 }
+
+// dumpLiteral renders a value as a SQL literal that parses back to the same
+// value. FLOAT values always show a fraction or an exponent.
+func dumpLiteral(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eIN") {
+			s += ".0"
+		}
+		return s
+	case bool:
+		return strconv.FormatBool(v)
+	case Decimal:
+		return v.String()
+	case Blob:
+		return "X'" + v.String() + "'"
+	default:
+		return "'" + strings.ReplaceAll(fmt.Sprint(v), "'", "''") + "'"
+	}
+}
@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TableStats holds the statistics collected by ANALYZE. They describe the
+// table at the time of the last ANALYZE and are not maintained by writes;
+// the planner uses them as fractions of the current row count.
+type TableStats struct {
+	Rows    int
+	Columns []ColumnStats
+}
+
+// ColumnStats describes the values of a single column. Min and Max are nil
+// when the column holds no non-NULL values.
+type ColumnStats struct {
+	Name     string
+	Distinct int
+	Nulls    int
+	Min      interface{}
+	Max      interface{}
+}
+
+// column returns the statistics of the named column or nil.
+func (s *TableStats) column(name string) *ColumnStats {
+	if s == nil {
+		return nil
+	}
+	for i := range s.Columns {
+		if s.Columns[i].Name == name {
+			return &s.Columns[i]
+		}
+	}
+	return nil
+}
+
+// analyze computes fresh statistics over the rows of the table. The caller
+// must hold t.mu.
+func (t *Table) analyze() (*TableStats, error) {
+	n := t.rowCount()
+	stats := &TableStats{Rows: n, Columns: make([]ColumnStats, len(t.Columns))}
+	values := make([]interface{}, 0, n)
+	for i, c := range t.Columns {
+		cs := ColumnStats{Name: c.Name}
+		values = values[:0]
+		for r := 0; r < n; r++ {
+			v, err := t.value(r, i)
+			if err != nil {
+				return nil, err
+			}
+			if v == nil {
+				cs.Nulls++
+				continue
+			}
+			values = append(values, v)
+		}
+		sort.Slice(values, func(a, b int) bool { return compareValues(values[a], values[b]) < 0 })
+		for j, v := range values {
+			if j == 0 || compareValues(v, values[j-1]) != 0 {
+				cs.Distinct++
+			}
+		}
+		if len(values) > 0 {
+			cs.Min, cs.Max = values[0], values[len(values)-1]
+		}
+		stats.Columns[i] = cs
+	}
+	return stats, nil
+}
+
+func handleAnalyze(query string) (string, error) {
+	fields := strings.Fields(query)
+	if len(fields) > 2 {
+		return "", errors.New("invalid ANALYZE syntax")
+	}
+
+	var tables []*Table
+	if txCtx == nil {
+		dbMu.RLock()
+	}
+	if len(fields) == 2 {
+		if table, ok := Tables[fields[1]]; ok {
+			tables = append(tables, table)
+		}
+	} else {
+		for _, table := range Tables {
+			tables = append(tables, table)
+		}
+	}
+	// Holding dbMu until the statistics are set keeps a backup from seeing
+	// the entry without them.
+	var err error
+	if len(fields) == 2 && len(tables) == 0 {
+		err = errors.New("table does not exist")
+	} else {
+		err = appendWAL(query)
+	}
+	if err == nil {
+		for _, table := range tables {
+			table.mu.Lock()
+			var stats *TableStats
+			if stats, err = table.analyze(); err == nil {
+				table.Stats = stats
+			}
+			table.mu.Unlock()
+			if err != nil {
+				break
+			}
+		}
+	}
+	if txCtx == nil {
+		dbMu.RUnlock()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := SaveBinaryDB(); err != nil {
+		return "", err
+	}
+	if err := clearWAL(); err != nil {
+		return "", err
+	}
+	if len(fields) == 2 {
+		return fmt.Sprintf("Table '%s' analyzed.", fields[1]), nil
+	}
+	return fmt.Sprintf("%d tables analyzed.", len(tables)), nil
+}
+
+// statsTable builds the minidb_stats system table: one row per column of
+// every analyzed table.
+func statsTable() *Table {
+	t := &Table{
+		Name: "minidb_stats",
+		Columns: []Column{
+			{Name: "table_name", Type: TypeText},
+			{Name: "column_name", Type: TypeText},
+			{Name: "row_count", Type: TypeInt},
+			{Name: "distinct_count", Type: TypeInt},
+			{Name: "null_count", Type: TypeInt},
+			{Name: "min_value", Type: TypeText},
+			{Name: "max_value", Type: TypeText},
+		},
+	}
+	for _, table := range sortedTables() {
+		table.mu.RLock()
+		stats := table.Stats
+		table.mu.RUnlock()
+		if stats == nil {
+			continue
+		}
+		for _, cs := range stats.Columns {
+			t.Rows = append(t.Rows, Row{
+				table.Name, cs.Name, stats.Rows, cs.Distinct, cs.Nulls,
+				formatValue(cs.Min), formatValue(cs.Max),
+			})
+		}
+	}
+	return t
+}
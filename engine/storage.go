@@ -0,0 +1,218 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// StorageKind selects how a table keeps its rows in memory.
+type StorageKind string
+
+const (
+	// StorageRow keeps every row as a Row in Table.Rows.
+	StorageRow StorageKind = "row"
+	// StorageColumnar keeps one typed vector per column, which saves the
+	// boxing of every value and lets scans read only the columns a query
+	// needs.
+	StorageColumnar StorageKind = "columnar"
+)
+
+func parseStorageKind(s string) (StorageKind, error) {
+	switch kind := StorageKind(strings.ToLower(s)); kind {
+	case StorageRow, StorageColumnar:
+		return kind, nil
+	default:
+		return "", fmt.Errorf("unknown storage %s", s)
+	}
+}
+
+// setStorage switches the table to the given layout, moving its rows. Row
+// tables keep their rows in buffer pool pages when BufferPoolSize is set.
+func (t *Table) setStorage(kind StorageKind) error {
+	if err := t.rebuild(kind, kind != StorageColumnar && BufferPoolSize > 0, nil); err != nil {
+		return err
+	}
+	t.Storage = kind
+	return nil
+}
+
+// rebuild moves the rows of the table whose positions are not in del into a
+// new layout of the given kind, in buffer pool pages if paged, and rebuilds
+// the indexes. Rows are moved one at a time, so paged rows are read a page
+// at a time and never have to fit in memory together. On error the table is
+// left as it was. The caller must hold t.mu.
+func (t *Table) rebuild(kind StorageKind, paged bool, del map[int]bool) error {
+	old := &Table{Columns: t.Columns, Rows: t.Rows, store: t.store, pages: t.pages}
+	trees := make(map[*Index]*btree, len(t.Indexes))
+	for _, idx := range t.Indexes {
+		trees[idx], idx.tree = idx.tree, newBTree()
+	}
+	t.Rows, t.store, t.pages = make([]Row, 0, old.rowCount()-len(del)), nil, nil
+	switch {
+	case kind == StorageColumnar:
+		t.store, t.Rows = newColumnStore(t.Columns), nil
+	case paged:
+		t.pages, t.Rows = newPagedStore(t.Columns), nil
+	}
+	var aerr error
+	err := old.eachRow(func(i int, row Row) bool {
+		if del[i] {
+			return true
+		}
+		var pos int
+		if pos, aerr = t.appendRow(row); aerr != nil {
+			return false
+		}
+		t.addToIndexes(row, pos)
+		return true
+	})
+	if err == nil {
+		err = aerr
+	}
+	if err != nil {
+		if t.pages != nil {
+			t.pages.release()
+		}
+		t.Rows, t.store, t.pages = old.Rows, old.store, old.pages
+		for idx, tree := range trees {
+			idx.tree = tree
+		}
+		return err
+	}
+	if old.pages != nil {
+		old.pages.release()
+	}
+	return nil
+}
+
+// release returns the buffer pool pages of a table that is dropped or
+// replaced. Readers that still hold the table see it empty.
+func (t *Table) release() {
+	if t.pages != nil {
+		t.mu.Lock()
+		t.pages.release()
+		t.mu.Unlock()
+	}
+}
+
+// rowCount returns the number of rows in any layout.
+func (t *Table) rowCount() int {
+	switch {
+	case t.store != nil:
+		return t.store.n
+	case t.pages != nil:
+		return t.pages.n
+	}
+	return len(t.Rows)
+}
+
+// row returns row i. Rows of a columnar table are assembled on every call,
+// so changes to the returned row are not stored. Only paged rows can fail
+// to be read.
+func (t *Table) row(i int) (Row, error) {
+	switch {
+	case t.store != nil:
+		return t.store.row(i, nil), nil
+	case t.pages != nil:
+		return t.pages.row(i)
+	}
+	return t.Rows[i], nil
+}
+
+// value returns column col of row i without assembling the row.
+func (t *Table) value(i, col int) (interface{}, error) {
+	if t.store != nil {
+		return t.store.cols[col].get(i), nil
+	}
+	row, err := t.row(i)
+	if err != nil {
+		return nil, err
+	}
+	return row[col], nil
+}
+
+// appendRow adds a row and returns its position. On error the row is not
+// added.
+func (t *Table) appendRow(row Row) (int, error) {
+	switch {
+	case t.store != nil:
+		t.store.append(row)
+	case t.pages != nil:
+		if err := t.pages.append(row); err != nil {
+			return -1, err
+		}
+	default:
+		t.Rows = append(t.Rows, row)
+	}
+	return t.rowCount() - 1, nil
+}
+
+// setRow replaces row i. On error the row is unchanged.
+func (t *Table) setRow(i int, row Row) error {
+	switch {
+	case t.store != nil:
+		t.store.set(i, row)
+	case t.pages != nil:
+		return t.pages.set(i, row)
+	default:
+		t.Rows[i] = row
+	}
+	return nil
+}
+
+// eachRow calls fn for every row in storage order until fn returns false.
+func (t *Table) eachRow(fn func(int, Row) bool) error {
+	if t.pages != nil {
+		return t.pages.each(fn)
+	}
+	for i, n := 0, t.rowCount(); i < n; i++ {
+		row, _ := t.row(i)
+		if !fn(i, row) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// removeRows deletes the rows at the positions in del. The rows that
+// follow move up. Row and columnar tables are compacted in place and the
+// index entries of the remaining rows are shifted with them, which walks
+// every row and index entry once but rebuilds nothing. Paged tables are
+// copied into new pages and their indexes rebuilt, a page at a time. The
+// caller must hold t.mu.
+func (t *Table) removeRows(del map[int]bool) error {
+	if t.pages != nil {
+		return t.rebuild(t.Storage, true, del)
+	}
+	gone := make([]int, 0, len(del))
+	for i := range del {
+		gone = append(gone, i)
+	}
+	sort.Ints(gone)
+	for _, i := range gone {
+		row, _ := t.row(i)
+		for _, idx := range t.Indexes {
+			idx.tree.Delete(idx.key(row), i)
+		}
+	}
+	if t.store != nil {
+		t.store.remove(gone)
+	} else {
+		n := 0
+		for i, row := range t.Rows {
+			if !del[i] {
+				t.Rows[n] = row
+				n++
+			}
+		}
+		clear(t.Rows[n:])
+		t.Rows = t.Rows[:n]
+	}
+	if len(gone) > 0 && gone[0] < t.rowCount() {
+		for _, idx := range t.Indexes {
+			idx.tree.mapRows(func(pos int) int { return pos - sort.SearchInts(gone, pos) })
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// systemTablePrefix is reserved for the read-only virtual tables below.
+const systemTablePrefix = "minidb_"
+
+// systemTables maps the name of every system table to the function that
+// builds a snapshot of it from the catalog. The builders run with dbMu held
+// (or inside a transaction) and lock individual tables themselves.
+var systemTables = map[string]func() *Table{
+	"minidb_tables":  tablesTable,
+	"minidb_columns": columnsTable,
+	"minidb_indexes": indexesTable,
+	"minidb_stats":   statsTable,
+}
+
+// lookupTable resolves the table a query reads from: a user table or a
+// freshly built system table. The caller must hold dbMu unless a
+// transaction is active.
+func lookupTable(name string) (table *Table, system bool, ok bool) {
+	if build, ok := systemTables[name]; ok {
+		return build(), true, true
+	}
+	table, ok = Tables[name]
+	return table, false, ok
+}
+
+// isReservedTableName reports whether name may not be used for a user table.
+func isReservedTableName(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), systemTablePrefix)
+}
+
+// sortedTables returns the user tables ordered by name. The caller must hold
+// dbMu unless a transaction is active.
+func sortedTables() []*Table {
+	tables := make([]*Table, 0, len(Tables))
+	for _, t := range Tables {
+		tables = append(tables, t)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+	return tables
+}
+
+// tablesTable builds minidb_tables: one row per user table.
+func tablesTable() *Table {
+	t := &Table{
+		Name: "minidb_tables",
+		Columns: []Column{
+			{Name: "table_name", Type: TypeText},
+			{Name: "column_count", Type: TypeInt},
+			{Name: "row_count", Type: TypeInt},
+			{Name: "index_count", Type: TypeInt},
+			{Name: "storage", Type: TypeText},
+		},
+	}
+	for _, table := range sortedTables() {
+		storage := table.Storage
+		if storage == "" {
+			storage = StorageRow
+		}
+		table.mu.RLock()
+		t.Rows = append(t.Rows, Row{table.Name, len(table.Columns), table.rowCount(), len(table.Indexes), string(storage)})
+		table.mu.RUnlock()
+	}
+	return t
+}
+
+// columnsTable builds minidb_columns: one row per column of every user
+// table, in declaration order. Constraints a column does not have are NULL.
+func columnsTable() *Table {
+	t := &Table{
+		Name: "minidb_columns",
+		Columns: []Column{
+			{Name: "table_name", Type: TypeText},
+			{Name: "column_name", Type: TypeText},
+			{Name: "position", Type: TypeInt},
+			{Name: "type", Type: TypeText},
+			{Name: "primary_key", Type: TypeBool},
+			{Name: "unique", Type: TypeBool},
+			{Name: "autoincrement", Type: TypeBool},
+			{Name: "default_value", Type: TypeText},
+			{Name: "check_condition", Type: TypeText},
+			{Name: "references", Type: TypeText},
+			{Name: "on_delete", Type: TypeText},
+		},
+	}
+	orNull := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+	for _, table := range sortedTables() {
+		table.mu.RLock()
+		for i, c := range table.Columns {
+			var ref, onDelete interface{}
+			if fk := c.References; fk != nil {
+				ref, onDelete = fmt.Sprintf("%s(%s)", fk.Table, fk.Column), fk.OnDelete
+			}
+			t.Rows = append(t.Rows, Row{table.Name, c.Name, i + 1, string(c.Type), c.PrimaryKey, c.Unique,
+				c.AutoIncrement, orNull(c.Default), orNull(c.Check), ref, onDelete})
+		}
+		table.mu.RUnlock()
+	}
+	return t
+}
+
+// indexesTable builds minidb_indexes: one row per index of every user table,
+// including the indexes backing PRIMARY KEY and UNIQUE columns.
+func indexesTable() *Table {
+	t := &Table{
+		Name: "minidb_indexes",
+		Columns: []Column{
+			{Name: "table_name", Type: TypeText},
+			{Name: "index_name", Type: TypeText},
+			{Name: "columns", Type: TypeText},
+			{Name: "unique", Type: TypeBool},
+		},
+	}
+	for _, table := range sortedTables() {
+		table.mu.RLock()
+		names := make([]string, 0, len(table.Indexes))
+		for name := range table.Indexes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			idx := table.Indexes[name]
+			t.Rows = append(t.Rows, Row{table.Name, name, strings.Join(idx.Columns, ", "), idx.Unique})
+		}
+		table.mu.RUnlock()
+	}
+	return t
+}
+
+// handleShow answers SHOW TABLES from minidb_tables.
+func handleShow(query string) (string, error) {
+	fields := strings.Fields(query)
+	if len(fields) != 2 || strings.ToUpper(fields[1]) != "TABLES" {
+		return "", errors.New("invalid SHOW syntax")
+	}
+	return handleSelect("SELECT table_name FROM minidb_tables")
+}
+
+// handleDescribe lists the columns of a table from minidb_columns.
+func handleDescribe(query string) (string, error) {
+	fields := strings.Fields(query)
+	if len(fields) != 2 {
+		return "", errors.New("invalid DESCRIBE syntax")
+	}
+	name := fields[1]
+
+	if txCtx == nil {
+		dbMu.RLock()
+	}
+	_, exists := Tables[name]
+	if txCtx == nil {
+		dbMu.RUnlock()
+	}
+	if !exists {
+		return "", errors.New("table does not exist")
+	}
+	return handleSelect(fmt.Sprintf("SELECT column_name, type, primary_key, unique, autoincrement, default_value, check_condition, references, on_delete FROM minidb_columns WHERE table_name = %s", sqlLiteral(name)))
+}
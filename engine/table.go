@@ -11,24 +11,147 @@ import (
 type ColumnType string
 
 const (
-	TypeInt   ColumnType = "INT"
-	TypeText  ColumnType = "TEXT"
-	TypeFloat ColumnType = "FLOAT"
-	TypeBool  ColumnType = "BOOL"
+	TypeInt       ColumnType = "INT"
+	TypeText      ColumnType = "TEXT"
+	TypeFloat     ColumnType = "FLOAT"
+	TypeBool      ColumnType = "BOOL"
+	TypeBigInt    ColumnType = "BIGINT"
+	TypeTimestamp ColumnType = "TIMESTAMP"
+	TypeDate      ColumnType = "DATE"
+	TypeBlob      ColumnType = "BLOB"
+	// TypeDecimal is stored with its precision and scale, e.g. DECIMAL(10,2).
+	TypeDecimal ColumnType = "DECIMAL"
 )
 
+// Base returns the type without its parameters: DECIMAL for DECIMAL(10,2).
+func (ct ColumnType) Base() ColumnType {
+	if i := strings.IndexByte(string(ct), '('); i != -1 {
+		return ct[:i]
+	}
+	return ct
+}
+
+// decimalSpec returns the precision and scale of a DECIMAL type.
+func (ct ColumnType) decimalSpec() (precision, scale int) {
+	precision = maxDecimalPrecision
+	open := strings.IndexByte(string(ct), '(')
+	if open == -1 {
+		return precision, 0
+	}
+	params := strings.Split(strings.TrimSuffix(string(ct[open+1:]), ")"), ",")
+	precision, _ = strconv.Atoi(params[0])
+	if len(params) > 1 {
+		scale, _ = strconv.Atoi(params[1])
+	}
+	return precision, scale
+}
+
+// parseColumnType validates a type name from CREATE TABLE and returns it in
+// canonical form.
+func parseColumnType(s string) (ColumnType, error) {
+	ct := ColumnType(strings.ToUpper(strings.ReplaceAll(s, " ", "")))
+	switch ct.Base() {
+	case TypeInt, TypeText, TypeFloat, TypeBool, TypeBigInt, TypeTimestamp, TypeDate, TypeBlob:
+		if ct != ct.Base() {
+			return "", fmt.Errorf("type %s takes no parameters", ct.Base())
+		}
+		return ct, nil
+	case TypeDecimal:
+		if ct == TypeDecimal {
+			return TypeDecimal, nil
+		}
+		if !strings.HasSuffix(string(ct), ")") {
+			return "", fmt.Errorf("invalid type %s", s)
+		}
+		params := strings.Split(string(ct[len(TypeDecimal)+1:len(ct)-1]), ",")
+		if len(params) > 2 {
+			return "", fmt.Errorf("invalid type %s", s)
+		}
+		precision, err := strconv.Atoi(params[0])
+		if err != nil || precision < 1 || precision > maxDecimalPrecision {
+			return "", fmt.Errorf("DECIMAL precision must be between 1 and %d", maxDecimalPrecision)
+		}
+		scale := 0
+		if len(params) == 2 {
+			scale, err = strconv.Atoi(params[1])
+			if err != nil || scale < 0 || scale > precision {
+				return "", errors.New("DECIMAL scale must be between 0 and the precision")
+			}
+		}
+		return ColumnType(fmt.Sprintf("DECIMAL(%d,%d)", precision, scale)), nil
+	default:
+		return "", fmt.Errorf("unknown column type %s", s)
+	}
+}
+
 type Column struct {
-	Name string
-	Type ColumnType
+	Name       string
+	Type       ColumnType
+	PrimaryKey bool
+	Unique     bool
+	Default    string // literal of the DEFAULT clause as written, "" for none
+	Check      string // condition of the CHECK clause, "" for none
+	References *ForeignKey
+	// AutoIncrement assigns the next value of Table.Sequence to rows
+	// inserted without a value for the column.
+	AutoIncrement bool
 }
 
-// Index stores mapping from column values to row indexes for quick lookup.
+// ErrConstraint is wrapped by errors returned when a statement would violate
+// a PRIMARY KEY, UNIQUE, CHECK or REFERENCES constraint.
+var ErrConstraint = errors.New("constraint violation")
+
+// Index keeps row positions ordered by the values of the indexed columns so
+// that it can serve equality lookups, range scans and ordered iteration.
+// Composite indexes use tuples of the column values as keys. A unique index
+// rejects rows that would duplicate an existing key.
 type Index struct {
-	Column string
-	idx    int
-	Values map[interface{}][]int
+	Columns []string
+	Unique  bool
+	cols    []int
+	tree    *btree
+}
+
+// Name returns the key of the index in Table.Indexes: the indexed column
+// names joined with commas.
+func (i *Index) Name() string { return indexName(i.Columns) }
+
+// Lookup returns the positions of rows whose indexed columns equal values.
+func (i *Index) Lookup(values ...interface{}) []int {
+	return i.tree.Get(i.keyOf(values))
 }
 
+func (i *Index) key(row Row) interface{} {
+	if len(i.cols) == 1 {
+		return row[i.cols[0]]
+	}
+	k := make(tuple, len(i.cols))
+	for j, c := range i.cols {
+		k[j] = row[c]
+	}
+	return k
+}
+
+// hasNull reports whether row holds NULL in an indexed column. NULL equals
+// nothing, so such a row never conflicts under a unique index.
+func (i *Index) hasNull(row Row) bool {
+	for _, c := range i.cols {
+		if row[c] == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Index) keyOf(values []interface{}) interface{} {
+	if len(i.cols) == 1 && len(values) == 1 {
+		return values[0]
+	}
+	return tuple(values)
+}
+
+func indexName(columns []string) string { return strings.Join(columns, ",") }
+
 type Row []interface{}
 
 type Table struct {
@@ -37,11 +160,26 @@ type Table struct {
 	Rows    []Row
 	mu      sync.RWMutex
 	Indexes map[string]*Index
+	Stats   *TableStats
+	// Storage is the in-memory layout; empty means StorageRow. Columnar
+	// tables keep their rows in store and paged row tables in pages; both
+	// leave Rows nil.
+	Storage StorageKind
+	store   *columnStore
+	pages   *pagedStore
+	// Sequence is the last value assigned to the AUTOINCREMENT column.
+	Sequence int64
+	// checks holds the CHECK clauses of Columns, compiled once the table
+	// is created or loaded.
+	checks []checkConstraint
 }
 
 var Tables = make(map[string]*Table)
 
 func Init() error {
+	if err := loadKeyFromEnv(); err != nil {
+		return err
+	}
 	if err := LoadBinaryDB(); err != nil {
 		return err
 	}
@@ -50,57 +188,120 @@ func Init() error {
 
 func HandleCommand(query string) (string, error) {
 	query = strings.TrimSpace(query)
+	handler := commandHandler(query)
+	if handler == nil {
+		return "", errors.New("unsupported command")
+	}
+	return handler(query)
+}
+
+// commandHandler returns the handler for the statement in query, or nil if
+// the statement is not supported.
+func commandHandler(query string) func(string) (string, error) {
 	queryUpper := strings.ToUpper(query)
 
 	switch {
 	case strings.HasPrefix(queryUpper, "CREATE TABLE"):
-		return handleCreateTable(query)
-	case strings.HasPrefix(queryUpper, "CREATE INDEX"):
-		return handleCreateIndex(query)
+		return handleCreateTable
+	case strings.HasPrefix(queryUpper, "CREATE INDEX"),
+		strings.HasPrefix(queryUpper, "CREATE UNIQUE INDEX"):
+		return handleCreateIndex
 	case strings.HasPrefix(queryUpper, "INSERT INTO"):
-		return handleInsert(query)
+		return handleInsert
 	case strings.HasPrefix(queryUpper, "UPDATE"):
-		return handleUpdate(query)
+		return handleUpdate
+	case strings.HasPrefix(queryUpper, "DELETE"):
+		return handleDelete
 	case strings.HasPrefix(queryUpper, "SELECT"):
-		return handleSelect(query)
+		return handleSelect
+	case strings.HasPrefix(queryUpper, "EXPLAIN"):
+		return handleExplain
+	case strings.HasPrefix(queryUpper, "ANALYZE"):
+		return handleAnalyze
+	case strings.HasPrefix(queryUpper, "SHOW"):
+		return handleShow
+	case strings.HasPrefix(queryUpper, "DESCRIBE"):
+		return handleDescribe
+	case strings.HasPrefix(queryUpper, "VERIFY"):
+		return handleVerify
+	case strings.HasPrefix(queryUpper, "ROTATE"):
+		return handleRotate
+	case strings.HasPrefix(queryUpper, "BACKUP"):
+		return handleBackup
+	case strings.HasPrefix(queryUpper, "COPY"):
+		return handleCopy
+	case strings.HasPrefix(queryUpper, "SOURCE"):
+		return handleSource
 	case strings.HasPrefix(queryUpper, "DUMP"):
-		return handleDump(query)
+		return handleDump
 	default:
-		return "", errors.New("unsupported command")
+		return nil
 	}
 }
 
-func handleCreateTable(query string) (string, error) {
-	if err := appendWAL(query); err != nil {
-		return "", err
+// FileStatement reports whether query reads or writes a file it names,
+// such as BACKUP TO, COPY, DUMP and SOURCE, or rewrites the data file
+// under a new key (ROTATE KEY). Servers taking statements from the network
+// reject these.
+func FileStatement(query string) bool {
+	queryUpper := strings.ToUpper(strings.TrimSpace(query))
+	for _, prefix := range []string{"BACKUP", "COPY", "DUMP", "ROTATE", "SOURCE"} {
+		if strings.HasPrefix(queryUpper, prefix) {
+			return true
+		}
 	}
+	return false
+}
+
+func handleCreateTable(query string) (string, error) {
 	open := strings.Index(query, "(")
-	close := strings.Index(query, ")")
+	close := -1
+	if open != -1 {
+		close = matchingParen(query, open)
+	}
 
-	if open == -1 || close == -1 || open > close {
+	if open == -1 || close == -1 {
 		return "", errors.New("invalid syntax for CREATE TABLE")
 	}
+	opts, err := parseTableOptions(query[close+1:])
+	if err != nil {
+		return "", err
+	}
 
 	header := strings.TrimSpace(query[12:open])
-	cols := strings.Split(query[open+1:close], ",")
+	if isReservedTableName(header) {
+		return "", fmt.Errorf("table name %s is reserved for system tables", header)
+	}
+	cols := splitTopLevel(query[open+1:close], ',')
 
 	var columns []Column
+	hasPrimaryKey, hasAutoIncrement := false, false
 	for _, col := range cols {
-		parts := strings.Fields(strings.TrimSpace(col))
-		if len(parts) == 0 {
+		if strings.TrimSpace(col) == "" {
 			continue
 		}
-		name := parts[0]
-		colType := ColumnType("TEXT")
-		if len(parts) > 1 {
-			colType = ColumnType(strings.ToUpper(parts[1]))
+		column, err := parseColumnDef(col)
+		if err != nil {
+			return "", err
+		}
+		if column.PrimaryKey {
+			if hasPrimaryKey {
+				return "", errors.New("multiple PRIMARY KEY columns are not supported")
+			}
+			hasPrimaryKey = true
 		}
-		switch colType {
-		case TypeInt, TypeText, TypeFloat, TypeBool:
-		default:
-			return "", fmt.Errorf("unknown column type %s", colType)
+		if column.AutoIncrement {
+			switch {
+			case hasAutoIncrement:
+				return "", errors.New("multiple AUTOINCREMENT columns are not supported")
+			case column.Type != TypeInt && column.Type != TypeBigInt:
+				return "", fmt.Errorf("AUTOINCREMENT column %s must be INT or BIGINT", column.Name)
+			case column.Default != "":
+				return "", fmt.Errorf("AUTOINCREMENT column %s cannot have a DEFAULT", column.Name)
+			}
+			hasAutoIncrement = true
 		}
-		columns = append(columns, Column{Name: name, Type: colType})
+		columns = append(columns, column)
 	}
 
 	table := &Table{
@@ -108,14 +309,65 @@ func handleCreateTable(query string) (string, error) {
 		Columns: columns,
 		Rows:    []Row{},
 	}
+	for _, opt := range opts {
+		applyTableOption(table, opt)
+	}
+	for _, c := range columns {
+		v, err := c.defaultValue()
+		if err != nil {
+			return "", err
+		}
+		if v == nil && c.PrimaryKey && c.Default != "" {
+			return "", fmt.Errorf("PRIMARY KEY column %s cannot default to NULL", c.Name)
+		}
+	}
+	if err := table.compileChecks(); err != nil {
+		return "", err
+	}
+	if err := table.setStorage(table.Storage); err != nil {
+		return "", err
+	}
+	for _, c := range columns {
+		if c.PrimaryKey || c.Unique {
+			if err := table.createIndex([]string{c.Name}, true); err != nil {
+				return "", err
+			}
+		}
+	}
+	// Deleting or changing a referenced row finds the rows that reference
+	// it through an index on the referencing column.
+	for _, c := range columns {
+		if c.References != nil && table.Indexes[c.Name] == nil {
+			if err := table.createIndex([]string{c.Name}, false); err != nil {
+				return "", err
+			}
+		}
+	}
 
-	if txCtx != nil {
-		Tables[header] = table
-	} else {
+	// The entry is written under the lock so that a backup never sees it
+	// without the table.
+	if txCtx == nil {
 		dbMu.Lock()
-		Tables[header] = table
+	}
+	err = table.checkForeignKeys()
+	if err == nil {
+		err = appendWAL(query)
+	}
+	if err != nil {
+		if txCtx == nil {
+			dbMu.Unlock()
+		}
+		table.release()
+		return "", err
+	}
+	if old := Tables[header]; old != nil {
+		old.release()
+	}
+	Tables[header] = table
+	if txCtx == nil {
 		dbMu.Unlock()
 	}
+	resultCache.InvalidateTable(header)
 
 	returnMsg := fmt.Sprintf("Table '%s' created.", header)
 
@@ -130,17 +382,24 @@ func handleCreateTable(query string) (string, error) {
 
 func handleCreateIndex(query string) (string, error) {
 	parts := strings.Fields(query)
+	unique := len(parts) > 1 && strings.ToUpper(parts[1]) == "UNIQUE"
+	if unique {
+		parts = append(parts[:1], parts[2:]...)
+	}
 	if len(parts) < 4 || strings.ToUpper(parts[1]) != "INDEX" || strings.ToUpper(parts[2]) != "ON" {
 		return "", errors.New("invalid CREATE INDEX syntax")
 	}
-	tableName := parts[3]
-	colRaw := parts[len(parts)-1]
-	open := strings.Index(colRaw, "(")
-	close := strings.Index(colRaw, ")")
+	target := strings.Join(parts[3:], " ")
+	open := strings.Index(target, "(")
+	close := strings.Index(target, ")")
 	if open == -1 || close == -1 || close <= open {
 		return "", errors.New("invalid CREATE INDEX syntax")
 	}
-	colName := colRaw[open+1 : close]
+	tableName := strings.TrimSpace(target[:open])
+	var columns []string
+	for _, c := range strings.Split(target[open+1:close], ",") {
+		columns = append(columns, strings.TrimSpace(c))
+	}
 
 	var table *Table
 	var exists bool
@@ -156,38 +415,79 @@ func handleCreateIndex(query string) (string, error) {
 	}
 
 	table.mu.Lock()
-	err := table.createIndex(colName)
+	idx, err := table.buildIndex(columns, unique)
+	if err == nil {
+		err = appendWAL(query)
+	}
+	if err == nil {
+		if table.Indexes == nil {
+			table.Indexes = make(map[string]*Index)
+		}
+		table.Indexes[idx.Name()] = idx
+		resultCache.InvalidateTable(table.Name)
+	}
 	table.mu.Unlock()
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("Index on %s created.", colName), nil
-}
 
-func handleInsert(query string) (string, error) {
-	if err := appendWAL(query); err != nil {
+	if err := SaveBinaryDB(); err != nil {
 		return "", err
 	}
-	queryUpper := strings.ToUpper(query)
-	valuesIdx := strings.Index(queryUpper, "VALUES")
-	if valuesIdx == -1 {
-		return "", errors.New("invalid syntax for INSERT")
+	if err := clearWAL(); err != nil {
+		return "", err
 	}
+	return fmt.Sprintf("Index on %s created.", strings.Join(columns, ", ")), nil
+}
+
+// handleInsert handles INSERT INTO t [(col, ...)] VALUES (...), ... and
+// INSERT INTO t [(col, ...)] SELECT .... All rows are inserted as one change
+// logged by the statement itself; columns left out get their default.
+func handleInsert(query string) (string, error) {
+	res, err := execInsert(query)
+	return res.Message, err
+}
 
-	intoPart := strings.Fields(query[:valuesIdx])
-	if len(intoPart) < 3 {
-		return "", errors.New("invalid INSERT INTO syntax")
+// execInsert runs an INSERT and reports the rows it inserted or updated.
+func execInsert(query string) (Result, error) {
+	rest := strings.TrimSpace(query)
+	if len(rest) < len("INSERT INTO") {
+		return Result{}, errors.New("invalid INSERT INTO syntax")
+	}
+	rest = strings.TrimSpace(rest[len("INSERT INTO"):])
+	end := strings.IndexAny(rest, " \t\r\n(")
+	if end == -1 {
+		return Result{}, errors.New("invalid syntax for INSERT")
 	}
-	tableName := intoPart[2]
+	tableName := rest[:end]
+	rest = strings.TrimSpace(rest[end:])
 
-	valuesRaw := strings.TrimSpace(query[valuesIdx+len("VALUES"):])
-	open := strings.Index(valuesRaw, "(")
-	close := strings.Index(valuesRaw, ")")
-	if open == -1 || close == -1 || open > close {
-		return "", errors.New("invalid VALUES syntax")
+	var names []string
+	if strings.HasPrefix(rest, "(") {
+		close := matchingParen(rest, 0)
+		if close == -1 {
+			return Result{}, errors.New("invalid INSERT column list")
+		}
+		for _, name := range strings.Split(rest[1:close], ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
+		rest = strings.TrimSpace(rest[close+1:])
 	}
 
-	vals := strings.Split(valuesRaw[open+1:close], ",")
+	rest, conflictRaw, hasConflict := splitOnConflict(rest)
+	var tuples [][]string
+	var selectQuery string
+	switch upper := strings.ToUpper(rest); {
+	case keywordIndex(upper, "VALUES") == 0:
+		var err error
+		if tuples, err = splitTuples(rest[len("VALUES"):]); err != nil {
+			return Result{}, err
+		}
+	case keywordIndex(upper, "SELECT") == 0:
+		selectQuery = rest
+	default:
+		return Result{}, errors.New("invalid syntax for INSERT")
+	}
 
 	var table *Table
 	var exists bool
@@ -199,198 +499,310 @@ func handleInsert(query string) (string, error) {
 		dbMu.RUnlock()
 	}
 	if !exists {
-		return "", errors.New("table does not exist")
+		return Result{}, errors.New("table does not exist")
 	}
-
-	var row Row
-	for i, v := range vals {
-		val := strings.Trim(strings.TrimSpace(v), "'")
-		if i >= len(table.Columns) {
-			return "", errors.New("columns count does not match")
-		}
-		parsed, err := parseValue(val, table.Columns[i].Type)
-		if err != nil {
-			return "", fmt.Errorf("invalid %s value for column %s", table.Columns[i].Type, table.Columns[i].Name)
+	cols, err := table.insertColumns(names)
+	if err != nil {
+		return Result{}, err
+	}
+	var conflict *onConflict
+	if hasConflict {
+		if conflict, err = table.parseOnConflict(conflictRaw); err != nil {
+			return Result{}, err
 		}
-		row = append(row, parsed)
 	}
 
-	if len(row) != len(table.Columns) {
-		return "", errors.New("columns count does not match")
+	var rows []Row
+	if selectQuery != "" {
+		rows, err = table.selectRows(selectQuery, cols)
+	} else {
+		rows, err = table.parseRows(tuples, cols)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	if len(rows) == 0 {
+		return Result{Message: "0 rows inserted."}, nil
 	}
 
-	table.mu.Lock()
-	table.Rows = append(table.Rows, row)
-	idx := len(table.Rows) - 1
-	table.addToIndexes(row, idx)
-	table.mu.Unlock()
+	inserted, updated := rows, 0
+	if conflict != nil {
+		if inserted, updated, err = table.upsertRows(rows, conflict, query); err != nil {
+			return Result{}, err
+		}
+	} else {
+		// Replaying the statement would evaluate CURRENT_TIMESTAMP again,
+		// so the rows are logged as they were inserted.
+		entries := []string{query}
+		if table.hasVolatileDefault() {
+			entries = table.insertEntries(rows)
+		}
+		if k, err := table.insertRows(rows, entries...); err != nil {
+			if k >= 0 {
+				err = rowError(len(rows), k, err)
+			}
+			return Result{}, err
+		}
+	}
 
 	if err := SaveBinaryDB(); err != nil {
-		return "", err
+		return Result{}, err
 	}
 	if err := clearWAL(); err != nil {
-		return "", err
+		return Result{}, err
+	}
+	res := Result{
+		Message:      insertMessage(len(inserted), updated),
+		RowsAffected: int64(len(inserted) + updated),
 	}
-	return "1 row inserted.", nil
+	if col := table.autoIncrementColumn(); col != -1 && len(inserted) > 0 {
+		res.LastInsertID, _ = toInt64(inserted[len(inserted)-1][col])
+	}
+	return res, nil
 }
 
-func handleSelect(query string) (string, error) {
-	if res, ok := resultCache.Get(query); ok {
-		return res, nil
-	}
-	upper := strings.ToUpper(query)
-	whereIdx := strings.Index(upper, " WHERE ")
-	var whereCol string
-	var whereVal interface{}
-	if whereIdx != -1 {
-		condRaw := strings.TrimSpace(query[whereIdx+7:])
-		query = strings.TrimSpace(query[:whereIdx])
-		parts := strings.SplitN(condRaw, "=", 2)
-		if len(parts) != 2 {
-			return "", errors.New("invalid WHERE syntax")
-		}
-		whereCol = strings.TrimSpace(parts[0])
-		whereVal = strings.Trim(strings.TrimSpace(parts[1]), "'")
+// insertMessage reports the rows an INSERT inserted and, with ON CONFLICT
+// DO UPDATE, updated.
+func insertMessage(inserted, updated int) string {
+	msg := "1 row inserted"
+	if inserted != 1 {
+		msg = fmt.Sprintf("%d rows inserted", inserted)
 	}
-
-	fromIdx := strings.Index(upper, " FROM ")
-	if fromIdx == -1 {
-		return "", errors.New("invalid SELECT syntax")
+	if updated > 0 {
+		msg += fmt.Sprintf(", %d updated", updated)
 	}
-	colsRaw := strings.TrimSpace(query[6:fromIdx])
-	cols := strings.Split(colsRaw, ",")
-	for i, c := range cols {
-		cols[i] = strings.TrimSpace(c)
+	return msg + "."
+}
+
+// rowError names row k of an INSERT of n rows in err. A single row is not
+// named.
+func rowError(n, k int, err error) error {
+	if n == 1 {
+		return err
 	}
-	tableName := strings.Fields(query[fromIdx+6:])[0]
+	return fmt.Errorf("row %d: %w", k+1, err)
+}
 
-	var table *Table
-	var exists bool
-	if txCtx != nil {
-		table, exists = Tables[tableName]
-		if !exists {
-			return "", errors.New("table does not exist")
+// insertColumns resolves the column list of an INSERT to column positions.
+// No list means every column in order.
+func (t *Table) insertColumns(names []string) ([]int, error) {
+	if names == nil {
+		cols := make([]int, len(t.Columns))
+		for i := range cols {
+			cols[i] = i
 		}
-	} else {
-		dbMu.RLock()
-		table, exists = Tables[tableName]
-		if !exists {
-			dbMu.RUnlock()
-			return "", errors.New("table does not exist")
+		return cols, nil
+	}
+	cols := make([]int, len(names))
+	seen := make(map[int]bool, len(names))
+	for k, name := range names {
+		i := t.columnIndex(name)
+		if i == -1 {
+			return nil, fmt.Errorf("column %s does not exist", name)
+		}
+		if seen[i] {
+			return nil, fmt.Errorf("column %s is listed twice", name)
 		}
+		seen[i] = true
+		cols[k] = i
 	}
+	return cols, nil
+}
 
-	colIdx := make([]int, 0, len(cols))
-	if len(cols) == 1 && cols[0] == "*" {
-		for i := range table.Columns {
-			colIdx = append(colIdx, i)
+// parseRows converts the VALUES rows of an INSERT for the columns cols.
+// Columns that are not listed, or are given as DEFAULT, get their default.
+func (t *Table) parseRows(tuples [][]string, cols []int) ([]Row, error) {
+	defaults := t.defaultRow()
+	rows := make([]Row, len(tuples))
+	for k, vals := range tuples {
+		if len(vals) != len(cols) {
+			return nil, rowError(len(tuples), k, errors.New("columns count does not match"))
 		}
-		cols = make([]string, len(table.Columns))
-		for i, c := range table.Columns {
-			cols[i] = c.Name
-		}
-	} else {
-		for _, c := range cols {
-			idx := -1
-			for i, col := range table.Columns {
-				if col.Name == c {
-					idx = i
-					break
-				}
+		row := append(Row(nil), defaults...)
+		for j, v := range vals {
+			c := t.Columns[cols[j]]
+			switch strings.ToUpper(strings.TrimSpace(v)) {
+			case "NULL":
+				row[cols[j]] = nil
+				continue
+			case "DEFAULT":
+				continue
 			}
-			if idx == -1 {
-				if txCtx == nil {
-					dbMu.RUnlock()
-				}
-				return "", fmt.Errorf("unknown column %s", c)
+			parsed, err := parseValue(unquote(v), c.Type)
+			if err != nil {
+				return nil, rowError(len(tuples), k, fmt.Errorf("invalid %s value for column %s", c.Type, c.Name))
 			}
-			colIdx = append(colIdx, idx)
+			row[cols[j]] = parsed
+		}
+		if err := t.checkNotNull(row); err != nil {
+			return nil, rowError(len(tuples), k, err)
 		}
+		rows[k] = row
 	}
+	return rows, nil
+}
 
-	var whereIdxCol int
-	var whereParsed interface{}
-	if whereCol != "" {
-		idx := -1
-		for i, c := range table.Columns {
-			if c.Name == whereCol {
-				idx = i
-				break
+// selectRows runs the SELECT of an INSERT ... SELECT and converts its rows
+// for the columns cols. Values are converted through their text form, so a
+// column accepts whatever it would accept as a literal.
+func (t *Table) selectRows(query string, cols []int) ([]Row, error) {
+	res, err := selectResult(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Columns) != len(cols) {
+		return nil, errors.New("columns count does not match")
+	}
+	defaults := t.defaultRow()
+	rows := make([]Row, len(res.Rows))
+	for k, src := range res.Rows {
+		row := append(Row(nil), defaults...)
+		for j, v := range src {
+			if v == nil {
+				continue
 			}
-		}
-		if idx == -1 {
-			if txCtx == nil {
-				dbMu.RUnlock()
+			c := t.Columns[cols[j]]
+			parsed, err := parseValue(fmt.Sprint(v), c.Type)
+			if err != nil {
+				return nil, rowError(len(res.Rows), k, fmt.Errorf("invalid %s value for column %s", c.Type, c.Name))
 			}
-			return "", fmt.Errorf("unknown column %s", whereCol)
+			row[cols[j]] = parsed
 		}
-		parsed, err := parseValue(fmt.Sprint(whereVal), table.Columns[idx].Type)
-		if err != nil {
-			if txCtx == nil {
-				dbMu.RUnlock()
-			}
-			return "", fmt.Errorf("invalid %s value for column %s", table.Columns[idx].Type, whereCol)
+		if err := t.checkNotNull(row); err != nil {
+			return nil, rowError(len(res.Rows), k, err)
 		}
-		whereIdxCol = idx
-		whereParsed = parsed
+		rows[k] = row
 	}
+	return rows, nil
+}
 
-	var builder strings.Builder
-	builder.WriteString(strings.Join(cols, "\t") + "\n")
-
-	table.mu.RLock()
-	var rowIndexes []int
-	if whereCol != "" {
-		if idx, ok := table.Indexes[whereCol]; ok {
-			if rows, ok2 := idx.Values[whereParsed]; ok2 {
-				rowIndexes = append(rowIndexes, rows...)
-			}
+// checkNotNull rejects a row with NULL in a PRIMARY KEY column. NULL in an
+// AUTOINCREMENT column is replaced by the next value on insert.
+func (t *Table) checkNotNull(row Row) error {
+	for i, c := range t.Columns {
+		if c.PrimaryKey && !c.AutoIncrement && row[i] == nil {
+			return fmt.Errorf("%w: NULL value for PRIMARY KEY column %s", ErrConstraint, c.Name)
 		}
 	}
-	if rowIndexes == nil {
-		rowIndexes = make([]int, len(table.Rows))
-		for i := range table.Rows {
-			rowIndexes[i] = i
+	return nil
+}
+
+// checkUpdatedNotNull is checkNotNull for the new values of an updated row,
+// which get no AUTOINCREMENT value, so NULL is rejected in every PRIMARY KEY
+// column.
+func (t *Table) checkUpdatedNotNull(row Row) error {
+	for i, c := range t.Columns {
+		if c.PrimaryKey && row[i] == nil {
+			return fmt.Errorf("%w: NULL value for PRIMARY KEY column %s", ErrConstraint, c.Name)
 		}
 	}
-	for _, rid := range rowIndexes {
-		if rid >= len(table.Rows) {
-			continue
-		}
-		row := table.Rows[rid]
-		if whereCol != "" && row[whereIdxCol] != whereParsed {
-			continue
+	return nil
+}
+
+// splitTuples splits the list after VALUES into the values of each
+// parenthesized row.
+func splitTuples(s string) ([][]string, error) {
+	var tuples [][]string
+	for _, t := range splitTopLevel(s, ',') {
+		t = strings.TrimSpace(t)
+		if !strings.HasPrefix(t, "(") || matchingParen(t, 0) != len(t)-1 {
+			return nil, errors.New("invalid VALUES syntax")
 		}
-		strVals := make([]string, len(colIdx))
-		for i, idx := range colIdx {
-			strVals[i] = fmt.Sprint(row[idx])
+		tuples = append(tuples, splitTopLevel(t[1:len(t)-1], ','))
+	}
+	return tuples, nil
+}
+
+func handleSelect(query string) (string, error) {
+	res, err := selectResult(query)
+	if err != nil {
+		return "", err
+	}
+	return res.String(), nil
+}
+
+func selectResult(query string) (*ResultSet, error) {
+	// Results seen inside a transaction may never be committed, so they
+	// bypass the cache entirely.
+	cached := txCtx == nil
+	if cached {
+		if res, ok := resultCache.Get(query); ok {
+			return res, nil
 		}
-		builder.WriteString(strings.Join(strVals, "\t") + "\n")
 	}
-	table.mu.RUnlock()
+	stmt, err := parseSelect(query)
+	if err != nil {
+		return nil, err
+	}
+
 	if txCtx == nil {
-		dbMu.RUnlock()
+		dbMu.RLock()
+		defer dbMu.RUnlock()
+	}
+	table, system, exists := lookupTable(stmt.table)
+	if !exists {
+		return nil, errors.New("table does not exist")
+	}
+	// System tables are rebuilt on every query and never go stale in the
+	// cache, so there is no point in storing them.
+	cached = cached && !system
+
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	res, err := table.execSelect(stmt)
+	if err != nil {
+		return nil, err
 	}
 
-	res := builder.String()
-	resultCache.Add(query, res)
+	// Adding under the table lock guarantees that a concurrent write
+	// invalidates the entry after it is stored rather than before.
+	if cached {
+		resultCache.Add(query, res, table.Name)
+	}
 	return res, nil
 }
 
-func handleUpdate(query string) (string, error) {
-	if err := appendWAL(query); err != nil {
+func handleExplain(query string) (string, error) {
+	inner := strings.TrimSpace(query[len("EXPLAIN"):])
+	if !strings.HasPrefix(strings.ToUpper(inner), "SELECT") {
+		return "", errors.New("EXPLAIN supports only SELECT")
+	}
+	stmt, err := parseSelect(inner)
+	if err != nil {
 		return "", err
 	}
-	queryUpper := strings.ToUpper(query)
-	setIdx := strings.Index(queryUpper, " SET ")
+
+	if txCtx == nil {
+		dbMu.RLock()
+		defer dbMu.RUnlock()
+	}
+	table, _, exists := lookupTable(stmt.table)
+	if !exists {
+		return "", errors.New("table does not exist")
+	}
+
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	plan, err := table.planSelect(stmt)
+	if err != nil {
+		return "", err
+	}
+	return plan.explain(), nil
+}
+
+func handleUpdate(query string) (string, error) {
+	setIdx := keywordIndex(query, "SET")
 	if setIdx == -1 {
 		return "", errors.New("invalid syntax for UPDATE")
 	}
 
-	whereIdx := strings.Index(queryUpper, " WHERE ")
+	whereIdx := keywordIndex(query, "WHERE")
 	if whereIdx == -1 {
 		return "", errors.New("UPDATE without WHERE is not supported")
 	}
+	if whereIdx < setIdx {
+		return "", errors.New("invalid syntax for UPDATE")
+	}
 
 	tableName := strings.TrimSpace(query[6:setIdx])
 
@@ -407,30 +819,22 @@ func handleUpdate(query string) (string, error) {
 		return "", errors.New("table does not exist")
 	}
 
-	assignmentsRaw := query[setIdx+5 : whereIdx]
-	condRaw := query[whereIdx+7:]
+	assignmentsRaw := query[setIdx+len("SET") : whereIdx]
+	condRaw := query[whereIdx+len("WHERE"):]
 
 	// Parse condition
-	condParts := strings.SplitN(condRaw, "=", 2)
-	if len(condParts) != 2 {
-		return "", errors.New("invalid WHERE syntax")
+	conds, err := parseWhere(condRaw)
+	if err != nil {
+		return "", err
 	}
-	condCol := strings.TrimSpace(condParts[0])
-	condVal := strings.Trim(strings.TrimSpace(condParts[1]), "'")
-
-	condIdx := -1
-	for i, c := range table.Columns {
-		if c.Name == condCol {
-			condIdx = i
-			break
+	for i := range conds {
+		if err := conds[i].bind(table); err != nil {
+			return "", err
 		}
 	}
-	if condIdx == -1 {
-		return "", fmt.Errorf("unknown column %s", condCol)
-	}
 
 	// Parse assignments
-	assignmentList := strings.Split(assignmentsRaw, ",")
+	assignmentList := splitTopLevel(assignmentsRaw, ',')
 	updates := make(map[int]interface{})
 	for _, a := range assignmentList {
 		parts := strings.SplitN(a, "=", 2)
@@ -438,7 +842,7 @@ func handleUpdate(query string) (string, error) {
 			return "", errors.New("invalid SET syntax")
 		}
 		col := strings.TrimSpace(parts[0])
-		val := strings.Trim(strings.TrimSpace(parts[1]), "'")
+		val := unquote(parts[1])
 
 		idx := -1
 		for i, c := range table.Columns {
@@ -450,6 +854,10 @@ func handleUpdate(query string) (string, error) {
 		if idx == -1 {
 			return "", fmt.Errorf("unknown column %s", col)
 		}
+		if strings.EqualFold(strings.TrimSpace(parts[1]), "NULL") {
+			updates[idx] = nil
+			continue
+		}
 		parsed, err := parseValue(val, table.Columns[idx].Type)
 		if err != nil {
 			return "", fmt.Errorf("invalid %s value for column %s", table.Columns[idx].Type, col)
@@ -457,29 +865,71 @@ func handleUpdate(query string) (string, error) {
 		updates[idx] = parsed
 	}
 
-	var cond interface{}
-	parsedCond, err := parseValue(condVal, table.Columns[condIdx].Type)
-	if err != nil {
-		return "", fmt.Errorf("invalid %s value for column %s", table.Columns[condIdx].Type, condCol)
+	// The rows may reference other tables or be referenced by them.
+	parents := table.referencedTables()
+	refs := table.updatedReferences(updates)
+	read := parents
+	for _, ref := range refs {
+		read = append(read, ref.table)
 	}
-	cond = parsedCond
-
-	updated := 0
-	table.mu.Lock()
-	for i, row := range table.Rows {
-		if row[condIdx] == cond {
-			for idx, val := range updates {
-				if idx < len(row) {
-					row[idx] = val
-				}
+	unlock := lockTables([]*Table{table}, read)
+	// Collect the matching rows first: the scan may walk an index that is
+	// modified when the rows are replaced below.
+	var (
+		matched []int
+		oldRows []Row
+		newRows []Row
+	)
+	err = table.scan(conds, func(i int, row Row) bool {
+		newRow := append(Row(nil), row...)
+		for idx, val := range updates {
+			if idx < len(newRow) {
+				newRow[idx] = val
 			}
-			old := table.Rows[i]
-			table.Rows[i] = row
-			table.updateIndexes(old, row, i)
-			updated++
 		}
+		matched = append(matched, i)
+		oldRows = append(oldRows, row)
+		newRows = append(newRows, newRow)
+		return true
+	})
+	for _, row := range newRows {
+		if err != nil {
+			break
+		}
+		err = table.checkUpdatedNotNull(row)
 	}
-	table.mu.Unlock()
+	if err == nil {
+		_, err = table.checkRows(newRows)
+	}
+	if err == nil {
+		_, err = table.checkReferences(newRows, parents)
+	}
+	if err == nil {
+		err = table.checkReferencedUpdate(matched, newRows, refs)
+	}
+	if err == nil {
+		err = table.checkUniqueUpdate(matched, newRows)
+	}
+	if err == nil {
+		err = appendWAL(query)
+	}
+	if err != nil {
+		unlock()
+		return "", err
+	}
+	// Only a paged row can fail to be written, leaving the rows before it
+	// changed.
+	resultCache.InvalidateTable(table.Name)
+	for k, i := range matched {
+		if err := table.setRow(i, newRows[k]); err != nil {
+			unlock()
+			return "", err
+		}
+		table.updateIndexes(oldRows[k], newRows[k], i)
+	}
+	table.Sequence = table.updatedSequence(newRows)
+	updated := len(matched)
+	unlock()
 
 	if err := SaveBinaryDB(); err != nil {
 		return "", err
@@ -491,22 +941,57 @@ func handleUpdate(query string) (string, error) {
 	return fmt.Sprintf("%d rows updated.", updated), nil
 }
 
+// handleDump handles DUMP [filename] [SCHEMA ONLY | DATA ONLY]
+// [TABLES t1, t2, ...].
 func handleDump(query string) (string, error) {
-	tokens := strings.Fields(query)
+	tokens := strings.Fields(query)[1:]
 	filename := "dump.sql"
-	if len(tokens) > 1 {
-		filename = tokens[1]
+	if len(tokens) > 0 {
+		switch strings.ToUpper(tokens[0]) {
+		case "SCHEMA", "DATA", "TABLES":
+		default:
+			filename, tokens = unquote(tokens[0]), tokens[1:]
+		}
 	}
-	if err := SaveSQLDump(filename); err != nil {
+	var opts DumpOptions
+	for len(tokens) > 0 {
+		switch kw := strings.ToUpper(tokens[0]); {
+		case (kw == "SCHEMA" || kw == "DATA") && len(tokens) > 1 && strings.ToUpper(tokens[1]) == "ONLY":
+			opts.SchemaOnly = opts.SchemaOnly || kw == "SCHEMA"
+			opts.DataOnly = opts.DataOnly || kw == "DATA"
+			tokens = tokens[2:]
+		case kw == "TABLES" && len(tokens) > 1:
+			for _, name := range strings.Split(strings.Join(tokens[1:], " "), ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					opts.Tables = append(opts.Tables, name)
+				}
+			}
+			tokens = nil
+		default:
+			return "", errors.New("invalid DUMP syntax")
+		}
+	}
+	if err := SaveSQLDumpWith(filename, opts); err != nil {
 		return "", err
 	}
 	return fmt.Sprintf("Dump saved to %s.", filename), nil
 }
 
 func parseValue(val string, ct ColumnType) (interface{}, error) {
-	switch ct {
+	switch ct.Base() {
 	case TypeInt:
 		return strconv.Atoi(val)
+	case TypeBigInt:
+		return strconv.ParseInt(val, 10, 64)
+	case TypeTimestamp:
+		return parseTimestamp(val)
+	case TypeDate:
+		return parseDate(val)
+	case TypeBlob:
+		return parseBlob(val)
+	case TypeDecimal:
+		precision, scale := ct.decimalSpec()
+		return parseDecimal(val, precision, scale)
 	case TypeFloat:
 		return strconv.ParseFloat(val, 64)
 	case TypeBool:
@@ -523,50 +1008,425 @@ func parseValue(val string, ct ColumnType) (interface{}, error) {
 	}
 }
 
-func (t *Table) createIndex(column string) error {
-	idx := -1
-	for i, c := range t.Columns {
-		if c.Name == column {
-			idx = i
-			break
+func parseColumnDef(def string) (Column, error) {
+	def = strings.TrimSpace(def)
+	parts := strings.Fields(def)
+	col := Column{Name: parts[0], Type: TypeText}
+	rest := parts[1:]
+	skip := 1
+	if len(rest) > 0 {
+		word, _ := cutWord(rest[0])
+		switch strings.ToUpper(word) {
+		case "PRIMARY", "UNIQUE", "DEFAULT", "CHECK", "REFERENCES", "AUTOINCREMENT", "AUTO_INCREMENT":
+		default:
+			// Type parameters may be written with spaces: DECIMAL (10, 2).
+			typ, n := rest[0], 1
+			for n < len(rest) && (strings.HasPrefix(rest[n], "(") || strings.Count(typ, "(") > strings.Count(typ, ")")) {
+				typ += rest[n]
+				n++
+			}
+			switch strings.ToUpper(typ) {
+			case "SERIAL":
+				col.Type, col.AutoIncrement = TypeInt, true
+			case "BIGSERIAL":
+				col.Type, col.AutoIncrement = TypeBigInt, true
+			default:
+				ct, err := parseColumnType(typ)
+				if err != nil {
+					return Column{}, err
+				}
+				col.Type = ct
+			}
+			skip += n
 		}
 	}
-	if idx == -1 {
-		return fmt.Errorf("unknown column %s", column)
+
+	// Constraints are parsed from the text rather than from its fields so
+	// that literals and conditions keep their spaces.
+	s := def
+	for ; skip > 0; skip-- {
+		_, s = cutField(s)
 	}
-	m := make(map[interface{}][]int)
-	for i, row := range t.Rows {
-		v := row[idx]
-		m[v] = append(m[v], i)
+	for s != "" {
+		word, tail := cutWord(s)
+		switch strings.ToUpper(word) {
+		case "PRIMARY":
+			key, after := cutWord(tail)
+			if !strings.EqualFold(key, "KEY") {
+				return Column{}, fmt.Errorf("invalid constraint for column %s", col.Name)
+			}
+			col.PrimaryKey = true
+			tail = after
+		case "UNIQUE":
+			col.Unique = true
+		case "AUTOINCREMENT", "AUTO_INCREMENT":
+			col.AutoIncrement = true
+		case "DEFAULT":
+			lit, after, ok := cutLiteral(tail)
+			if !ok {
+				return Column{}, fmt.Errorf("invalid DEFAULT for column %s", col.Name)
+			}
+			col.Default, tail = lit, after
+		case "CHECK":
+			close := -1
+			if strings.HasPrefix(tail, "(") {
+				close = matchingParen(tail, 0)
+			}
+			if close == -1 || strings.TrimSpace(tail[1:close]) == "" {
+				return Column{}, fmt.Errorf("invalid CHECK for column %s", col.Name)
+			}
+			col.Check, tail = strings.TrimSpace(tail[1:close]), tail[close+1:]
+		case "REFERENCES":
+			fk, after, err := parseForeignKey(tail)
+			if err != nil {
+				return Column{}, fmt.Errorf("%w for column %s", err, col.Name)
+			}
+			col.References, tail = fk, after
+		case "ON":
+			kw, after := cutWord(tail)
+			if col.References == nil || !strings.EqualFold(kw, "DELETE") {
+				return Column{}, fmt.Errorf("invalid constraint for column %s", col.Name)
+			}
+			action, after, err := parseOnDelete(after)
+			if err != nil {
+				return Column{}, fmt.Errorf("%w for column %s", err, col.Name)
+			}
+			col.References.OnDelete, tail = action, after
+		default:
+			return Column{}, fmt.Errorf("unknown constraint %s for column %s", word, col.Name)
+		}
+		s = strings.TrimSpace(tail)
+	}
+	return col, nil
+}
+
+// cutField splits the first whitespace-separated field off s.
+func cutField(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	end := strings.IndexAny(s, " \t\r\n")
+	if end == -1 {
+		return s, ""
+	}
+	return s[:end], strings.TrimSpace(s[end:])
+}
+
+// cutWord splits the first word off s. A word also ends where a
+// parenthesis starts, so that CHECK(x > 0) needs no space.
+func cutWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	end := strings.IndexAny(s, " \t\r\n(")
+	if end == -1 {
+		return s, ""
+	}
+	return s[:end], strings.TrimSpace(s[end:])
+}
+
+// cutLiteral splits a leading literal off s: a quoted string, a BLOB
+// literal or a single field. It reports false for a missing literal or an
+// unterminated string.
+func cutLiteral(s string) (string, string, bool) {
+	s = strings.TrimSpace(s)
+	start := 0
+	if len(s) > 1 && (s[0] == 'X' || s[0] == 'x') && s[1] == '\'' {
+		start = 1
+	}
+	if start < len(s) && s[start] == '\'' {
+		for i := start + 1; i < len(s); i++ {
+			if s[i] != '\'' {
+				continue
+			}
+			if i+1 < len(s) && s[i+1] == '\'' {
+				i++
+				continue
+			}
+			return s[:i+1], strings.TrimSpace(s[i+1:]), true
+		}
+		return "", "", false
+	}
+	lit, rest := cutField(s)
+	return lit, rest, lit != ""
+}
+
+// parseTableOptions parses the optional WITH (key=value, ...) clause that
+// follows the column list of CREATE TABLE.
+func parseTableOptions(s string) ([]option, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if len(s) < 4 || !strings.EqualFold(s[:4], "WITH") {
+		return nil, fmt.Errorf("unexpected %s after column list", s)
+	}
+	s = strings.TrimSpace(s[4:])
+	if !strings.HasPrefix(s, "(") || !strings.HasSuffix(s, ")") {
+		return nil, errors.New("invalid syntax for WITH options")
+	}
+	var opts []option
+	for _, raw := range splitTopLevel(s[1:len(s)-1], ',') {
+		key, value, ok := strings.Cut(raw, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid table option %s", strings.TrimSpace(raw))
+		}
+		opt := option{key: strings.ToLower(strings.TrimSpace(key)), value: unquote(value)}
+		switch opt.key {
+		case "storage":
+			kind, err := parseStorageKind(opt.value)
+			if err != nil {
+				return nil, err
+			}
+			opt.value = string(kind)
+		case "sequence":
+			if n, err := strconv.ParseInt(opt.value, 10, 64); err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid sequence %s", opt.value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown table option %s", opt.key)
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+func (t *Table) createIndex(columns []string, unique bool) error {
+	idx, err := t.buildIndex(columns, unique)
+	if err != nil {
+		return err
 	}
 	if t.Indexes == nil {
 		t.Indexes = make(map[string]*Index)
 	}
-	t.Indexes[column] = &Index{Column: column, idx: idx, Values: m}
+	t.Indexes[idx.Name()] = idx
 	return nil
 }
 
-func (t *Table) addToIndexes(row Row, rowIdx int) {
+// buildIndex indexes the current rows over columns without attaching the
+// index to the table. A column declared PRIMARY KEY or UNIQUE always gets a
+// unique index so that a plain CREATE INDEX cannot drop the constraint.
+func (t *Table) buildIndex(columns []string, unique bool) (*Index, error) {
+	if len(columns) == 0 {
+		return nil, errors.New("index requires at least one column")
+	}
+	idx := &Index{Columns: columns, Unique: unique, tree: newBTree()}
+	for _, name := range columns {
+		col := t.columnIndex(name)
+		if col == -1 {
+			return nil, fmt.Errorf("unknown column %s", name)
+		}
+		idx.cols = append(idx.cols, col)
+	}
+	if len(idx.cols) == 1 {
+		c := t.Columns[idx.cols[0]]
+		idx.Unique = unique || c.PrimaryKey || c.Unique
+	}
+	var err error
+	serr := t.eachRow(func(i int, row Row) bool {
+		key := idx.key(row)
+		if idx.Unique && !idx.hasNull(row) && idx.tree.Get(key) != nil {
+			err = t.uniqueViolation(idx, key)
+			return false
+		}
+		idx.tree.Insert(key, i)
+		return true
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// checkUnique verifies that row does not duplicate a value held by a unique
+// index. Rows listed in ignore are treated as if they were already removed.
+func (t *Table) checkUnique(row Row, ignore map[int]bool) error {
 	for _, idx := range t.Indexes {
-		val := row[idx.idx]
-		idx.Values[val] = append(idx.Values[val], rowIdx)
+		if !idx.Unique || idx.hasNull(row) {
+			continue
+		}
+		key := idx.key(row)
+		for _, rid := range idx.tree.Get(key) {
+			if !ignore[rid] {
+				return t.uniqueViolation(idx, key)
+			}
+		}
 	}
+	return nil
 }
 
-func (t *Table) updateIndexes(oldRow, newRow Row, rowIdx int) {
+// checkUniqueInsert verifies that appending rows keeps every unique index
+// free of duplicates. On a violation it returns the position of the first
+// offending row.
+func (t *Table) checkUniqueInsert(rows []Row) (int, error) {
+	var seen map[*Index]*btree
+	if len(rows) > 1 {
+		seen = make(map[*Index]*btree)
+	}
+	for k, row := range rows {
+		for _, idx := range t.Indexes {
+			if !idx.Unique || idx.hasNull(row) {
+				continue
+			}
+			key := idx.key(row)
+			if len(idx.tree.Get(key)) > 0 || seen[idx] != nil && seen[idx].Get(key) != nil {
+				return k, t.uniqueViolation(idx, key)
+			}
+			if seen != nil {
+				if seen[idx] == nil {
+					seen[idx] = newBTree()
+				}
+				seen[idx].Insert(key, k)
+			}
+		}
+	}
+	return -1, nil
+}
+
+// insertRows appends rows as a single change logged by the WAL entries:
+// either every row is inserted or, if a row fails a CHECK, references a
+// missing row or violates a unique index, none is and its position is
+// returned with the error. Rows without a value for the AUTOINCREMENT
+// column get one in place.
+func (t *Table) insertRows(rows []Row, entries ...string) (int, error) {
+	parents := t.referencedTables()
+	unlock := lockTables([]*Table{t}, parents)
+	defer unlock()
+	seq := t.assignSequence(rows)
+	if k, err := t.checkRows(rows); err != nil {
+		return k, err
+	}
+	if k, err := t.checkReferences(rows, parents); err != nil {
+		return k, err
+	}
+	if k, err := t.checkUniqueInsert(rows); err != nil {
+		return k, err
+	}
+	if err := appendWAL(entries...); err != nil {
+		return -1, err
+	}
+	t.Sequence = seq
+	resultCache.InvalidateTable(t.Name)
+	for _, row := range rows {
+		pos, err := t.appendRow(row)
+		if err != nil {
+			return -1, err
+		}
+		t.addToIndexes(row, pos)
+	}
+	return -1, nil
+}
+
+// assignSequence fills the AUTOINCREMENT column of rows that leave it NULL
+// with the values following t.Sequence and returns the new counter.
+// Explicit values above the counter move it forward. The counter is only
+// stored once the rows are inserted, so a rejected INSERT uses up no
+// values. The caller must hold t.mu.
+func (t *Table) assignSequence(rows []Row) int64 {
+	seq := t.Sequence
+	col := t.autoIncrementColumn()
+	if col == -1 {
+		return seq
+	}
+	for _, row := range rows {
+		switch v := row[col].(type) {
+		case nil:
+			seq++
+			if t.Columns[col].Type == TypeInt {
+				row[col] = int(seq)
+			} else {
+				row[col] = seq
+			}
+		case int:
+			seq = max(seq, int64(v))
+		case int64:
+			seq = max(seq, v)
+		}
+	}
+	return seq
+}
+
+// updatedSequence returns the counter moved past the AUTOINCREMENT values
+// that rows are updated to, so that later INSERTs do not hand out a value
+// that is already taken. The caller must hold t.mu.
+func (t *Table) updatedSequence(rows []Row) int64 {
+	seq := t.Sequence
+	if col := t.autoIncrementColumn(); col != -1 {
+		for _, row := range rows {
+			if v, ok := toInt64(row[col]); ok {
+				seq = max(seq, v)
+			}
+		}
+	}
+	return seq
+}
+
+// autoIncrementColumn returns the position of the AUTOINCREMENT column, or
+// -1 if the table has none.
+func (t *Table) autoIncrementColumn() int {
+	for i, c := range t.Columns {
+		if c.AutoIncrement {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkUniqueUpdate verifies that replacing the rows at positions matched
+// with newRows keeps every unique index free of duplicates.
+func (t *Table) checkUniqueUpdate(matched []int, newRows []Row) error {
+	ignore := make(map[int]bool, len(matched))
+	for _, i := range matched {
+		ignore[i] = true
+	}
 	for _, idx := range t.Indexes {
-		ov := oldRow[idx.idx]
-		nv := newRow[idx.idx]
-		if ov == nv {
+		if !idx.Unique {
 			continue
 		}
-		arr := idx.Values[ov]
-		for i := range arr {
-			if arr[i] == rowIdx {
-				idx.Values[ov] = append(arr[:i], arr[i+1:]...)
-				break
+		seen := newBTree()
+		for k, row := range newRows {
+			if idx.hasNull(row) {
+				continue
 			}
+			key := idx.key(row)
+			if seen.Get(key) != nil {
+				return t.uniqueViolation(idx, key)
+			}
+			seen.Insert(key, k)
+		}
+	}
+	for _, row := range newRows {
+		if err := t.checkUnique(row, ignore); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Table) uniqueViolation(idx *Index, key interface{}) error {
+	if len(idx.cols) > 1 {
+		return fmt.Errorf("%w: duplicate value %v for UNIQUE columns (%s)", ErrConstraint, key, strings.Join(idx.Columns, ", "))
+	}
+	kind := "UNIQUE"
+	if t.Columns[idx.cols[0]].PrimaryKey {
+		kind = "PRIMARY KEY"
+	}
+	return fmt.Errorf("%w: duplicate value %v for %s column %s", ErrConstraint, key, kind, idx.Columns[0])
+}
+
+func (t *Table) addToIndexes(row Row, rowIdx int) {
+	for _, idx := range t.Indexes {
+		idx.tree.Insert(idx.key(row), rowIdx)
+	}
+}
+
+func (t *Table) updateIndexes(oldRow, newRow Row, rowIdx int) {
+	for _, idx := range t.Indexes {
+		ov := idx.key(oldRow)
+		nv := idx.key(newRow)
+		if compareValues(ov, nv) == 0 {
+			continue
 		}
-		idx.Values[nv] = append(idx.Values[nv], rowIdx)
+		idx.tree.Delete(ov, rowIdx)
+		idx.tree.Insert(nv, rowIdx)
 	}
 }
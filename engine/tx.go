@@ -32,8 +32,12 @@ func (tx *Tx) Commit() error {
 		walMu.Unlock()
 		return err
 	}
-	for _, line := range tx.wal {
-		if _, err := f.WriteString(line + "\n"); err != nil {
+	for _, entry := range tx.wal {
+		line, err := encodeWALEntry(entry)
+		if err == nil {
+			_, err = f.WriteString(line + "\n")
+		}
+		if err != nil {
 			_ = f.Close()
 			walMu.Unlock()
 			return err
@@ -43,6 +47,7 @@ func (tx *Tx) Commit() error {
 	walMu.Unlock()
 
 	txCtx = nil
+	releaseTables(tx.snapshot)
 	if err := saveBinaryDBNoLock(); err != nil {
 		dbMu.Unlock()
 		return err
@@ -57,33 +62,49 @@ func (tx *Tx) Commit() error {
 
 // Rollback restores the snapshot state and discards changes.
 func (tx *Tx) Rollback() {
+	releaseTables(Tables)
 	Tables = tx.snapshot
 	txCtx = nil
+	resultCache.Purge()
 	dbMu.Unlock()
 }
 
+// releaseTables returns the buffer pool pages of tables that are no longer
+// used.
+func releaseTables(tables map[string]*Table) {
+	for _, t := range tables {
+		t.release()
+	}
+}
+
 // cloneTables performs a deep copy of tables for transaction snapshots.
 func cloneTables(src map[string]*Table) map[string]*Table {
 	newMap := make(map[string]*Table, len(src))
 	for name, tbl := range src {
 		t := &Table{
-			Name:    tbl.Name,
-			Columns: append([]Column(nil), tbl.Columns...),
-			Rows:    make([]Row, len(tbl.Rows)),
+			Name:     tbl.Name,
+			Columns:  append([]Column(nil), tbl.Columns...),
+			Rows:     make([]Row, len(tbl.Rows)),
+			Stats:    tbl.Stats,
+			Storage:  tbl.Storage,
+			Sequence: tbl.Sequence,
+			checks:   tbl.checks,
 		}
 		for i, row := range tbl.Rows {
 			nr := make(Row, len(row))
 			copy(nr, row)
 			t.Rows[i] = nr
 		}
+		if tbl.store != nil {
+			t.store = tbl.store.clone()
+		}
+		if tbl.pages != nil {
+			t.pages, t.Rows = tbl.pages.clone(), nil
+		}
 		if len(tbl.Indexes) > 0 {
 			t.Indexes = make(map[string]*Index, len(tbl.Indexes))
 			for col, idx := range tbl.Indexes {
-				ni := &Index{Column: idx.Column, idx: idx.idx, Values: make(map[interface{}][]int)}
-				for v, arr := range idx.Values {
-					ni.Values[v] = append([]int(nil), arr...)
-				}
-				t.Indexes[col] = ni
+				t.Indexes[col] = &Index{Columns: idx.Columns, Unique: idx.Unique, cols: idx.cols, tree: idx.tree.clone()}
 			}
 		}
 		newMap[name] = t
@@ -0,0 +1,291 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// onConflict is the ON CONFLICT clause of an INSERT.
+type onConflict struct {
+	index  *Index // unique index of the conflict target; nil means any
+	update bool   // DO UPDATE rather than DO NOTHING
+	sets   []conflictSet
+}
+
+// conflictSet is an assignment of DO UPDATE SET: a literal value, or the
+// value the row proposed for insertion holds in column excluded.
+type conflictSet struct {
+	col      int
+	value    interface{}
+	excluded int // -1 for a literal
+}
+
+// splitOnConflict splits an ON CONFLICT clause off the end of an INSERT
+// and returns what follows ON CONFLICT.
+func splitOnConflict(s string) (string, string, bool) {
+	for off := 0; ; {
+		idx := keywordIndex(s[off:], "ON")
+		if idx == -1 {
+			return s, "", false
+		}
+		idx += off
+		if word, rest := cutWord(s[idx+len("ON"):]); strings.EqualFold(word, "CONFLICT") {
+			return strings.TrimSpace(s[:idx]), rest, true
+		}
+		off = idx + len("ON")
+	}
+}
+
+// parseOnConflict parses "[(<column>, ...)] DO NOTHING" or
+// "(<column>, ...) DO UPDATE SET <column> = <value> | EXCLUDED.<column>, ...".
+func (t *Table) parseOnConflict(s string) (*onConflict, error) {
+	oc := &onConflict{}
+	if strings.HasPrefix(s, "(") {
+		close := matchingParen(s, 0)
+		if close == -1 {
+			return nil, errors.New("invalid ON CONFLICT target")
+		}
+		var cols []string
+		for _, name := range strings.Split(s[1:close], ",") {
+			cols = append(cols, strings.TrimSpace(name))
+		}
+		idx := t.Indexes[indexName(cols)]
+		if idx == nil || !idx.Unique {
+			return nil, fmt.Errorf("no unique index on (%s) for ON CONFLICT", strings.Join(cols, ", "))
+		}
+		oc.index = idx
+		s = s[close+1:]
+	}
+	word, rest := cutWord(s)
+	action, rest := cutWord(rest)
+	if !strings.EqualFold(word, "DO") {
+		return nil, errors.New("invalid ON CONFLICT syntax")
+	}
+	switch strings.ToUpper(action) {
+	case "NOTHING":
+		if rest != "" {
+			return nil, errors.New("invalid ON CONFLICT syntax")
+		}
+		return oc, nil
+	case "UPDATE":
+	default:
+		return nil, errors.New("invalid ON CONFLICT syntax")
+	}
+	if oc.index == nil {
+		return nil, errors.New("ON CONFLICT DO UPDATE requires a conflict target")
+	}
+	set, rest := cutWord(rest)
+	if !strings.EqualFold(set, "SET") || rest == "" {
+		return nil, errors.New("invalid ON CONFLICT syntax")
+	}
+	oc.update = true
+	for _, a := range splitTopLevel(rest, ',') {
+		name, raw, ok := strings.Cut(a, "=")
+		if !ok {
+			return nil, errors.New("invalid SET syntax")
+		}
+		name, raw = strings.TrimSpace(name), strings.TrimSpace(raw)
+		col := t.columnIndex(name)
+		if col == -1 {
+			return nil, fmt.Errorf("unknown column %s", name)
+		}
+		c := t.Columns[col]
+		set := conflictSet{col: col, excluded: -1}
+		switch {
+		case len(raw) > len("EXCLUDED.") && strings.EqualFold(raw[:len("EXCLUDED.")], "EXCLUDED."):
+			ex := t.columnIndex(raw[len("EXCLUDED."):])
+			if ex == -1 {
+				return nil, fmt.Errorf("unknown column %s", raw)
+			}
+			if t.Columns[ex].Type != c.Type {
+				return nil, fmt.Errorf("%s cannot be assigned to %s column %s", raw, c.Type, c.Name)
+			}
+			set.excluded = ex
+		case strings.EqualFold(raw, "NULL"):
+		default:
+			v, err := parseValue(unquote(raw), c.Type)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s value for column %s", c.Type, c.Name)
+			}
+			set.value = v
+		}
+		oc.sets = append(oc.sets, set)
+	}
+	return oc, nil
+}
+
+// updates returns the columns set by DO UPDATE.
+func (oc *onConflict) updates() map[int]interface{} {
+	cols := make(map[int]interface{}, len(oc.sets))
+	for _, set := range oc.sets {
+		cols[set.col] = nil
+	}
+	return cols
+}
+
+// conflicts returns the unique indexes a row proposed for insertion is
+// checked against: the conflict target, or every unique index.
+func (t *Table) conflicts(oc *onConflict) []*Index {
+	if oc.index != nil {
+		return []*Index{oc.index}
+	}
+	var indexes []*Index
+	for _, idx := range t.Indexes {
+		if idx.Unique {
+			indexes = append(indexes, idx)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Name() < indexes[j].Name() })
+	return indexes
+}
+
+// upsertRows inserts rows as a single change, except that a row that
+// conflicts with an existing row on a unique index of oc is skipped or
+// updates that row instead. The rows are matched against the table as it
+// was before the statement, so DO UPDATE affecting the same row twice is
+// an error. Either every change is made or none is. It returns the
+// inserted rows and the number of updated rows.
+func (t *Table) upsertRows(rows []Row, oc *onConflict, query string) ([]Row, int, error) {
+	parents := t.referencedTables()
+	var refs []fkRef
+	if oc.update {
+		refs = t.updatedReferences(oc.updates())
+	}
+	read := parents
+	for _, ref := range refs {
+		read = append(read, ref.table)
+	}
+	unlock := lockTables([]*Table{t}, read)
+	defer unlock()
+
+	var (
+		inserts []Row
+		matched []int
+		oldRows []Row
+		newRows []Row
+	)
+	indexes := t.conflicts(oc)
+	pending := make([]*btree, len(indexes))
+	for i := range pending {
+		pending[i] = newBTree()
+	}
+	updated := make(map[int]bool)
+	for k, row := range rows {
+		pos, again := -1, false
+		for i, idx := range indexes {
+			// NULL, like an AUTOINCREMENT value still to be assigned,
+			// conflicts with nothing.
+			if idx.hasNull(row) {
+				continue
+			}
+			key := idx.key(row)
+			if ids := idx.tree.Get(key); len(ids) > 0 {
+				pos = ids[0]
+				break
+			}
+			if len(pending[i].Get(key)) > 0 {
+				again = true
+				break
+			}
+		}
+		switch {
+		case pos == -1 && !again:
+			for i, idx := range indexes {
+				pending[i].Insert(idx.key(row), k)
+			}
+			inserts = append(inserts, row)
+		case !oc.update:
+		case again || updated[pos]:
+			return nil, 0, rowError(len(rows), k, errors.New("ON CONFLICT DO UPDATE cannot affect a row twice"))
+		default:
+			old, err := t.row(pos)
+			if err != nil {
+				return nil, 0, err
+			}
+			newRow := append(Row(nil), old...)
+			for _, set := range oc.sets {
+				if set.excluded >= 0 {
+					newRow[set.col] = row[set.excluded]
+				} else {
+					newRow[set.col] = set.value
+				}
+			}
+			if err := t.checkUpdatedNotNull(newRow); err != nil {
+				return nil, 0, rowError(len(rows), k, err)
+			}
+			updated[pos] = true
+			matched = append(matched, pos)
+			oldRows = append(oldRows, old)
+			newRows = append(newRows, newRow)
+		}
+	}
+	if len(inserts) == 0 && len(matched) == 0 {
+		return nil, 0, nil
+	}
+
+	seq := max(t.assignSequence(inserts), t.updatedSequence(newRows))
+	changed := append(append([]Row(nil), newRows...), inserts...)
+	_, err := t.checkRows(changed)
+	if err == nil {
+		_, err = t.checkReferences(changed, parents)
+	}
+	if err == nil {
+		err = t.checkReferencedUpdate(matched, newRows, refs)
+	}
+	if err == nil {
+		// Checking the inserted rows like updated ones also catches a
+		// duplicate between an inserted row and the new values of an
+		// updated row.
+		err = t.checkUniqueUpdate(matched, changed)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Replaying the statement would evaluate CURRENT_TIMESTAMP again, so
+	// the changes are logged as they were made.
+	entries := []string{query}
+	if t.hasVolatileDefault() {
+		entries = entries[:0]
+		for k := range matched {
+			entries = append(entries, t.upsertEntry(oc.index, oldRows[k], newRows[k]))
+		}
+		entries = append(entries, t.insertEntries(inserts)...)
+	}
+	if err := appendWAL(entries...); err != nil {
+		return nil, 0, err
+	}
+	resultCache.InvalidateTable(t.Name)
+	for k, pos := range matched {
+		if err := t.setRow(pos, newRows[k]); err != nil {
+			return nil, 0, err
+		}
+		t.updateIndexes(oldRows[k], newRows[k], pos)
+	}
+	for _, row := range inserts {
+		pos, err := t.appendRow(row)
+		if err != nil {
+			return nil, 0, err
+		}
+		t.addToIndexes(row, pos)
+	}
+	t.Sequence = seq
+	return inserts, len(matched), nil
+}
+
+// upsertEntry returns a WAL entry replacing the row with the key old holds
+// in idx by newRow.
+func (t *Table) upsertEntry(idx *Index, old, newRow Row) string {
+	values := append(Row(nil), newRow...)
+	for _, c := range idx.cols {
+		values[c] = old[c]
+	}
+	sets := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		sets[i] = c.Name + " = " + dumpLiteral(newRow[i])
+	}
+	return fmt.Sprintf("INSERT INTO %s VALUES %s ON CONFLICT (%s) DO UPDATE SET %s",
+		t.Name, buildValuesSQL(values), strings.Join(idx.Columns, ", "), strings.Join(sets, ", "))
+}
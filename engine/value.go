@@ -0,0 +1,373 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tuple is the key of a composite index: the values of the indexed columns
+// in index order.
+type tuple []interface{}
+
+// String renders the tuple the way it is written in SQL.
+func (t tuple) String() string {
+	parts := make([]string, len(t))
+	for i, v := range t {
+		parts[i] = fmt.Sprint(v)
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+// hasPrefix reports whether the first values of t equal prefix.
+func (t tuple) hasPrefix(prefix tuple) bool {
+	if len(t) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if compareValues(t[i], prefix[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Timestamp is a TIMESTAMP value: microseconds since the Unix epoch, UTC.
+type Timestamp int64
+
+// timestampLayout is RFC 3339 with up to microsecond precision.
+const timestampLayout = "2006-01-02T15:04:05.999999Z07:00"
+
+// timestampInputLayouts are accepted when parsing TIMESTAMP literals; values
+// without a zone are taken as UTC.
+var timestampInputLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// Time returns the timestamp as a time.Time in UTC.
+func (t Timestamp) Time() time.Time { return time.UnixMicro(int64(t)).UTC() }
+
+func (t Timestamp) String() string { return t.Time().Format(timestampLayout) }
+
+func parseTimestamp(s string) (Timestamp, error) {
+	for _, layout := range timestampInputLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return Timestamp(t.UnixMicro()), nil
+		}
+	}
+	return 0, errors.New("invalid TIMESTAMP value")
+}
+
+// Date is a DATE value: days since the Unix epoch.
+type Date int64
+
+const secondsPerDay = 24 * 60 * 60
+
+// Time returns midnight UTC of the date.
+func (d Date) Time() time.Time { return time.Unix(int64(d)*secondsPerDay, 0).UTC() }
+
+func (d Date) String() string { return d.Time().Format("2006-01-02") }
+
+func parseDate(s string) (Date, error) {
+	t, err := time.ParseInLocation("2006-01-02", s, time.UTC)
+	if err != nil {
+		return 0, errors.New("invalid DATE value")
+	}
+	// Unix seconds of midnight are always a multiple of a day.
+	return Date(t.Unix() / secondsPerDay), nil
+}
+
+// Blob is a BLOB value. It is written as a hex literal X'...' in SQL and
+// rendered as plain hex in query results.
+type Blob []byte
+
+func (b Blob) String() string { return hex.EncodeToString(b) }
+
+// parseBlob accepts X'0a1b' literals as well as bare hex digits.
+func parseBlob(s string) (Blob, error) {
+	if len(s) >= 3 && (s[0] == 'X' || s[0] == 'x') && s[1] == '\'' && s[len(s)-1] == '\'' {
+		s = s[2 : len(s)-1]
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid BLOB value")
+	}
+	return Blob(b), nil
+}
+
+// Decimal is a fixed-point DECIMAL value equal to Unscaled / 10^Scale.
+type Decimal struct {
+	Unscaled int64
+	Scale    int
+}
+
+func (d Decimal) String() string {
+	neg := d.Unscaled < 0
+	// uint64 keeps the magnitude of math.MinInt64 representable.
+	mag := uint64(d.Unscaled)
+	if neg {
+		mag = -mag
+	}
+	digits := strconv.FormatUint(mag, 10)
+	if d.Scale > 0 {
+		if len(digits) <= d.Scale {
+			digits = strings.Repeat("0", d.Scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-d.Scale] + "." + digits[len(digits)-d.Scale:]
+	}
+	if neg {
+		return "-" + digits
+	}
+	return digits
+}
+
+func (d Decimal) rat() *big.Rat {
+	den := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d.Scale)), nil)
+	return new(big.Rat).SetFrac(big.NewInt(d.Unscaled), den)
+}
+
+// maxDecimalPrecision is the number of decimal digits that always fit into
+// the int64 holding the unscaled value.
+const maxDecimalPrecision = 18
+
+// parseDecimal parses a plain decimal number into a value with the given
+// precision and scale. Extra fractional digits are rounded half away from
+// zero; values needing more than precision digits are rejected.
+func parseDecimal(s string, precision, scale int) (Decimal, error) {
+	invalid := fmt.Errorf("invalid DECIMAL(%d,%d) value", precision, scale)
+	neg := false
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	intPart, frac, _ := strings.Cut(s, ".")
+	if intPart == "" && frac == "" || !isDigits(intPart) || !isDigits(frac) {
+		return Decimal{}, invalid
+	}
+	roundUp := false
+	if len(frac) > scale {
+		roundUp = frac[scale] >= '5'
+		frac = frac[:scale]
+	}
+	frac += strings.Repeat("0", scale-len(frac))
+	intPart = strings.TrimLeft(intPart, "0")
+	if len(intPart) > precision-scale {
+		return Decimal{}, invalid
+	}
+
+	var unscaled int64
+	if digits := intPart + frac; digits != "" {
+		n, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil {
+			return Decimal{}, invalid
+		}
+		unscaled = n
+	}
+	if roundUp {
+		unscaled++
+		if unscaled >= pow10(precision) {
+			return Decimal{}, invalid
+		}
+	}
+	if neg {
+		unscaled = -unscaled
+	}
+	return Decimal{Unscaled: unscaled, Scale: scale}, nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// formatValue renders a value for query output; nil is NULL.
+func formatValue(v interface{}) string {
+	if v == nil {
+		return "NULL"
+	}
+	return fmt.Sprint(v)
+}
+
+// compareValues orders two column values. Values of different kinds are
+// ordered bool < numbers < dates and timestamps < strings < blobs so that
+// the ordering stays total even for legacy rows whose values could not be
+// parsed into the column type.
+func compareValues(a, b interface{}) int {
+	ra, rb := valueRank(a), valueRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+	switch av := a.(type) {
+	case bool:
+		bv := b.(bool)
+		switch {
+		case av == bv:
+			return 0
+		case !av:
+			return -1
+		default:
+			return 1
+		}
+	case int, int64:
+		if bv, ok := toInt64(b); ok {
+			x, _ := toInt64(av)
+			return compareInt64s(x, bv)
+		}
+		return compareFloats(toFloat(a), toFloat(b))
+	case Decimal:
+		if bv, ok := b.(Decimal); ok {
+			if av.Scale == bv.Scale {
+				return compareInt64s(av.Unscaled, bv.Unscaled)
+			}
+			return av.rat().Cmp(bv.rat())
+		}
+		return compareFloats(toFloat(a), toFloat(b))
+	case float64:
+		return compareFloats(av, toFloat(b))
+	case Timestamp, Date:
+		return compareInt64s(temporalMicros(a), temporalMicros(b))
+	case string:
+		return strings.Compare(av, b.(string))
+	case Blob:
+		return bytes.Compare(av, b.(Blob))
+	case tuple:
+		// Tuples compare element by element; a prefix sorts before every
+		// tuple that extends it.
+		bv := b.(tuple)
+		for i := 0; i < len(av) && i < len(bv); i++ {
+			if c := compareValues(av[i], bv[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(av), len(bv))
+	default:
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	}
+}
+
+func valueRank(v interface{}) int {
+	switch v.(type) {
+	case bool:
+		return 0
+	case int, int64, float64, Decimal:
+		return 1
+	case Timestamp, Date:
+		return 2
+	case string:
+		return 3
+	case Blob:
+		return 4
+	case tuple:
+		return 5
+	default:
+		return 6
+	}
+}
+
+// isNumeric reports whether v lies on a number line: numbers, dates and
+// timestamps. toFloat maps such values onto float64.
+func isNumeric(v interface{}) bool {
+	r := valueRank(v)
+	return r == 1 || r == 2
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	case Decimal:
+		f, _ := n.rat().Float64()
+		return f
+	case Timestamp, Date:
+		return float64(temporalMicros(n))
+	default:
+		return 0
+	}
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+// temporalMicros converts a Timestamp or Date to microseconds since the
+// Unix epoch so that both can be compared.
+func temporalMicros(v interface{}) int64 {
+	switch t := v.(type) {
+	case Timestamp:
+		return int64(t)
+	case Date:
+		return int64(t) * secondsPerDay * 1_000_000
+	default:
+		return 0
+	}
+}
+
+func compareInts(a, b int) int {
+	return compareInt64s(int64(a), int64(b))
+}
+
+func compareInt64s(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compareFloats orders NaN after every other number and equal to itself, so
+// NaN keys keep B-tree order total.
+func compareFloats(a, b float64) int {
+	switch an, bn := math.IsNaN(a), math.IsNaN(b); {
+	case an && bn:
+		return 0
+	case an:
+		return 1
+	case bn:
+		return -1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
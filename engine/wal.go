@@ -2,6 +2,7 @@ package engine
 
 import (
 	"bufio"
+	"fmt"
 	"os"
 	"strings"
 	"sync"
@@ -14,14 +15,23 @@ var (
 	walReplay bool
 )
 
-func appendWAL(entry string) error {
+func appendWAL(entries ...string) error {
 	if walReplay {
 		return nil
 	}
 	if txCtx != nil {
-		txCtx.wal = append(txCtx.wal, entry)
+		txCtx.wal = append(txCtx.wal, entries...)
 		return nil
 	}
+	var b strings.Builder
+	for _, entry := range entries {
+		line, err := encodeWALEntry(entry)
+		if err != nil {
+			return err
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
 	walMu.Lock()
 	defer walMu.Unlock()
 	f, err := os.OpenFile(walFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
@@ -29,7 +39,7 @@ func appendWAL(entry string) error {
 		return err
 	}
 	defer func() { _ = f.Close() }()
-	if _, err := f.WriteString(entry + "\n"); err != nil {
+	if _, err := f.WriteString(b.String()); err != nil {
 		return err
 	}
 	return nil
@@ -44,9 +54,19 @@ func clearWAL() error {
 	}
 	walMu.Lock()
 	defer walMu.Unlock()
+	return archiveAndRemoveWAL()
+}
+
+// archiveAndRemoveWAL archives the entries of walFile, which have been
+// applied to the data file, and removes it. The caller must hold walMu.
+func archiveAndRemoveWAL() error {
+	if err := archiveWAL(); err != nil {
+		return err
+	}
 	if err := os.Remove(walFile); err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	walArchived = 0
 	return nil
 }
 
@@ -68,7 +88,12 @@ func replayWAL() error {
 		if line == "" {
 			continue
 		}
-		if _, err := HandleCommand(line); err != nil {
+		entry, err := decodeWALEntry(line)
+		if err != nil {
+			walReplay = false
+			return fmt.Errorf("replaying WAL: %w", err)
+		}
+		if _, err := HandleCommand(entry); err != nil {
 			walReplay = false
 			return err
 		}
@@ -76,9 +101,9 @@ func replayWAL() error {
 	walReplay = false
 
 	walMu.Lock()
-	err = os.Remove(walFile)
+	err = archiveAndRemoveWAL()
 	walMu.Unlock()
-	if err != nil && !os.IsNotExist(err) {
+	if err != nil {
 		return err
 	}
 	return scanner.Err()
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"minisql/engine"
 )
@@ -17,25 +19,83 @@ func main() {
 	listen := flag.String("listen", "", "start HTTP server on this address")
 	maxRows := flag.Int("maxrows", engine.MaxRowCount, "maximum rows per table")
 	cacheLimit := flag.Int("cache", 1_048_576, "query cache size in bytes")
+	compression := flag.String("compression", "", "data file compression: none or flate (default: keep the file's setting)")
+	poolSize := flag.Int64("pool", 0, "buffer pool budget in bytes for table rows; 0 keeps all rows in memory")
+	keyHex := flag.String("key", "", "hex-encoded AES key encrypting data.mdb and data.wal (default: $"+engine.KeyEnv+")")
+	archiveDir := flag.String("archive", "", "directory archiving applied WAL entries for point-in-time restore")
+	restoreDir := flag.String("restore", "", "restore the backup in this directory, replaying the WAL archive, and exit")
+	untilLSN := flag.Uint64("until-lsn", 0, "with -restore, stop after this LSN")
+	untilTime := flag.String("until-time", "", "with -restore, stop at this RFC 3339 time")
+	loadFile := flag.String("load", "", "execute the SQL file, such as a dump, in one transaction at startup")
 	flag.Parse()
 
 	engine.MaxRowCount = *maxRows
+	engine.BufferPoolSize = *poolSize
+	engine.WALArchiveDir = *archiveDir
 	engine.InitCache(*cacheLimit)
+	if *keyHex != "" {
+		key, err := engine.ParseKey(*keyHex)
+		if err == nil {
+			err = engine.SetEncryptionKey(key)
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+	}
+
+	if *restoreDir != "" {
+		target := engine.RestoreTarget{LSN: *untilLSN}
+		if *untilTime != "" {
+			t, err := time.Parse(time.RFC3339, *untilTime)
+			if err != nil {
+				fmt.Println("Error:", err)
+				return
+			}
+			target.Time = t
+		}
+		lsn, err := engine.Restore(*restoreDir, target)
+		if err != nil {
+			fmt.Println("Error restoring DB:", err)
+			return
+		}
+		fmt.Printf("Restored to LSN %d\n", lsn)
+		return
+	}
 
 	if err := engine.Init(); err != nil {
 		fmt.Println("Error loading DB:", err)
 		return
 	}
+	if *compression != "" {
+		kind, err := engine.ParseCompression(*compression)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		engine.Compression = kind
+		if err := engine.SaveBinaryDB(); err != nil {
+			fmt.Println("Error saving DB:", err)
+			return
+		}
+	}
+
+	if *loadFile != "" {
+		n, err := engine.LoadSQLFile(*loadFile, func(n int) {
+			fmt.Printf("%s: %d statements executed\n", *loadFile, n)
+		})
+		if err != nil {
+			fmt.Println("Error loading SQL:", err)
+			return
+		}
+		fmt.Printf("%s: loaded %d statements\n", *loadFile, n)
+	}
 
 	if *listen != "" {
-		http.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
-			data, _ := io.ReadAll(r.Body)
-			res, err := engine.Execute(string(data))
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			_, _ = w.Write([]byte(res))
+		http.HandleFunc("/query", handleQuery)
+		http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(engine.ResultCacheStats())
 		})
 		log.Printf("Listening on %s", *listen)
 		log.Fatal(http.ListenAndServe(*listen, nil))
@@ -73,3 +133,21 @@ func main() {
 		}
 	}
 }
+
+// handleQuery runs the statement in the request body. Statements that
+// access files are refused: the paths would be resolved on the server
+// with its permissions.
+func handleQuery(w http.ResponseWriter, r *http.Request) {
+	data, _ := io.ReadAll(r.Body)
+	query := string(data)
+	if engine.FileStatement(query) {
+		http.Error(w, "statements that access files are not allowed over HTTP", http.StatusForbidden)
+		return
+	}
+	res, err := engine.Execute(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, _ = w.Write([]byte(res))
+}